@@ -0,0 +1,316 @@
+package overlaynetwork
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/gcash/bchd/chaincfg/chainhash"
+	"github.com/gcash/bchutil"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p-record"
+	"sync"
+	"time"
+)
+
+var (
+	// ACLRefreshInterval is how often we fetch the ACL of a gated topic from
+	// the DHT to pick up changes.
+	ACLRefreshInterval = time.Minute * 10
+
+	// ACLRetryInterval is how often we retry fetching the ACL of a gated
+	// topic until we have loaded it for the first time.
+	ACLRetryInterval = time.Second * 30
+
+	// ErrInvalidACLRecord is returned when an ACL record is malformed, is
+	// stored under the wrong key or is not signed by its owner.
+	ErrInvalidACLRecord = errors.New("invalid acl record")
+
+	// ErrNotACLOwner is returned when trying to publish an ACL with a key that
+	// doesn't belong to the ACL owner.
+	ErrNotACLOwner = errors.New("key does not match acl owner")
+)
+
+// TopicACL is the list of BCH addresses allowed to publish to a gated topic.
+// It is stored in the DHT under a key derived from the owner and topic and is
+// signed by the owner's key. Updates must increase the sequence number.
+type TopicACL struct {
+	// Topic is the pubsub topic the ACL applies to.
+	Topic string `json:"topic"`
+
+	// Owner is the CashAddr of the key which signs the ACL.
+	Owner string `json:"owner"`
+
+	// Publishers are the CashAddrs of the keys allowed to publish.
+	Publishers []string `json:"publishers"`
+
+	// Seq is the sequence number of the ACL. Higher numbers replace lower.
+	Seq uint64 `json:"seq"`
+
+	// Signature is the owner's compact signature over the ACL.
+	Signature []byte `json:"signature"`
+}
+
+// sigHash returns the hash the owner signs.
+func (acl *TopicACL) sigHash() ([]byte, error) {
+	cpy := *acl
+	cpy.Signature = nil
+	ser, err := json.Marshal(&cpy)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.DoubleHashB(append([]byte("overlay-topic-acl:"), ser...)), nil
+}
+
+// TopicACLKey returns the DHT key of the ACL for the owner and topic.
+func TopicACLKey(owner bchutil.Address, topic string) string {
+	h := sha256.Sum256([]byte(owner.EncodeAddress() + "/" + topic))
+	return "/acl/" + hex.EncodeToString(h[:])
+}
+
+// ACLValidator is the DHT validator for topic ACLs. It checks that the ACL is
+// stored under the key for its owner and topic and is signed by the owner.
+type ACLValidator struct {
+	Params *chaincfg.Params
+}
+
+// Validate validates the given record, returning an error if it's
+// invalid (e.g., expired, signed by the wrong key, etc.).
+func (v *ACLValidator) Validate(key string, value []byte) error {
+	ns, _, err := record.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	if ns != "acl" {
+		return errors.New("namespace not 'acl'")
+	}
+	acl := new(TopicACL)
+	if err := json.Unmarshal(value, acl); err != nil {
+		return ErrInvalidACLRecord
+	}
+	owner, err := bchutil.DecodeAddress(acl.Owner, v.Params)
+	if err != nil {
+		return ErrInvalidACLRecord
+	}
+	if key != TopicACLKey(owner, acl.Topic) {
+		return ErrInvalidACLRecord
+	}
+	hash, err := acl.sigHash()
+	if err != nil {
+		return err
+	}
+	signer, err := recoverAddress(acl.Signature, hash, v.Params)
+	if err != nil || signer.EncodeAddress() != owner.EncodeAddress() {
+		return ErrInvalidACLRecord
+	}
+	for _, p := range acl.Publishers {
+		if _, err := bchutil.DecodeAddress(p, v.Params); err != nil {
+			return ErrInvalidACLRecord
+		}
+	}
+	return nil
+}
+
+// Select selects the best record from the set of records (e.g., the
+// newest).
+//
+// Decisions made by select should be stable. ACLs with the same sequence
+// number are ordered by their serialized bytes so that every node picks the
+// same one regardless of the order they were received in.
+func (v *ACLValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestSeq := -1, uint64(0)
+	for i, value := range values {
+		acl := new(TopicACL)
+		if err := json.Unmarshal(value, acl); err != nil {
+			continue
+		}
+		if best == -1 || acl.Seq > bestSeq ||
+			(acl.Seq == bestSeq && bytes.Compare(value, values[best]) > 0) {
+			best, bestSeq = i, acl.Seq
+		}
+	}
+	if best == -1 {
+		return 0, ErrInvalidACLRecord
+	}
+	return best, nil
+}
+
+// PublishTopicACL signs the ACL with the owner's key and puts it to the DHT.
+// The ACL is tracked by the Republisher so it stays available.
+func (n *OverlayNode) PublishTopicACL(ctx context.Context, acl *TopicACL, ownerKey *bchec.PrivateKey) error {
+	owner, err := bchutil.DecodeAddress(acl.Owner, n.Params)
+	if err != nil {
+		return err
+	}
+	if addressFromPubKey(ownerKey.PubKey(), true, n.Params).EncodeAddress() != owner.EncodeAddress() {
+		return ErrNotACLOwner
+	}
+	hash, err := acl.sigHash()
+	if err != nil {
+		return err
+	}
+	acl.Signature, err = bchec.SignCompact(bchec.S256(), ownerKey, hash, true)
+	if err != nil {
+		return err
+	}
+	ser, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	return n.Republisher.Publish(ctx, TopicACLKey(owner, acl.Topic), ser, 0)
+}
+
+// EnableTopicACL fetches the topic's ACL from the DHT and registers a topic
+// validator which drops every message that isn't signed by one of the keys in
+// the ACL. The ACL is refreshed periodically until the node shuts down. If the
+// ACL can't be fetched yet, for example because we haven't joined the DHT,
+// every message is dropped until a retry succeeds.
+func (n *OverlayNode) EnableTopicACL(ctx context.Context, topic string, owner string) error {
+	ownerAddr, err := bchutil.DecodeAddress(owner, n.Params)
+	if err != nil {
+		return err
+	}
+	gate := &topicGate{
+		topic:  topic,
+		key:    TopicACLKey(ownerAddr, topic),
+		params: n.Params,
+	}
+	if err := n.PubSub.RegisterTopicValidator(topic, gate.validate, nil); err != nil {
+		return err
+	}
+	err = gate.refresh(ctx, n)
+	if err != nil {
+		log.Warnf("acl: failed to fetch acl for %s, will retry: %s", topic, err)
+	}
+	go func() {
+		loaded := err == nil
+		for {
+			interval := ACLRefreshInterval
+			if !loaded {
+				interval = ACLRetryInterval
+			}
+			select {
+			case <-time.After(interval):
+				if err := gate.refresh(n.ctx, n); err != nil {
+					log.Debugf("acl: failed to refresh acl for %s: %s", topic, err)
+					continue
+				}
+				loaded = true
+			case <-n.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// PublishGated signs the data with the BCH key and publishes it to the gated
+// topic. The signature commits to the topic and our peer ID so that it can't
+// be replayed by another peer or on another topic.
+func (n *OverlayNode) PublishGated(ctx context.Context, topic string, data []byte, key *bchec.PrivateKey, opts ...PublishOption) error {
+	sig, err := bchec.SignCompact(bchec.S256(), key, gatedMessageHash(topic, n.Host.ID(), data), true)
+	if err != nil {
+		return err
+	}
+	return n.PubSub.Publish(ctx, topic, append(sig, data...), opts...)
+}
+
+// GatedPayload returns the payload and signer of a message published with
+// PublishGated.
+func GatedPayload(msg *pubsub.Message, params *chaincfg.Params) ([]byte, bchutil.Address, error) {
+	data := msg.GetData()
+	if len(data) < 65 || len(msg.GetTopicIDs()) != 1 {
+		return nil, nil, errors.New("malformed gated message")
+	}
+	from := msg.GetFrom()
+	sig, payload := data[:65], data[65:]
+	signer, err := recoverAddress(sig, gatedMessageHash(msg.GetTopicIDs()[0], from, payload), params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, signer, nil
+}
+
+// topicGate holds the current ACL for a gated topic.
+type topicGate struct {
+	topic      string
+	key        string
+	params     *chaincfg.Params
+	seq        uint64
+	publishers map[string]struct{}
+	mtx        sync.RWMutex
+}
+
+// refresh fetches the ACL from the DHT and swaps it in if it's newer than the
+// one we have.
+func (g *topicGate) refresh(ctx context.Context, n *OverlayNode) error {
+	value, err := n.Routing.GetValue(ctx, g.key)
+	if err != nil {
+		return err
+	}
+	acl := new(TopicACL)
+	if err := json.Unmarshal(value, acl); err != nil {
+		return err
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.publishers != nil && acl.Seq <= g.seq {
+		return nil
+	}
+	publishers := make(map[string]struct{}, len(acl.Publishers))
+	for _, p := range acl.Publishers {
+		addr, err := bchutil.DecodeAddress(p, g.params)
+		if err != nil {
+			continue
+		}
+		publishers[addr.EncodeAddress()] = struct{}{}
+	}
+	g.seq = acl.Seq
+	g.publishers = publishers
+	log.Debugf("acl: loaded acl %d for %s with %d publishers", acl.Seq, g.topic, len(publishers))
+	return nil
+}
+
+// validate is the topic validator for the gated topic.
+func (g *topicGate) validate(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+	_, signer, err := GatedPayload(msg, g.params)
+	if err != nil {
+		return false
+	}
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	_, ok := g.publishers[signer.EncodeAddress()]
+	return ok
+}
+
+func gatedMessageHash(topic string, from peer.ID, data []byte) []byte {
+	buf := []byte("overlay-gated-message:" + topic + ":")
+	buf = append(buf, []byte(from)...)
+	buf = append(buf, data...)
+	return chainhash.DoubleHashB(buf)
+}
+
+// recoverAddress recovers the P2PKH address of the key which produced the
+// compact signature over the hash.
+func recoverAddress(sig, hash []byte, params *chaincfg.Params) (bchutil.Address, error) {
+	pub, compressed, err := bchec.RecoverCompact(bchec.S256(), sig, hash)
+	if err != nil {
+		return nil, err
+	}
+	return addressFromPubKey(pub, compressed, params), nil
+}
+
+func addressFromPubKey(pub *bchec.PublicKey, compressed bool, params *chaincfg.Params) bchutil.Address {
+	ser := pub.SerializeUncompressed()
+	if compressed {
+		ser = pub.SerializeCompressed()
+	}
+	addr, _ := bchutil.NewAddressPubKeyHash(bchutil.Hash160(ser), params)
+	return addr
+}
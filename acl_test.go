@@ -0,0 +1,169 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"testing"
+	"time"
+)
+
+// signedACL returns a serialized ACL signed by the owner key.
+func signedACL(t *testing.T, owner *bchec.PrivateKey, topic string, seq uint64, publishers ...string) []byte {
+	t.Helper()
+	acl := &TopicACL{
+		Topic:      topic,
+		Owner:      addressFromPubKey(owner.PubKey(), true, &chaincfg.TestNet3Params).EncodeAddress(),
+		Publishers: publishers,
+		Seq:        seq,
+	}
+	hash, err := acl.sigHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl.Signature, err = bchec.SignCompact(bchec.S256(), owner, hash, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ser, err := json.Marshal(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ser
+}
+
+func newTestKey(t *testing.T) *bchec.PrivateKey {
+	t.Helper()
+	key, err := bchec.NewPrivateKey(bchec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestACLValidator(t *testing.T) {
+	params := &chaincfg.TestNet3Params
+	v := &ACLValidator{Params: params}
+	owner, other := newTestKey(t), newTestKey(t)
+	ownerAddr := addressFromPubKey(owner.PubKey(), true, params)
+	key := TopicACLKey(ownerAddr, "gated")
+
+	valid := signedACL(t, owner, "gated", 1)
+	forged := new(TopicACL)
+	json.Unmarshal(signedACL(t, other, "gated", 1), forged)
+	forged.Owner = ownerAddr.EncodeAddress()
+	forgedSer, _ := json.Marshal(forged)
+
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+		valid bool
+	}{
+		{"valid", key, valid, true},
+		{"wrong topic", TopicACLKey(ownerAddr, "other"), valid, false},
+		{"not signed by owner", key, forgedSer, false},
+		{"malformed", key, []byte("{"), false},
+	}
+	for _, test := range tests {
+		if err := v.Validate(test.key, test.value); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	// ACLs with the same sequence number are selected by their bytes so the
+	// choice doesn't depend on the order.
+	a := signedACL(t, owner, "gated", 2, addressFromPubKey(other.PubKey(), true, params).EncodeAddress())
+	b := signedACL(t, owner, "gated", 2)
+	newer := signedACL(t, owner, "gated", 3)
+	i, err := v.Select(key, [][]byte{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := v.Select(key, [][]byte{b, a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string([][]byte{a, b}[i]) != string([][]byte{b, a}[j]) {
+		t.Fatal("select is not stable for equal sequence numbers")
+	}
+	if i, _ := v.Select(key, [][]byte{a, newer, b}); i != 1 {
+		t.Fatalf("expected the newest acl to be selected, got %d", i)
+	}
+}
+
+// gatedMessage returns a message signed by the key as PublishGated would.
+func gatedMessage(t *testing.T, n *OverlayNode, topic string, key *bchec.PrivateKey) *pubsub.Message {
+	t.Helper()
+	data := []byte("hello")
+	sig, err := bchec.SignCompact(bchec.S256(), key, gatedMessageHash(topic, n.Host.ID(), data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pubsub.Message{Message: &pb.Message{
+		From:     []byte(n.Host.ID()),
+		Data:     append(sig, data...),
+		TopicIDs: []string{topic},
+	}}
+}
+
+func TestEnableTopicACLBeforeACLExists(t *testing.T) {
+	interval := ACLRetryInterval
+	ACLRetryInterval = time.Millisecond * 100
+	defer func() { ACLRetryInterval = interval }()
+
+	server := func(cfg *NodeConfig) { cfg.DHTMode = DHTModeServer }
+	ownerNode, node := newTestNode(t, server), newTestNode(t, server)
+	connectNodes(t, node, ownerNode)
+	ok := waitFor(t, time.Second*10, func() bool {
+		return ownerNode.Routing.(*dht.IpfsDHT).RoutingTable().Size() > 0 &&
+			node.Routing.(*dht.IpfsDHT).RoutingTable().Size() > 0
+	})
+	if !ok {
+		t.Fatal("dht peers not added to the routing table")
+	}
+
+	params := &chaincfg.TestNet3Params
+	owner, publisher := newTestKey(t), newTestKey(t)
+	ownerAddr := addressFromPubKey(owner.PubKey(), true, params).EncodeAddress()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// The ACL hasn't been published yet so every message is dropped.
+	fetchCtx, fetchCancel := context.WithTimeout(ctx, time.Second)
+	err := node.EnableTopicACL(fetchCtx, "gated", ownerAddr)
+	fetchCancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.PubSub.mtx.Lock()
+	validate := node.PubSub.validators["gated"]
+	node.PubSub.mtx.Unlock()
+	msg := gatedMessage(t, node, "gated", publisher)
+	if validate(ctx, node.Host.ID(), msg) {
+		t.Fatal("message accepted before the acl was loaded")
+	}
+
+	acl := &TopicACL{
+		Topic:      "gated",
+		Owner:      ownerAddr,
+		Publishers: []string{addressFromPubKey(publisher.PubKey(), true, params).EncodeAddress()},
+		Seq:        1,
+	}
+	if err := ownerNode.PublishTopicACL(ctx, acl, owner); err != nil {
+		t.Fatal(err)
+	}
+	ok = waitFor(t, time.Second*10, func() bool {
+		return validate(ctx, node.Host.ID(), msg)
+	})
+	if !ok {
+		t.Fatal("acl not loaded after it was published")
+	}
+	if validate(ctx, node.Host.ID(), gatedMessage(t, node, "gated", owner)) {
+		t.Fatal("message from a key not in the acl accepted")
+	}
+}
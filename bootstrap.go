@@ -82,7 +82,7 @@ func Bootstrap(routing *dht.IpfsDHT, peerHost host.Host, cfg BootstrapConfig) er
 
 	// Bootstrap the DHT. This requires open connections first which is why we start
 	// the connection supervisor first.
-	if _, err := routing.BootstrapWithConfig(dht.DefaultBootstrapConfig); err != nil {
+	if err := routing.BootstrapWithConfig(context.Background(), dht.DefaultBootstrapConfig); err != nil {
 		return err
 	}
 	return nil
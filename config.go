@@ -1,9 +1,12 @@
 package overlaynetwork
 
 import (
+	"github.com/gcash/bchd/bchec"
 	"github.com/gcash/bchd/chaincfg"
+	"github.com/ipfs/go-datastore"
 	"github.com/libp2p/go-libp2p-crypto"
 	"github.com/libp2p/go-libp2p-peerstore"
+	"time"
 )
 
 // NodeConfig contains basic configuration information that we'll need to
@@ -27,6 +30,117 @@ type NodeConfig struct {
 	// startup.
 	PrivateKey crypto.PrivKey
 
-	// DataDir is the path to a directory to store node data.
+	// DataDir is the path to a directory to store node data. It is required
+	// unless Datastore is set or DatastoreType is DatastoreInMemory.
 	DataDir string
+
+	// Datastore is an optional datastore for the node to use. If nil a new
+	// datastore is opened based on the DatastoreType. The node will not close
+	// a datastore that is passed in here.
+	Datastore datastore.Batching
+
+	// DatastoreType selects the datastore backend to open if Datastore is nil.
+	// The default is leveldb.
+	DatastoreType DatastoreType
+
+	// DatastoreMounts optionally mounts separate datastores under the given
+	// namespaces. For example the DHT records can be kept in memory while the
+	// peer cache and app data are persisted by mounting an in-memory datastore
+	// at DHTNamespace. The node's namespaces are DHTNamespace,
+	// PeerCacheNamespace and AppNamespace.
+	// Keys which don't fall under any mount go to the root datastore.
+	DatastoreMounts map[datastore.Key]datastore.Batching
+
+	// DHTMode selects whether the DHT runs as a full server, as a query-only
+	// client or switches between the two based on public reachability. The
+	// default is DHTModeServer.
+	DHTMode DHTMode
+
+	// PowDifficulty overrides the number of leading zero bits required for
+	// records in the pow namespace. If zero the difficulty for the network
+	// in the PowDifficulty map is used.
+	PowDifficulty int
+
+	// TopicDiscovery controls how pubsub topics are advertised and how we
+	// find other subscribers. Any field which is zero, or the whole config if
+	// nil, is taken from DefaultTopicDiscoveryConfig.
+	TopicDiscovery *TopicDiscoveryConfig
+
+	// PubsubRouter selects the pubsub router. The default is gossipsub.
+	PubsubRouter PubsubRouter
+
+	// GossipSubParams overrides the gossipsub parameters such as the mesh
+	// degree (D, Dlo, Dhi) and the heartbeat interval. Only used with the
+	// gossipsub router. If nil the libp2p defaults are used. The parameters
+	// are process wide, see GossipSubParams, and a node with an inconsistent
+	// set fails to start.
+	GossipSubParams *GossipSubParams
+
+	// PubsubLimits are the per-peer rate limits enforced on pubsub messages.
+	// If nil DefaultPubsubLimitConfig is used.
+	PubsubLimits *PubsubLimitConfig
+
+	// InvalidMessagePenalties holds the penalties for peers which relay
+	// invalid pubsub messages. If nil DefaultInvalidMessagePenalties is used.
+	InvalidMessagePenalties *InvalidMessagePenalties
+
+	// Storage controls the storage quota, per-peer store limits and garbage
+	// collection of DHT records. If nil DefaultStorageConfig is used.
+	Storage *StorageConfig
+
+	// Services are the names of the services this node supports. They are
+	// sent to peers in the handshake.
+	Services []string
+
+	// ChainTip optionally returns our current chain tip which is sent to
+	// peers in the handshake. It may return nil if the tip is unknown.
+	ChainTip func() *ChainTip
+
+	// Mailbox holds the limits enforced when storing messages for other
+	// peers' mailboxes. If nil DefaultMailboxConfig is used.
+	Mailbox *MailboxConfig
+
+	// MessagingKey is an optional wallet key. If set, messages we send are
+	// signed with it, our wallet record is published so peers can message us
+	// by key, and messages deposited in its mailbox are delivered to
+	// Messages.
+	MessagingKey *bchec.PrivateKey
+
+	// NATPortMap tries to open a port on the router with UPnP or NAT-PMP
+	// so that peers can dial us.
+	NATPortMap bool
+
+	// AutoNAT asks our peers to dial us back to find out whether we are
+	// publicly reachable. The result is exposed by Reachability and picks
+	// the DHT mode in DHTModeAuto. If false reachability is guessed from our
+	// addresses.
+	AutoNAT bool
+
+	// AutoNATService dials other peers back when they ask to find out
+	// whether they are reachable. Only enable this on publicly reachable
+	// nodes.
+	AutoNATService bool
+
+	// HolePunching upgrades relayed connections to direct connections. When
+	// a peer connects to us through a relay we open a hole in our NAT by
+	// dialing it from our listen port and ask it to dial us directly. Both
+	// peers need it enabled.
+	HolePunching bool
+
+	// RelayService lets peers which aren't publicly reachable relay
+	// connections through us, within the given limits. The relay is
+	// advertised in the service registry while we are publicly reachable
+	// so that those peers can find it. The relay service is disabled if nil.
+	// The limits are shared by every node in the process, see RelayConfig.
+	RelayService *RelayConfig
+
+	// AutoRelay connects to relays found in the service registry whenever
+	// we aren't publicly reachable and advertises /p2p-circuit addresses
+	// through them.
+	AutoRelay bool
+
+	// RepublishInterval is the interval at which records published through
+	// the Republisher are re-put to the DHT. If zero DefaultRepublishInterval
+	// is used.
+	RepublishInterval time.Duration
 }
@@ -0,0 +1,174 @@
+package overlaynetwork
+
+import (
+	"errors"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-ds-badger"
+	"github.com/ipfs/go-ds-leveldb"
+	"io"
+	"path"
+	"sort"
+)
+
+// DatastoreType selects which datastore backend the node will open when
+// a datastore is not passed in via the config.
+type DatastoreType int
+
+const (
+	// DatastoreLevelDB is a leveldb datastore saved in the DataDir. This is the
+	// default.
+	DatastoreLevelDB DatastoreType = iota
+
+	// DatastoreBadger is a badger datastore saved in the DataDir.
+	DatastoreBadger
+
+	// DatastoreInMemory is an in-memory datastore. Nothing is persisted and no
+	// DataDir is required. This is mostly useful for testing.
+	DatastoreInMemory
+)
+
+var (
+	// DHTNamespace is the datastore namespace under which the DHT stores
+	// its records.
+	DHTNamespace = datastore.NewKey("/dht")
+
+	// PeerCacheNamespace is the datastore namespace under which we cache the
+	// addresses of peers we've been connected to.
+	PeerCacheNamespace = datastore.NewKey("/peers")
+
+	// AppNamespace is the datastore namespace reserved for application data.
+	AppNamespace = datastore.NewKey("/app")
+
+	// dhtMigrationKey is set once the DHT records have been moved under
+	// DHTNamespace.
+	dhtMigrationKey = datastore.NewKey("/overlay/migrations/dht-namespace")
+
+	// ErrNoDataDir is returned when a persistent datastore is selected but no
+	// DataDir is set in the config.
+	ErrNoDataDir = errors.New("a DataDir is required for persistent datastores")
+)
+
+// openDatastore returns the root datastore for the node. If the config does not
+// provide one we open a new one based on the DatastoreType. Any mounts in
+// the config are layered on top of the root datastore. The returned closer is
+// non-nil if the datastore was opened by us and should be closed on shutdown.
+func openDatastore(config *NodeConfig) (datastore.Batching, io.Closer, error) {
+	var (
+		dstore datastore.Batching
+		closer io.Closer
+		err    error
+	)
+	if config.Datastore != nil {
+		dstore = config.Datastore
+	} else {
+		switch config.DatastoreType {
+		case DatastoreInMemory:
+			dstore = dssync.MutexWrap(datastore.NewMapDatastore())
+		case DatastoreBadger:
+			if config.DataDir == "" {
+				return nil, nil, ErrNoDataDir
+			}
+			dstore, err = badger.NewDatastore(path.Join(config.DataDir, "libp2p"), &badger.DefaultOptions)
+		default:
+			if config.DataDir == "" {
+				return nil, nil, ErrNoDataDir
+			}
+			dstore, err = leveldb.NewDatastore(path.Join(config.DataDir, "libp2p"), nil)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		closer, _ = dstore.(io.Closer)
+	}
+
+	if len(config.DatastoreMounts) == 0 {
+		return dstore, closer, nil
+	}
+
+	mounts := make([]mount.Mount, 0, len(config.DatastoreMounts)+1)
+	for prefix, ds := range config.DatastoreMounts {
+		mounts = append(mounts, mount.Mount{Prefix: prefix, Datastore: ds})
+	}
+	// Sort the longest prefix first so that a key is stored in the most
+	// specific mount. The root mount goes last so it only catches keys which
+	// don't match any of the other mounts.
+	sort.Slice(mounts, func(i, j int) bool {
+		li, lj := len(mounts[i].Prefix.List()), len(mounts[j].Prefix.List())
+		if li != lj {
+			return li > lj
+		}
+		return mounts[i].Prefix.String() < mounts[j].Prefix.String()
+	})
+	mounts = append(mounts, mount.Mount{Prefix: datastore.NewKey("/"), Datastore: dstore})
+	return mount.New(mounts), closer, nil
+}
+
+// migrateDHTRecords moves the DHT records which older versions of the node
+// stored at the root of the datastore under DHTNamespace. Everything at the
+// root which isn't under one of our own namespaces was written by the DHT.
+// The migration only runs once.
+func migrateDHTRecords(ds datastore.Batching) error {
+	has, err := ds.Has(dhtMigrationKey)
+	if err != nil || has {
+		return err
+	}
+	res, err := ds.Query(query.Query{})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	batch, err := ds.Batch()
+	if err != nil {
+		return err
+	}
+	moved := 0
+	for _, entry := range entries {
+		key := datastore.NewKey(entry.Key)
+		if isNodeKey(key) {
+			continue
+		}
+		if err := batch.Put(DHTNamespace.Child(key), entry.Value); err != nil {
+			return err
+		}
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+		moved++
+	}
+	if err := batch.Put(dhtMigrationKey, []byte{1}); err != nil {
+		return err
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	if moved > 0 {
+		log.Infof("moved %d dht records to %s", moved, DHTNamespace)
+	}
+	return nil
+}
+
+// isNodeKey returns whether the key is under one of the namespaces the node
+// or applications store data in.
+func isNodeKey(key datastore.Key) bool {
+	for _, prefix := range []datastore.Key{DHTNamespace, PeerCacheNamespace, AppNamespace,
+		mailboxPrefix, historyPrefix, republisherPrefix, dhtMigrationKey.Parent()} {
+		if prefix.Equal(key) || prefix.IsAncestorOf(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// AppDatastore returns a view of the node's datastore which is namespaced
+// under AppNamespace. Applications should use this to store their own data
+// so that it doesn't collide with the node's data.
+func (n *OverlayNode) AppDatastore() datastore.Datastore {
+	return namespace.Wrap(n.Datastore, AppNamespace)
+}
@@ -0,0 +1,171 @@
+package overlaynetwork
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-crypto"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"testing"
+)
+
+func TestDatastoreMountsLongestPrefixFirst(t *testing.T) {
+	root := dssync.MutexWrap(datastore.NewMapDatastore())
+	dht := dssync.MutexWrap(datastore.NewMapDatastore())
+	pow := dssync.MutexWrap(datastore.NewMapDatastore())
+	peers := dssync.MutexWrap(datastore.NewMapDatastore())
+	ds, _, err := openDatastore(&NodeConfig{
+		Datastore: root,
+		DatastoreMounts: map[datastore.Key]datastore.Batching{
+			DHTNamespace:                    dht,
+			DHTNamespace.ChildString("pow"): pow,
+			PeerCacheNamespace:              peers,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key   datastore.Key
+		store datastore.Datastore
+		local datastore.Key
+	}{
+		{DHTNamespace.ChildString("pow").ChildString("a"), pow, datastore.NewKey("/a")},
+		{DHTNamespace.ChildString("sha256"), dht, datastore.NewKey("/sha256")},
+		{PeerCacheNamespace.ChildString("peer"), peers, datastore.NewKey("/peer")},
+		{AppNamespace.ChildString("a"), root, AppNamespace.ChildString("a")},
+	}
+	for _, test := range tests {
+		if err := ds.Put(test.key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		has, err := test.store.Has(test.local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !has {
+			t.Errorf("%s not stored in the expected mount", test.key)
+		}
+	}
+}
+
+func TestMigrateDHTRecords(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	legacy := map[datastore.Key][]byte{
+		datastore.NewKey("/CIQHASH"):                []byte("record"),
+		datastore.NewKey("/providers/CIQHASH/peer"): []byte("provider"),
+	}
+	for k, v := range legacy {
+		if err := ds.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := AppNamespace.ChildString("data")
+	if err := ds.Put(app, []byte("app")); err != nil {
+		t.Fatal(err)
+	}
+	cachedPeer := PeerCacheNamespace.ChildString("peer")
+	if err := ds.Put(cachedPeer, []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDHTRecords(ds); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range legacy {
+		if has, _ := ds.Has(k); has {
+			t.Errorf("%s left at the root", k)
+		}
+		got, err := ds.Get(DHTNamespace.Child(k))
+		if err != nil {
+			t.Fatalf("%s not migrated: %s", k, err)
+		}
+		if string(got) != string(v) {
+			t.Errorf("%s: expected %q, got %q", k, v, got)
+		}
+	}
+	if has, _ := ds.Has(app); !has {
+		t.Error("app data was moved")
+	}
+	if has, _ := ds.Has(cachedPeer); !has {
+		t.Error("peer cache was moved")
+	}
+
+	// The migration only runs once.
+	if err := ds.Put(datastore.NewKey("/later"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDHTRecords(ds); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := ds.Has(datastore.NewKey("/later")); !has {
+		t.Error("migration ran twice")
+	}
+}
+
+func TestPeerCacheMount(t *testing.T) {
+	root := dssync.MutexWrap(datastore.NewMapDatastore())
+	peers := dssync.MutexWrap(datastore.NewMapDatastore())
+	ds, _, err := openDatastore(&NodeConfig{
+		Datastore:       root,
+		DatastoreMounts: map[datastore.Key]datastore.Batching{PeerCacheNamespace: peers},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []peerstore.PeerInfo
+	for i := 0; i < MaxCachedPeers+5; i++ {
+		privKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := peer.IDFromPrivateKey(privKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ma.StringCast(fmt.Sprintf("/ip4/10.0.0.%d/tcp/4001", i+1))
+		infos = append(infos, peerstore.PeerInfo{ID: id, Addrs: []ma.Multiaddr{addr}})
+	}
+	if err := savePeerCache(ds, infos); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := root.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := res.Rest(); len(entries) != 0 {
+		t.Errorf("%d peer cache entries written to the root datastore", len(entries))
+	}
+
+	cached, err := loadPeerCache(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != MaxCachedPeers {
+		t.Fatalf("expected %d cached peers, got %d", MaxCachedPeers, len(cached))
+	}
+	addrs := make(map[peer.ID]string)
+	for _, pi := range infos {
+		addrs[pi.ID] = pi.Addrs[0].String()
+	}
+	for _, pi := range cached {
+		if len(pi.Addrs) != 1 || addrs[pi.ID] != pi.Addrs[0].String() {
+			t.Errorf("unexpected cached peer %s %v", pi.ID, pi.Addrs)
+		}
+	}
+
+	// Saving while not connected to anyone keeps the previous cache.
+	if err := savePeerCache(ds, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := loadPeerCache(ds); len(cached) != MaxCachedPeers {
+		t.Errorf("empty save cleared the cache, %d peers left", len(cached))
+	}
+}
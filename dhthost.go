@@ -0,0 +1,171 @@
+package overlaynetwork
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/libp2p/go-libp2p-host"
+	dhtpb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"sync"
+)
+
+var (
+	// ErrPeerStoreLimit is returned to the DHT when a peer exceeds its store
+	// limits. The stream is reset when this happens.
+	ErrPeerStoreLimit = errors.New("peer exceeded store limit")
+
+	// DHTStoreLimitBanScore is added to a peer's ban score each time it
+	// exceeds its store limits or sends an oversized message.
+	DHTStoreLimitBanScore = 10.0
+
+	errFrameTooLarge = errors.New("dht message too large")
+)
+
+// dhtHost wraps the host that is passed into the DHT so that we can intercept
+// the stream handlers it registers. This allows us to inspect the messages
+// other peers send to our DHT before the DHT handles them and to switch the
+// DHT between client and server mode by registering or removing its handlers.
+type dhtHost struct {
+	host.Host
+
+	limiter     *storeLimiter
+	misbehavior *misbehaviorTracker
+	handlers    map[protocol.ID]inet.StreamHandler
+	server      bool
+	mtx         sync.Mutex
+}
+
+func newDHTHost(h host.Host, limiter *storeLimiter, misbehavior *misbehaviorTracker, server bool) *dhtHost {
+	return &dhtHost{
+		Host:        h,
+		limiter:     limiter,
+		misbehavior: misbehavior,
+		handlers:    make(map[protocol.ID]inet.StreamHandler),
+		server:      server,
+	}
+}
+
+// SetStreamHandler saves the DHT's handler wrapped with our checks and
+// registers it with the host if we're in server mode.
+func (h *dhtHost) SetStreamHandler(pid protocol.ID, handler inet.StreamHandler) {
+	wrapped := func(s inet.Stream) {
+		handler(&limitedStream{
+			Stream:      s,
+			limiter:     h.limiter,
+			misbehavior: h.misbehavior,
+			peer:        s.Conn().RemotePeer(),
+		})
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.handlers[pid] = wrapped
+	if h.server {
+		h.Host.SetStreamHandler(pid, wrapped)
+	}
+}
+
+// RemoveStreamHandler removes the DHT's handler.
+func (h *dhtHost) RemoveStreamHandler(pid protocol.ID) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	delete(h.handlers, pid)
+	h.Host.RemoveStreamHandler(pid)
+}
+
+// setServerMode registers the DHT's handlers with the host if server is true
+// otherwise it removes them. Without the handlers the host will not advertise
+// the DHT protocol and other peers can't query us or store records with us.
+func (h *dhtHost) setServerMode(server bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.server == server {
+		return
+	}
+	h.server = server
+	for pid, handler := range h.handlers {
+		if server {
+			h.Host.SetStreamHandler(pid, handler)
+		} else {
+			h.Host.RemoveStreamHandler(pid)
+		}
+	}
+}
+
+func (h *dhtHost) isServer() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.server
+}
+
+// limitedStream parses the varint delimited DHT messages as they are read
+// off the stream. Any store requests which exceed the peer's limits cause the
+// stream to be reset before the DHT sees the message.
+type limitedStream struct {
+	inet.Stream
+
+	limiter     *storeLimiter
+	misbehavior *misbehaviorTracker
+	peer        peer.ID
+	buf         []byte
+}
+
+// Read reads from the underlying stream and inspects the data before handing
+// it to the DHT.
+func (s *limitedStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		if lerr := s.inspect(p[:n]); lerr != nil {
+			log.Debugf("dht: resetting stream from %s: %s", s.peer, lerr)
+			s.misbehavior.report(s.peer, DHTStoreLimitBanScore, lerr.Error())
+			s.Stream.Reset()
+			return 0, lerr
+		}
+	}
+	return n, err
+}
+
+// inspect appends the data to the current frame buffer and checks every
+// complete message. Since the DHT can't act on a message until it has read
+// the whole frame, returning an error here prevents it from being handled.
+func (s *limitedStream) inspect(data []byte) error {
+	s.buf = append(s.buf, data...)
+	for {
+		l, vn := binary.Uvarint(s.buf)
+		if vn == 0 {
+			return nil
+		}
+		if vn < 0 || l > inet.MessageSizeMax {
+			return errFrameTooLarge
+		}
+		end := vn + int(l)
+		if len(s.buf) < end {
+			return nil
+		}
+		if err := s.checkMessage(s.buf[vn:end]); err != nil {
+			return err
+		}
+		s.buf = append(s.buf[:0], s.buf[end:]...)
+	}
+}
+
+func (s *limitedStream) checkMessage(frame []byte) error {
+	msg := new(dhtpb.Message)
+	if err := msg.Unmarshal(frame); err != nil {
+		// Let the DHT deal with malformed messages.
+		return nil
+	}
+	switch msg.GetType() {
+	case dhtpb.Message_PUT_VALUE:
+		if !s.limiter.allow(s.peer, len(msg.GetRecord().GetValue())) {
+			return ErrPeerStoreLimit
+		}
+	case dhtpb.Message_ADD_PROVIDER:
+		if !s.limiter.allow(s.peer, len(frame)) {
+			return ErrPeerStoreLimit
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package overlaynetwork
+
+import (
+	"context"
+	"time"
+)
+
+// DHTMode selects whether the node's DHT serves requests from other peers.
+type DHTMode int
+
+const (
+	// DHTModeServer runs a full DHT server. The node advertises the DHT
+	// protocol, answers queries and stores records for other peers. This is
+	// the default.
+	DHTModeServer DHTMode = iota
+
+	// DHTModeClient only issues DHT queries. The node does not advertise the
+	// DHT protocol and never stores records for other peers. This is suitable
+	// for light wallets behind NAT or running on battery.
+	DHTModeClient
+
+	// DHTModeAuto starts in client mode and switches to server mode whenever
+	// the node is publicly reachable, as reported by Reachability. Enable
+	// AutoNAT in the config for an accurate answer.
+	DHTModeAuto
+)
+
+// String returns the name of the mode.
+func (m DHTMode) String() string {
+	switch m {
+	case DHTModeServer:
+		return "server"
+	case DHTModeClient:
+		return "client"
+	case DHTModeAuto:
+		return "auto"
+	}
+	return "unknown"
+}
+
+// DHTModeCheckInterval is how often a node in DHTModeAuto checks its
+// reachability to decide whether to switch modes.
+var DHTModeCheckInterval = time.Minute
+
+// DHTMode returns the mode the DHT is currently operating in. This will be
+// either DHTModeServer or DHTModeClient.
+func (n *OverlayNode) DHTMode() DHTMode {
+	if n.dhtHost.isServer() {
+		return DHTModeServer
+	}
+	return DHTModeClient
+}
+
+// runDHTModeSwitcher periodically checks whether the node is publicly
+// reachable and switches the DHT between client and server mode accordingly.
+func (n *OverlayNode) runDHTModeSwitcher(ctx context.Context) {
+	check := func() {
+		reachable := n.Reachability() == ReachabilityPublic
+		if reachable != n.dhtHost.isServer() {
+			n.dhtHost.setServerMode(reachable)
+			log.Infof("public reachability changed, dht now in %s mode", n.DHTMode())
+		}
+	}
+	check()
+
+	ticker := time.NewTicker(DHTModeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
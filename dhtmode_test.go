@@ -0,0 +1,123 @@
+package overlaynetwork
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-kad-dht"
+	"testing"
+	"time"
+)
+
+func TestDHTClientModeNotServed(t *testing.T) {
+	server := newTestNode(t, nil)
+	client := newTestNode(t, func(cfg *NodeConfig) { cfg.DHTMode = DHTModeClient })
+	connectNodes(t, client, server)
+
+	if client.DHTMode() != DHTModeClient || server.DHTMode() != DHTModeServer {
+		t.Fatalf("unexpected modes: client %s, server %s", client.DHTMode(), server.DHTMode())
+	}
+	for _, pid := range client.Host.Mux().Protocols() {
+		if pid == string(ProtocolDHTTestnet3) {
+			t.Fatal("client registered the dht protocol")
+		}
+	}
+
+	// Once identify has run each side knows what the other supports.
+	if !waitFor(t, time.Second*5, func() bool {
+		protos, err := client.Host.Peerstore().SupportsProtocols(server.Host.ID(), string(ProtocolDHTTestnet3))
+		return err == nil && len(protos) == 1
+	}) {
+		t.Fatal("server doesn't advertise the dht protocol")
+	}
+	protos, err := server.Host.Peerstore().SupportsProtocols(client.Host.ID(), string(ProtocolDHTTestnet3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(protos) != 0 {
+		t.Fatal("client advertises the dht protocol")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if s, err := server.Host.NewStream(ctx, client.Host.ID(), ProtocolDHTTestnet3); err == nil {
+		s.Reset()
+		t.Fatal("client served a dht stream")
+	}
+	if server.Routing.(*dht.IpfsDHT).RoutingTable().Find(client.Host.ID()) != "" {
+		t.Error("client added to the server's routing table")
+	}
+	if !waitFor(t, time.Second*5, func() bool {
+		return client.Routing.(*dht.IpfsDHT).RoutingTable().Find(server.Host.ID()) != ""
+	}) {
+		t.Error("server not added to the client's routing table")
+	}
+
+	// Switching to server mode, as auto mode does when we become publicly
+	// reachable, registers the handlers again.
+	client.dhtHost.setServerMode(true)
+	s, err := server.Host.NewStream(ctx, client.Host.ID(), ProtocolDHTTestnet3)
+	if err != nil {
+		t.Fatalf("dht stream refused in server mode: %s", err)
+	}
+	s.Reset()
+}
+
+func TestDHTClientModePubsubDiscovery(t *testing.T) {
+	discovery := DefaultTopicDiscoveryConfig
+	discovery.CheckInterval = time.Millisecond * 100
+	discovery.MaxBackoff = time.Millisecond * 100
+	client := func(cfg *NodeConfig) {
+		cfg.DHTMode = DHTModeClient
+		cfg.TopicDiscovery = &discovery
+	}
+	server := newTestNode(t, nil)
+	a := newTestNode(t, client)
+	b := newTestNode(t, client)
+	connectNodes(t, a, server)
+	connectNodes(t, b, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	const topic = "client-mode"
+	subA, err := a.PubSub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subA.Cancel()
+	subB, err := b.PubSub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subB.Cancel()
+
+	// The clients only know the server. They find each other through the
+	// provider records they stored with it.
+	if !waitFor(t, time.Second*15, func() bool {
+		for _, p := range b.PubSub.ListPeers(topic) {
+			if p == a.Host.ID() {
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Fatal("clients didn't find each other")
+	}
+	// Gossipsub only grafts the new peer on its next heartbeat so keep
+	// publishing until the message makes it through.
+	for {
+		if err := a.PubSub.Publish(ctx, topic, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		nextCtx, nextCancel := context.WithTimeout(ctx, time.Millisecond*500)
+		msg, err := subB.Next(nextCtx)
+		nextCancel()
+		if err == nil {
+			if string(msg.GetData()) != "hello" {
+				t.Fatalf("unexpected message %q", msg.GetData())
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			t.Fatal("message not delivered between the clients")
+		}
+	}
+}
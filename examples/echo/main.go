@@ -1,23 +1,23 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"crypto/rand"
 	"flag"
 	"fmt"
 	"github.com/gcash/bchd/chaincfg"
 	"github.com/gcash/overlaynetwork"
+	"github.com/gcash/overlaynetwork/framing"
 	golog "github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p-crypto"
 	"github.com/libp2p/go-libp2p-net"
 	"github.com/libp2p/go-libp2p-peerstore"
 	gologging "github.com/whyrusleeping/go-logging"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"strconv"
+	"time"
 )
 
 func main() {
@@ -81,16 +81,26 @@ func main() {
 	// per request/reply message pair? It's up to you.
 	//
 	// Finally it's up to you to decide what wire serialization you are going to use
-	// and how it will be delimited.
-	node.Host.SetStreamHandler("/bitcoincash/echo/1.0.0", func(s net.Stream) {
+	// and how it will be delimited. Here we use the framing package which prefixes
+	// each message with its length.
+	node.Host.SetStreamHandler("/bitcoincash/echo/1.0.0", func(stream net.Stream) {
 		log.Println("Got a new stream!")
-		buf := bufio.NewReader(s)
-		str, err := buf.ReadString('\n')
+		s := framing.NewStream(stream, 0)
+		s.ReadTimeout = time.Second * 30
+		s.WriteTimeout = time.Second * 30
+		msg, err := s.ReadFrame()
 		if err != nil {
-			s.Close()
+			log.Printf("read error: %s\n", err)
+			s.Reset()
+			return
+		}
+		defer framing.Put(msg)
+		log.Printf("read: %s\n", msg)
+		if err := s.WriteFrame(msg); err != nil {
+			log.Printf("write error: %s\n", err)
+			s.Reset()
+			return
 		}
-		log.Printf("read: %s\n", str)
-		s.Write([]byte(str))
 		s.Close()
 	})
 
@@ -117,17 +127,21 @@ func main() {
 	// make a new stream from host B to host A
 	// it should be handled on host A by the handler we set above because
 	// we use the same /bitcoincash/echo/1.0.0 protocol
-	s, err := node.Host.NewStream(context.Background(), peerInfo.ID, "/bitcoincash/echo/1.0.0")
+	stream, err := node.Host.NewStream(context.Background(), peerInfo.ID, "/bitcoincash/echo/1.0.0")
 	if err != nil {
 		log.Fatalln(err)
 	}
+	s := framing.NewStream(stream, 0)
 
-	_, err = s.Write([]byte("Hello, world!\n"))
-	if err != nil {
+	if err := s.WriteFrame([]byte("Hello, world!")); err != nil {
 		log.Fatalln(err)
 	}
 
-	out, err := ioutil.ReadAll(s)
+	// We're done writing so close our side of the stream. We can still
+	// read the reply.
+	s.CloseWrite()
+
+	out, err := s.ReadFrame()
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -17,6 +17,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"time"
 )
 
 func main() {
@@ -111,9 +112,12 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Publish to the topic "pizza"
+	// Publish to the topic "pizza". Since this node isn't subscribed to the topic it
+	// may not be connected to anyone who is, so we ask Publish to find and connect to
+	// at least one subscriber first.
 	fmt.Println("Publishing message to topic..")
-	err = node.PubSub.Publish(context.Background(), "pizza", []byte("I love pizza!"))
+	err = node.PubSub.Publish(context.Background(), "pizza", []byte("I love pizza!"),
+		overlaynetwork.WaitForPeers(1, time.Second*30))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,215 @@
+// Package framing reads and writes varint length-prefixed frames over
+// overlay streams.
+//
+// Each frame is the unsigned varint encoded length of the payload followed by
+// the payload itself. Frames larger than the max frame size are rejected
+// before any of the payload is read so a malicious peer can't make us
+// allocate an arbitrary amount of memory.
+package framing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/libp2p/go-buffer-pool"
+	inet "github.com/libp2p/go-libp2p-net"
+	"io"
+	"time"
+)
+
+var (
+	// ErrFrameTooLarge is returned when reading or writing a frame which is
+	// larger than the max frame size.
+	ErrFrameTooLarge = errors.New("frame too large")
+
+	// ErrMalformedFrame is returned when the length prefix of a frame is not
+	// a valid varint.
+	ErrMalformedFrame = errors.New("malformed frame length")
+)
+
+// DefaultMaxFrameSize is the max frame size used when zero is passed.
+const DefaultMaxFrameSize = 1 << 20
+
+// DefaultCloseTimeout is how long Close waits for the remote peer to close
+// its side of the stream before resetting it, unless the stream's ReadTimeout
+// is shorter.
+var DefaultCloseTimeout = time.Second * 10
+
+// Get returns a buffer of the given length from the buffer pool. The buffer
+// should be returned with Put when it is no longer used.
+func Get(length int) []byte {
+	return pool.Get(length)
+}
+
+// Put returns a buffer to the buffer pool. The buffer must not be used after
+// it has been returned.
+func Put(buf []byte) {
+	pool.Put(buf)
+}
+
+// Reader reads frames from an io.Reader.
+type Reader struct {
+	r   *bufio.Reader
+	max int
+}
+
+// NewReader returns a Reader which rejects frames larger than max. If max is
+// zero DefaultMaxFrameSize is used.
+func NewReader(r io.Reader, max int) *Reader {
+	if max == 0 {
+		max = DefaultMaxFrameSize
+	}
+	return &Reader{
+		r:   bufio.NewReader(r),
+		max: max,
+	}
+}
+
+// NextFrameSize reads the length prefix of the next frame. The caller must
+// then read exactly that many bytes with Read.
+func (r *Reader) NextFrameSize() (int, error) {
+	l, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		return 0, ErrMalformedFrame
+	}
+	if l > uint64(r.max) {
+		return 0, ErrFrameTooLarge
+	}
+	return int(l), nil
+}
+
+// Read reads raw bytes from the underlying reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+// ReadFrame reads the next frame. The returned buffer is taken from the buffer
+// pool and may be returned with Put once the caller is done with it. io.EOF is
+// only returned if the stream ended cleanly between frames.
+func (r *Reader) ReadFrame() ([]byte, error) {
+	l, err := r.NextFrameSize()
+	if err != nil {
+		return nil, err
+	}
+	buf := Get(l)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		Put(buf)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Writer writes frames to an io.Writer.
+type Writer struct {
+	w   io.Writer
+	max int
+}
+
+// NewWriter returns a Writer which refuses to write frames larger than max.
+// If max is zero DefaultMaxFrameSize is used.
+func NewWriter(w io.Writer, max int) *Writer {
+	if max == 0 {
+		max = DefaultMaxFrameSize
+	}
+	return &Writer{
+		w:   w,
+		max: max,
+	}
+}
+
+// WriteFrame writes the frame. The length prefix and payload are written with
+// a single call to the underlying writer.
+func (w *Writer) WriteFrame(frame []byte) error {
+	if len(frame) > w.max {
+		return ErrFrameTooLarge
+	}
+	buf := Get(binary.MaxVarintLen64 + len(frame))
+	defer Put(buf)
+	n := binary.PutUvarint(buf, uint64(len(frame)))
+	n += copy(buf[n:], frame)
+	_, err := w.w.Write(buf[:n])
+	return err
+}
+
+// Stream wraps an inet.Stream to read and write frames. If the timeouts are
+// set a deadline is set on the stream before each read or write.
+type Stream struct {
+	inet.Stream
+
+	// ReadTimeout is the max amount of time to wait for a frame.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the max amount of time to spend writing a frame.
+	WriteTimeout time.Duration
+
+	r *Reader
+	w *Writer
+}
+
+// NewStream returns a Stream which rejects frames larger than max. If max is
+// zero DefaultMaxFrameSize is used.
+func NewStream(s inet.Stream, max int) *Stream {
+	return &Stream{
+		Stream: s,
+		r:      NewReader(s, max),
+		w:      NewWriter(s, max),
+	}
+}
+
+// ReadFrame reads the next frame from the stream. See Reader.ReadFrame.
+func (s *Stream) ReadFrame() ([]byte, error) {
+	if s.ReadTimeout > 0 {
+		s.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+	return s.r.ReadFrame()
+}
+
+// WriteFrame writes the frame to the stream.
+func (s *Stream) WriteFrame(frame []byte) error {
+	if s.WriteTimeout > 0 {
+		s.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+	return s.w.WriteFrame(frame)
+}
+
+// CloseWrite closes our side of the stream. The remote peer reads io.EOF
+// after the last frame but we can keep reading what it sends.
+func (s *Stream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close closes our side of the stream and waits for the remote peer to close
+// its side. Any frames the remote peer sends in the meantime are discarded. If
+// the remote peer doesn't close within the ReadTimeout, or DefaultCloseTimeout
+// if that is shorter or no ReadTimeout is set, or sends anything other than
+// whole frames, the stream is reset.
+func (s *Stream) Close() error {
+	if err := s.Stream.Close(); err != nil {
+		s.Stream.Reset()
+		return err
+	}
+	timeout := DefaultCloseTimeout
+	if s.ReadTimeout > 0 && s.ReadTimeout < timeout {
+		timeout = s.ReadTimeout
+	}
+	s.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		l, err := s.r.NextFrameSize()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			_, err = s.r.r.Discard(l)
+		}
+		if err != nil {
+			s.Stream.Reset()
+			return err
+		}
+	}
+}
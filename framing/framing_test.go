@@ -0,0 +1,150 @@
+package framing
+
+import (
+	"bytes"
+	"encoding/binary"
+	inet "github.com/libp2p/go-libp2p-net"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadWriteFrames(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, 16)
+	frames := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{1}, 16)}
+	for _, frame := range frames {
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteFrame(make([]byte, 17)); err != ErrFrameTooLarge {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+
+	r := NewReader(&buf, 16)
+	for _, expected := range frames {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, expected) {
+			t.Fatalf("expected %x, got %x", expected, frame)
+		}
+		Put(frame)
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestReadMalformedFrames(t *testing.T) {
+	uvarint := func(l uint64) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return buf[:binary.PutUvarint(buf, l)]
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"too large", uvarint(17), ErrFrameTooLarge},
+		{"huge length", uvarint(1 << 62), ErrFrameTooLarge},
+		{"varint overflow", bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1), ErrMalformedFrame},
+		{"truncated length", []byte{0x80}, io.ErrUnexpectedEOF},
+		{"truncated payload", append(uvarint(10), "short"...), io.ErrUnexpectedEOF},
+		{"missing payload", uvarint(1), io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		r := NewReader(bytes.NewReader(test.data), 16)
+		if _, err := r.ReadFrame(); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// A zero length frame is valid and empty.
+	r := NewReader(bytes.NewReader(uvarint(0)), 16)
+	frame, err := r.ReadFrame()
+	if err != nil || len(frame) != 0 {
+		t.Fatalf("expected an empty frame, got %x (%v)", frame, err)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte{0x05, 'h', 'e', 'l', 'l', 'o'})
+	f.Add([]byte{0x00})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const max = 64
+		r := NewReader(bytes.NewReader(data), max)
+		read := 0
+		for {
+			frame, err := r.ReadFrame()
+			if err != nil {
+				break
+			}
+			if len(frame) > max {
+				t.Fatalf("read a %d byte frame with a max of %d", len(frame), max)
+			}
+			read += len(frame)
+			Put(frame)
+		}
+		if read > len(data) {
+			t.Fatalf("read %d bytes of frames from %d bytes", read, len(data))
+		}
+	})
+}
+
+// pipeStream is a stream over one end of a net.Pipe. Close only closes our
+// side, as it does for libp2p streams.
+type pipeStream struct {
+	inet.Stream
+
+	conn  net.Conn
+	reset chan struct{}
+}
+
+func (s *pipeStream) Read(p []byte) (int, error)         { return s.conn.Read(p) }
+func (s *pipeStream) Write(p []byte) (int, error)        { return s.conn.Write(p) }
+func (s *pipeStream) Close() error                       { return nil }
+func (s *pipeStream) SetDeadline(t time.Time) error      { return s.conn.SetDeadline(t) }
+func (s *pipeStream) SetReadDeadline(t time.Time) error  { return s.conn.SetReadDeadline(t) }
+func (s *pipeStream) SetWriteDeadline(t time.Time) error { return s.conn.SetWriteDeadline(t) }
+func (s *pipeStream) Reset() error                       { close(s.reset); return s.conn.Close() }
+
+func TestCloseBoundedByReadTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	ps := &pipeStream{conn: local, reset: make(chan struct{})}
+	s := NewStream(ps, 0)
+	s.ReadTimeout = time.Millisecond * 100
+
+	// The remote peer never closes its side.
+	start := time.Now()
+	if err := s.Close(); err == nil {
+		t.Fatal("expected close to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("close took %s", elapsed)
+	}
+	select {
+	case <-ps.reset:
+	default:
+		t.Fatal("stream not reset")
+	}
+}
+
+func TestCloseDiscardsFrames(t *testing.T) {
+	local, remote := net.Pipe()
+	ps := &pipeStream{conn: local, reset: make(chan struct{})}
+	s := NewStream(ps, 0)
+	go func() {
+		w := NewWriter(remote, 0)
+		w.WriteFrame([]byte("late"))
+		remote.Close()
+	}()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,536 @@
+package overlaynetwork
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// GroupKeyGracePeriod is how long we keep listening on a group's old
+	// topic after the key is rotated so that messages which were in flight
+	// are not lost.
+	GroupKeyGracePeriod = time.Minute
+
+	// GroupKeyTimeout is the max amount of time we will wait to deliver a
+	// group key to a member.
+	GroupKeyTimeout = time.Second * 30
+
+	// GroupKeyRetryInterval is how long we wait before retrying to deliver
+	// the group key to a member we failed to reach. The interval doubles
+	// with each attempt up to GroupKeyRetryMax.
+	GroupKeyRetryInterval = time.Second * 30
+
+	// GroupKeyRetryMax is the max amount of time between attempts to
+	// deliver the group key to a member.
+	GroupKeyRetryMax = time.Minute * 10
+
+	// ErrNotGroupAdmin is returned when trying to change the membership of a
+	// group we are not the admin of.
+	ErrNotGroupAdmin = errors.New("not the group admin")
+
+	// ErrGroupClosed is returned when using a group we have left.
+	ErrGroupClosed = errors.New("group closed")
+
+	// ErrNoGroupKey is returned when publishing to a group whose key we
+	// don't have.
+	ErrNoGroupKey = errors.New("no group key")
+
+	// groupKeyMessageSizeMax is the max size of a group key message.
+	groupKeyMessageSizeMax = int64(1 << 16)
+)
+
+// groupKeyProtocol returns the protocol ID used to distribute group keys on
+// the given network.
+func groupKeyProtocol(network string) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/bitcoincash/%s/group-key/1.0.0", network))
+}
+
+// groupKeyMessage is sent by the group admin to each member whenever the
+// group key changes. Streams are encrypted and authenticated by libp2p so the
+// key is only readable by the member it is sent to.
+type groupKeyMessage struct {
+	GroupID string   `json:"groupID"`
+	Name    string   `json:"name"`
+	Key     []byte   `json:"key"`
+	Epoch   uint64   `json:"epoch"`
+	Members []string `json:"members"`
+}
+
+// GroupMessage is a decrypted message received on a group topic.
+type GroupMessage struct {
+	// From is the member who published the message.
+	From peer.ID
+
+	// Data is the decrypted message.
+	Data []byte
+
+	// Epoch is the key epoch the message was sealed with.
+	Epoch uint64
+}
+
+// GroupManager manages the encrypted group topics this node is a member of.
+// Each group has a shared key which is used to seal the messages published
+// to the group. The pubsub topic is derived from the key so observers can't
+// tell which group a topic belongs to. The admin of a group distributes the
+// key to each member over a direct stream and rotates it whenever the
+// membership changes.
+type GroupManager struct {
+	ps       *Pubsub
+	ht       host.Host
+	protocol protocol.ID
+
+	// InviteHandler is called when a peer adds us to a new group. Returning
+	// true joins the group. If nil all invites are rejected. It is called
+	// without holding any locks so it may use the GroupManager.
+	InviteHandler func(admin peer.ID, name string) bool
+
+	groups map[string]*Group
+	joined chan *Group
+	mtx    sync.Mutex
+}
+
+func newGroupManager(ps *Pubsub, ht host.Host, network string) *GroupManager {
+	gm := &GroupManager{
+		ps:       ps,
+		ht:       ht,
+		protocol: groupKeyProtocol(network),
+		groups:   make(map[string]*Group),
+		joined:   make(chan *Group, 8),
+	}
+	ht.SetStreamHandler(gm.protocol, gm.handleKeyStream)
+	return gm
+}
+
+// CreateGroup creates a new group with us as the admin and sends the group key
+// to the members. Members we can't reach are still added and we keep trying
+// to send them the key in the background.
+func (gm *GroupManager) CreateGroup(ctx context.Context, name string, members []peer.ID) (*Group, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	g := gm.newGroup(hex.EncodeToString(id), name, gm.ht.ID())
+	ms := map[peer.ID]struct{}{gm.ht.ID(): {}}
+	for _, m := range members {
+		ms[m] = struct{}{}
+	}
+
+	gm.mtx.Lock()
+	gm.groups[g.ID] = g
+	gm.mtx.Unlock()
+
+	if err := g.rotate(ctx, ms); err != nil {
+		g.Leave()
+		return nil, err
+	}
+	return g, nil
+}
+
+// Group returns the group with the given ID or nil if we aren't a member.
+func (gm *GroupManager) Group(id string) *Group {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	return gm.groups[id]
+}
+
+// Groups returns the groups we are a member of.
+func (gm *GroupManager) Groups() []*Group {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	groups := make([]*Group, 0, len(gm.groups))
+	for _, g := range gm.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// Joined returns a channel on which the groups we join through an invite are
+// sent. Groups are dropped if the channel is not being read from.
+func (gm *GroupManager) Joined() <-chan *Group {
+	return gm.joined
+}
+
+func (gm *GroupManager) newGroup(id, name string, admin peer.ID) *Group {
+	ctx, cancel := context.WithCancel(gm.ps.ctx)
+	return &Group{
+		ID:      id,
+		Name:    name,
+		gm:      gm,
+		admin:   admin,
+		members: make(map[peer.ID]struct{}),
+		msgs:    make(chan *GroupMessage, 32),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// handleKeyStream receives a group key from a group admin.
+func (gm *GroupManager) handleKeyStream(s inet.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(GroupKeyTimeout))
+	from := s.Conn().RemotePeer()
+
+	msg := new(groupKeyMessage)
+	if err := json.NewDecoder(io.LimitReader(s, groupKeyMessageSizeMax)).Decode(msg); err != nil {
+		s.Reset()
+		return
+	}
+	members := make(map[peer.ID]struct{})
+	for _, m := range msg.Members {
+		pid, err := peer.IDB58Decode(m)
+		if err != nil {
+			return
+		}
+		members[pid] = struct{}{}
+	}
+	if _, ok := members[gm.ht.ID()]; !ok || len(msg.Key) != 32 {
+		return
+	}
+
+	gm.mtx.Lock()
+	g, ok := gm.groups[msg.GroupID]
+	gm.mtx.Unlock()
+	if !ok {
+		if gm.InviteHandler == nil || !gm.InviteHandler(from, msg.Name) {
+			log.Debugf("group: rejected invite to %s from %s", msg.Name, from)
+			return
+		}
+		// The admin may have sent us another key for the group while the
+		// handler was running.
+		gm.mtx.Lock()
+		g, ok = gm.groups[msg.GroupID]
+		if !ok {
+			g = gm.newGroup(msg.GroupID, msg.Name, from)
+			gm.groups[g.ID] = g
+		}
+		gm.mtx.Unlock()
+	}
+
+	if g.admin != from {
+		log.Debugf("group: %s sent a key for %s but is not the admin", from, g.ID)
+		return
+	}
+	if err := g.setKey(msg.Key, msg.Epoch, members); err != nil {
+		log.Debugf("group: failed to set key for %s: %s", g.ID, err)
+		return
+	}
+	if !ok {
+		select {
+		case gm.joined <- g:
+		default:
+		}
+	}
+}
+
+// Group is an encrypted pubsub group.
+type Group struct {
+	// ID is the randomly generated ID of the group.
+	ID string
+
+	// Name is the name the admin gave the group.
+	Name string
+
+	gm      *GroupManager
+	admin   peer.ID
+	members map[peer.ID]struct{}
+	key     []byte
+	aead    cipher.AEAD
+	epoch   uint64
+	topic   string
+	stop    context.CancelFunc
+	msgs    chan *GroupMessage
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mtx     sync.RWMutex
+}
+
+// Admin returns the admin of the group.
+func (g *Group) Admin() peer.ID {
+	return g.admin
+}
+
+// Members returns the members of the group including the admin.
+func (g *Group) Members() []peer.ID {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	members := make([]peer.ID, 0, len(g.members))
+	for m := range g.members {
+		members = append(members, m)
+	}
+	return members
+}
+
+// AddMember adds the peer to the group and rotates the group key. Only the
+// admin may add members.
+func (g *Group) AddMember(ctx context.Context, p peer.ID) error {
+	g.mtx.RLock()
+	members := make(map[peer.ID]struct{}, len(g.members)+1)
+	for m := range g.members {
+		members[m] = struct{}{}
+	}
+	g.mtx.RUnlock()
+	members[p] = struct{}{}
+	return g.rotate(ctx, members)
+}
+
+// RemoveMember removes the peer from the group and rotates the group key so
+// that the peer can't read any future messages. Only the admin may remove
+// members.
+func (g *Group) RemoveMember(ctx context.Context, p peer.ID) error {
+	if p == g.admin {
+		return errors.New("can't remove the group admin")
+	}
+	g.mtx.RLock()
+	members := make(map[peer.ID]struct{}, len(g.members))
+	for m := range g.members {
+		if m != p {
+			members[m] = struct{}{}
+		}
+	}
+	g.mtx.RUnlock()
+	return g.rotate(ctx, members)
+}
+
+// Rotate generates a new group key and sends it to the members. Only the
+// admin may rotate the key. Members we can't reach are sent the key in the
+// background.
+func (g *Group) Rotate(ctx context.Context) error {
+	return g.rotate(ctx, nil)
+}
+
+// rotate generates a new key for the given members, or the current members if
+// nil, and sends it to each of them. An unreachable member doesn't hold up the
+// rest of the group, we keep retrying it until the key changes again.
+func (g *Group) rotate(ctx context.Context, members map[peer.ID]struct{}) error {
+	if g.admin != g.gm.ht.ID() {
+		return ErrNotGroupAdmin
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	g.mtx.RLock()
+	epoch := g.epoch + 1
+	if members == nil {
+		members = g.members
+	}
+	g.mtx.RUnlock()
+
+	if err := g.setKey(key, epoch, members); err != nil {
+		return err
+	}
+
+	msg := &groupKeyMessage{
+		GroupID: g.ID,
+		Name:    g.Name,
+		Key:     key,
+		Epoch:   epoch,
+	}
+	for m := range members {
+		msg.Members = append(msg.Members, peer.IDB58Encode(m))
+	}
+
+	var wg sync.WaitGroup
+	for m := range members {
+		if m == g.gm.ht.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(m peer.ID) {
+			defer wg.Done()
+			if err := g.gm.sendKey(ctx, m, msg); err != nil {
+				log.Warnf("group: failed to send key for %s to %s, will retry: %s", g.ID, m, err)
+				go g.retrySendKey(m, msg)
+			}
+		}(m)
+	}
+	wg.Wait()
+	return nil
+}
+
+// retrySendKey keeps trying to send the key to the member until it succeeds,
+// the key is rotated again or we leave the group.
+func (g *Group) retrySendKey(p peer.ID, msg *groupKeyMessage) {
+	interval := GroupKeyRetryInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-g.ctx.Done():
+			return
+		}
+		g.mtx.RLock()
+		current := g.epoch == msg.Epoch
+		g.mtx.RUnlock()
+		if !current {
+			return
+		}
+		err := g.gm.sendKey(g.ctx, p, msg)
+		if err == nil {
+			log.Debugf("group: sent key for %s to %s", g.ID, p)
+			return
+		}
+		log.Debugf("group: failed to send key for %s to %s: %s", g.ID, p, err)
+		interval *= 2
+		if interval > GroupKeyRetryMax {
+			interval = GroupKeyRetryMax
+		}
+	}
+}
+
+func (gm *GroupManager) sendKey(ctx context.Context, p peer.ID, msg *groupKeyMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, GroupKeyTimeout)
+	defer cancel()
+
+	s, err := gm.ht.NewStream(ctx, p, gm.protocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := json.NewEncoder(s).Encode(msg); err != nil {
+		s.Reset()
+		return err
+	}
+	return nil
+}
+
+// setKey switches the group to a new key. We subscribe to the topic derived
+// from the new key and keep listening on the old topic for the grace period.
+func (g *Group) setKey(key []byte, epoch uint64, members map[peer.ID]struct{}) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if g.ctx.Err() != nil {
+		return ErrGroupClosed
+	}
+	if epoch <= g.epoch && g.key != nil {
+		return errors.New("stale group key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	// The topic isn't advertised in the DHT as that would reveal who the
+	// members are. They are connected through the invites instead.
+	topic := groupTopicName(key)
+	sub, err := g.gm.ps.subscribe(g.ctx, topic, false)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := context.WithCancel(g.ctx)
+	go g.readMessages(ctx, sub, aead, topic, epoch)
+
+	if g.stop != nil {
+		oldStop := g.stop
+		time.AfterFunc(GroupKeyGracePeriod, oldStop)
+	}
+	g.key = key
+	g.aead = aead
+	g.epoch = epoch
+	g.topic = topic
+	g.stop = stop
+	g.members = members
+	return nil
+}
+
+// readMessages decrypts the messages received on one of the group's topics
+// until the context is cancelled.
+func (g *Group) readMessages(ctx context.Context, sub *Subscription, aead cipher.AEAD, topic string, epoch uint64) {
+	defer sub.Cancel()
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		from := msg.GetFrom()
+		g.mtx.RLock()
+		_, member := g.members[from]
+		g.mtx.RUnlock()
+		if !member {
+			continue
+		}
+		data, err := openGroupMessage(aead, topic, msg.GetData())
+		if err != nil {
+			log.Debugf("group: failed to open message from %s: %s", from, err)
+			continue
+		}
+		select {
+		case g.msgs <- &GroupMessage{From: from, Data: data, Epoch: epoch}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Publish seals the data with the current group key and publishes it to the
+// group topic.
+func (g *Group) Publish(ctx context.Context, data []byte) error {
+	g.mtx.RLock()
+	aead, topic := g.aead, g.topic
+	g.mtx.RUnlock()
+	if g.ctx.Err() != nil {
+		return ErrGroupClosed
+	}
+	if aead == nil {
+		return ErrNoGroupKey
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, data, []byte(topic))
+	return g.gm.ps.Publish(ctx, topic, sealed)
+}
+
+// Next returns the next message published to the group.
+func (g *Group) Next(ctx context.Context) (*GroupMessage, error) {
+	select {
+	case msg := <-g.msgs:
+		return msg, nil
+	case <-g.ctx.Done():
+		return nil, ErrGroupClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Leave stops listening to the group and forgets the group key.
+func (g *Group) Leave() {
+	g.cancel()
+	g.gm.mtx.Lock()
+	delete(g.gm.groups, g.ID)
+	g.gm.mtx.Unlock()
+}
+
+func openGroupMessage(aead cipher.AEAD, topic string, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("message too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(topic))
+}
+
+// groupTopicName derives the pubsub topic for a group key.
+func groupTopicName(key []byte) string {
+	h := sha256.Sum256(append([]byte("overlay-group-topic:"), key...))
+	return "group:" + hex.EncodeToString(h[:])
+}
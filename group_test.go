@@ -0,0 +1,205 @@
+package overlaynetwork
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-peer"
+	"testing"
+	"time"
+)
+
+// newGroupTestNodes returns connected floodsub nodes which accept every group
+// invite.
+func newGroupTestNodes(t *testing.T, count int) []*OverlayNode {
+	var nodes []*OverlayNode
+	for i := 0; i < count; i++ {
+		n := newTestNode(t, func(cfg *NodeConfig) { cfg.PubsubRouter = PubsubRouterFloodSub })
+		n.Groups.InviteHandler = func(peer.ID, string) bool { return true }
+		for _, other := range nodes {
+			connectNodes(t, n, other)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// waitForGroup waits for the node to join the group with the given key epoch.
+func waitForGroup(t *testing.T, n *OverlayNode, id string, epoch uint64) *Group {
+	t.Helper()
+	var g *Group
+	ok := waitFor(t, time.Second*10, func() bool {
+		g = n.Groups.Group(id)
+		if g == nil {
+			return false
+		}
+		g.mtx.RLock()
+		defer g.mtx.RUnlock()
+		return g.epoch == epoch
+	})
+	if !ok {
+		t.Fatalf("node did not receive epoch %d of group %s", epoch, id)
+	}
+	return g
+}
+
+// publishToGroup publishes to the group once the admin sees count topic peers.
+func publishToGroup(t *testing.T, g *Group, count int, data string) {
+	t.Helper()
+	g.mtx.RLock()
+	topic := g.topic
+	g.mtx.RUnlock()
+	ok := waitFor(t, time.Second*10, func() bool {
+		return len(g.gm.ps.ps.ListPeers(topic)) >= count
+	})
+	if !ok {
+		t.Fatal("group topic peers not found")
+	}
+	if err := g.Publish(context.Background(), []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextGroupMessage(g *Group, timeout time.Duration) (*GroupMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return g.Next(ctx)
+}
+
+func TestGroupInvite(t *testing.T) {
+	nodes := newGroupTestNodes(t, 3)
+	admin, member, rejecter := nodes[0], nodes[1], nodes[2]
+
+	// The handler may use the group manager.
+	invited := make(chan int, 1)
+	member.Groups.InviteHandler = func(admin peer.ID, name string) bool {
+		invited <- len(member.Groups.Groups())
+		return name == "friends"
+	}
+	rejecter.Groups.InviteHandler = nil
+
+	g, err := admin.Groups.CreateGroup(context.Background(), "friends", []peer.ID{member.Host.ID(), rejecter.Host.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-invited:
+	case <-time.After(time.Second * 10):
+		t.Fatal("invite handler not called")
+	}
+	var joined *Group
+	select {
+	case joined = <-member.Groups.Joined():
+	case <-time.After(time.Second * 10):
+		t.Fatal("member did not join the group")
+	}
+	if joined.ID != g.ID || joined.Name != "friends" || joined.Admin() != admin.Host.ID() {
+		t.Fatalf("joined the wrong group %s %s", joined.ID, joined.Name)
+	}
+	if rejecter.Groups.Group(g.ID) != nil {
+		t.Fatal("rejected invite joined the group")
+	}
+
+	publishToGroup(t, g, 1, "hello")
+	msg, err := nextGroupMessage(joined, time.Second*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != "hello" || msg.From != admin.Host.ID() || msg.Epoch != 1 {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	// The group topic isn't advertised in the DHT.
+	g.mtx.RLock()
+	topic := g.topic
+	g.mtx.RUnlock()
+	admin.PubSub.mtx.Lock()
+	ts, ok := admin.PubSub.topics[topic]
+	advertised := ok && ts.cancel != nil
+	admin.PubSub.mtx.Unlock()
+	if !ok || advertised {
+		t.Fatal("group topic advertised")
+	}
+}
+
+func TestGroupRotationAndRemoval(t *testing.T) {
+	nodes := newGroupTestNodes(t, 3)
+	admin, stays, removed := nodes[0], nodes[1], nodes[2]
+
+	g, err := admin.Groups.CreateGroup(context.Background(), "rotate", []peer.ID{stays.Host.ID(), removed.Host.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForGroup(t, stays, g.ID, 1)
+	removedGroup := waitForGroup(t, removed, g.ID, 1)
+
+	if err := g.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitForGroup(t, removed, g.ID, 2)
+
+	if err := g.RemoveMember(context.Background(), removed.Host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	staysGroup := waitForGroup(t, stays, g.ID, 3)
+	if len(g.Members()) != 2 {
+		t.Fatalf("expected 2 members, got %d", len(g.Members()))
+	}
+	if err := g.RemoveMember(context.Background(), admin.Host.ID()); err == nil {
+		t.Fatal("removed the admin")
+	}
+	if err := staysGroup.Rotate(context.Background()); err != ErrNotGroupAdmin {
+		t.Fatalf("expected ErrNotGroupAdmin, got %v", err)
+	}
+
+	publishToGroup(t, g, 1, "secret")
+	msg, err := nextGroupMessage(staysGroup, time.Second*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data) != "secret" || msg.Epoch != 3 {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	// The removed member never got the new key.
+	if msg, err := nextGroupMessage(removedGroup, time.Millisecond*500); err == nil {
+		t.Fatalf("removed member received %q", msg.Data)
+	}
+	removedGroup.mtx.RLock()
+	epoch := removedGroup.epoch
+	removedGroup.mtx.RUnlock()
+	if epoch != 2 {
+		t.Fatalf("removed member has epoch %d", epoch)
+	}
+}
+
+func TestGroupUnreachableMember(t *testing.T) {
+	timeout, interval := GroupKeyTimeout, GroupKeyRetryInterval
+	GroupKeyTimeout, GroupKeyRetryInterval = time.Second, time.Millisecond*100
+	defer func() { GroupKeyTimeout, GroupKeyRetryInterval = timeout, interval }()
+
+	nodes := newGroupTestNodes(t, 2)
+	admin, member := nodes[0], nodes[1]
+	late := newTestNode(t, func(cfg *NodeConfig) { cfg.PubsubRouter = PubsubRouterFloodSub })
+	late.Groups.InviteHandler = func(peer.ID, string) bool { return true }
+
+	// We don't know how to reach the late member yet.
+	g, err := admin.Groups.CreateGroup(context.Background(), "late", []peer.ID{member.Host.ID(), late.Host.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Members()) != 3 {
+		t.Fatalf("expected 3 members, got %d", len(g.Members()))
+	}
+	waitForGroup(t, member, g.ID, 1)
+
+	// The key is delivered once the member is reachable.
+	connectNodes(t, late, admin)
+	waitForGroup(t, late, g.ID, 1)
+}
+
+func TestGroupPublishWithoutKey(t *testing.T) {
+	n := newTestNode(t, nil)
+	g := n.Groups.newGroup("id", "name", n.Host.ID())
+	if err := g.Publish(context.Background(), []byte("hello")); err != ErrNoGroupKey {
+		t.Fatalf("expected ErrNoGroupKey, got %v", err)
+	}
+}
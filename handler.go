@@ -0,0 +1,302 @@
+package overlaynetwork
+
+import (
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a stream handler to add behavior before or after it runs.
+// A middleware which rejects a stream should reset it and not call next.
+type Middleware func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler
+
+// Handle registers the handler for the protocol wrapped in the middlewares.
+// The first middleware is the outermost, so it runs first when a stream is
+// opened. Streams from banned peers are always rejected before any of the
+// middlewares run.
+func (n *OverlayNode) Handle(pid protocol.ID, handler inet.StreamHandler, middlewares ...Middleware) {
+	n.Host.SetStreamHandler(pid, n.wrapHandler(pid, handler, middlewares))
+}
+
+// wrapHandler wraps the handler in the middlewares and the ban check.
+func (n *OverlayNode) wrapHandler(pid protocol.ID, handler inet.StreamHandler, middlewares []Middleware) inet.StreamHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](pid, handler)
+	}
+	return func(s inet.Stream) {
+		if n.misbehavior.isBanned(s.Conn().RemotePeer()) {
+			s.Reset()
+			return
+		}
+		handler(s)
+	}
+}
+
+// Recover recovers from panics in the handler. The panic is logged and the
+// stream is reset.
+func Recover() Middleware {
+	return func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		return func(s inet.Stream) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("panic in %s handler: %v\n%s", pid, r, debug.Stack())
+					s.Reset()
+				}
+			}()
+			next(s)
+		}
+	}
+}
+
+// Logging logs the opening and closing of each stream at the debug level.
+func Logging() Middleware {
+	return func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		return func(s inet.Stream) {
+			p := s.Conn().RemotePeer()
+			start := time.Now()
+			log.Debugf("%s: new stream from %s", pid, p)
+			next(s)
+			log.Debugf("%s: stream from %s done after %s", pid, p, time.Since(start))
+		}
+	}
+}
+
+// Timeout sets a deadline on the stream and resets it if the handler is still
+// running after the timeout.
+func Timeout(timeout time.Duration) Middleware {
+	return func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		return func(s inet.Stream) {
+			s.SetDeadline(time.Now().Add(timeout))
+			timer := time.AfterFunc(timeout, func() {
+				log.Debugf("%s: stream from %s timed out", pid, s.Conn().RemotePeer())
+				s.Reset()
+			})
+			defer timer.Stop()
+			next(s)
+		}
+	}
+}
+
+// ConcurrencyLimit limits the number of streams for the protocol which are
+// handled at the same time. Streams over the limit are reset.
+func ConcurrencyLimit(max int) Middleware {
+	return func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		sem := make(chan struct{}, max)
+		return func(s inet.Stream) {
+			select {
+			case sem <- struct{}{}:
+			default:
+				log.Debugf("%s: rejecting stream from %s: too many streams", pid, s.Conn().RemotePeer())
+				s.Reset()
+				return
+			}
+			defer func() { <-sem }()
+			next(s)
+		}
+	}
+}
+
+// PeerConcurrencyLimit limits the number of streams for the protocol which
+// are handled at the same time for each peer. Streams over the limit are
+// reset.
+func PeerConcurrencyLimit(max int) Middleware {
+	return func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		var (
+			active = make(map[peer.ID]int)
+			mtx    sync.Mutex
+		)
+		return func(s inet.Stream) {
+			p := s.Conn().RemotePeer()
+			mtx.Lock()
+			if active[p] >= max {
+				mtx.Unlock()
+				log.Debugf("%s: rejecting stream from %s: too many streams from peer", pid, p)
+				s.Reset()
+				return
+			}
+			active[p]++
+			mtx.Unlock()
+
+			defer func() {
+				mtx.Lock()
+				active[p]--
+				if active[p] == 0 {
+					delete(active, p)
+				}
+				mtx.Unlock()
+			}()
+			next(s)
+		}
+	}
+}
+
+// PeerRateLimit limits the rate at which each peer may open streams for the
+// protocol. Only the Messages and Burst fields of the limit are used, with
+// Messages being the number of streams per second. Streams over the limit are
+// reset.
+func PeerRateLimit(limit RateLimit) Middleware {
+	return func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		if limit.Messages <= 0 {
+			return next
+		}
+		rl := newPeerRateLimiter(limit)
+		return func(s inet.Stream) {
+			p := s.Conn().RemotePeer()
+			if !rl.allow(p, time.Now()) {
+				log.Debugf("%s: rejecting stream from %s: rate limit exceeded", pid, p)
+				s.Reset()
+				return
+			}
+			next(s)
+		}
+	}
+}
+
+// idleBucketTimeout is how long a peer's stream rate limit bucket is kept
+// after it was last used. It is also how often idle buckets are removed.
+const idleBucketTimeout = time.Minute * 10
+
+// peerRateLimiter holds the PeerRateLimit bucket of each peer.
+type peerRateLimiter struct {
+	limit     RateLimit
+	buckets   map[peer.ID]*tokenBucket
+	lastSweep time.Time
+	mtx       sync.Mutex
+}
+
+func newPeerRateLimiter(limit RateLimit) *peerRateLimiter {
+	return &peerRateLimiter{
+		limit:     limit,
+		buckets:   make(map[peer.ID]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the peer's bucket if it has one.
+func (rl *peerRateLimiter) allow(p peer.ID, now time.Time) bool {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	// The middleware has no lifetime to run a goroutine off so idle buckets
+	// are removed here, at most once per idleBucketTimeout. Full buckets are
+	// the same as new ones so there is no need to keep them.
+	if now.Sub(rl.lastSweep) >= idleBucketTimeout {
+		for id, bucket := range rl.buckets {
+			if now.Sub(bucket.last) > idleBucketTimeout {
+				delete(rl.buckets, id)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[p]
+	if !ok {
+		b = newTokenBucket(rl.limit.Messages, rl.limit.Burst, now)
+		rl.buckets[p] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// AllowPeers only accepts streams from the given peers.
+func AllowPeers(peers ...peer.ID) Middleware {
+	allowed := make(map[peer.ID]struct{}, len(peers))
+	for _, p := range peers {
+		allowed[p] = struct{}{}
+	}
+	return PeerFilter(func(p peer.ID) bool {
+		_, ok := allowed[p]
+		return ok
+	})
+}
+
+// DenyPeers rejects streams from the given peers.
+func DenyPeers(peers ...peer.ID) Middleware {
+	denied := make(map[peer.ID]struct{}, len(peers))
+	for _, p := range peers {
+		denied[p] = struct{}{}
+	}
+	return PeerFilter(func(p peer.ID) bool {
+		_, ok := denied[p]
+		return !ok
+	})
+}
+
+// PeerFilter only accepts streams from peers for which allow returns true.
+// It can be used for access control lists which change over time.
+func PeerFilter(allow func(p peer.ID) bool) Middleware {
+	return func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		return func(s inet.Stream) {
+			if !allow(s.Conn().RemotePeer()) {
+				log.Debugf("%s: rejecting stream from %s: not allowed", pid, s.Conn().RemotePeer())
+				s.Reset()
+				return
+			}
+			next(s)
+		}
+	}
+}
+
+// HandlerMetrics holds the counters updated by the Metrics middleware. It is
+// safe to read it while streams are being handled using Snapshot.
+type HandlerMetrics struct {
+	streams  int64
+	active   int64
+	panics   int64
+	duration int64
+}
+
+// HandlerMetricsSnapshot is a point in time copy of the HandlerMetrics.
+type HandlerMetricsSnapshot struct {
+	// Streams is the total number of streams handled.
+	Streams int64
+
+	// Active is the number of streams being handled now.
+	Active int64
+
+	// Panics is the number of handlers which panicked.
+	Panics int64
+
+	// TotalDuration is the sum of the time spent handling streams.
+	TotalDuration time.Duration
+}
+
+// Snapshot returns a copy of the current counters.
+func (m *HandlerMetrics) Snapshot() HandlerMetricsSnapshot {
+	return HandlerMetricsSnapshot{
+		Streams:       atomic.LoadInt64(&m.streams),
+		Active:        atomic.LoadInt64(&m.active),
+		Panics:        atomic.LoadInt64(&m.panics),
+		TotalDuration: time.Duration(atomic.LoadInt64(&m.duration)),
+	}
+}
+
+// Metrics records the number of streams handled, how many are active, how
+// long they took and how many panicked. Panics are counted and then passed on
+// so it should be placed after Recover.
+func Metrics(m *HandlerMetrics) Middleware {
+	return func(pid protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		return func(s inet.Stream) {
+			start := time.Now()
+			atomic.AddInt64(&m.streams, 1)
+			atomic.AddInt64(&m.active, 1)
+			defer func() {
+				atomic.AddInt64(&m.active, -1)
+				atomic.AddInt64(&m.duration, int64(time.Since(start)))
+				if r := recover(); r != nil {
+					atomic.AddInt64(&m.panics, 1)
+					panic(r)
+				}
+			}()
+			next(s)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package overlaynetwork
+
+import (
+	"context"
+	"fmt"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+const testHandlerProtocol = protocol.ID("/overlay/test/handler")
+
+// okHandler reads a byte from the stream and replies with ok.
+func okHandler(s inet.Stream) {
+	defer s.Close()
+	buf := make([]byte, 1)
+	if _, err := s.Read(buf); err != nil {
+		s.Reset()
+		return
+	}
+	s.Write([]byte("ok"))
+}
+
+// callHandler opens a stream from a to b, sends a byte and returns an error
+// unless the handler replied with ok.
+func callHandler(t *testing.T, a, b *OverlayNode) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	s, err := a.Host.NewStream(ctx, b.Host.ID(), testHandlerProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := s.Write([]byte{1}); err != nil {
+		return err
+	}
+	resp, err := ioutil.ReadAll(s)
+	if err != nil {
+		return err
+	}
+	if string(resp) != "ok" {
+		return fmt.Errorf("unexpected response %q", resp)
+	}
+	return nil
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	a, b := newTestNode(t, nil), newTestNode(t, nil)
+	connectNodes(t, a, b)
+
+	var metrics HandlerMetrics
+	b.Handle(testHandlerProtocol, func(s inet.Stream) {
+		panic("handler panicked")
+	}, Recover(), Metrics(&metrics))
+
+	if err := callHandler(t, a, b); err == nil {
+		t.Fatal("stream not reset after the panic")
+	}
+	if !waitFor(t, time.Second*5, func() bool { return metrics.Snapshot().Panics == 1 }) {
+		t.Fatalf("expected 1 panic, got %+v", metrics.Snapshot())
+	}
+
+	// The node keeps serving streams after the panic.
+	b.Handle(testHandlerProtocol, okHandler, Recover(), Metrics(&metrics))
+	if err := callHandler(t, a, b); err != nil {
+		t.Fatal(err)
+	}
+	if snap := metrics.Snapshot(); snap.Streams != 2 || snap.Active != 0 {
+		t.Fatalf("unexpected metrics %+v", snap)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	a, b := newTestNode(t, nil), newTestNode(t, nil)
+	connectNodes(t, a, b)
+
+	done := make(chan struct{})
+	b.Handle(testHandlerProtocol, func(s inet.Stream) {
+		defer close(done)
+		// Block until the stream is reset.
+		ioutil.ReadAll(s)
+	}, Timeout(time.Millisecond*100))
+
+	if err := callHandler(t, a, b); err == nil {
+		t.Fatal("stream not reset after the timeout")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler still running after the timeout")
+	}
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	a, b := newTestNode(t, nil), newTestNode(t, nil)
+	connectNodes(t, a, b)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	b.Handle(testHandlerProtocol, func(s inet.Stream) {
+		select {
+		case started <- struct{}{}:
+			<-release
+		default:
+		}
+		okHandler(s)
+	}, ConcurrencyLimit(1))
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- callHandler(t, a, b) }()
+	select {
+	case <-started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler not called")
+	}
+
+	// The first stream is still being handled so the second is rejected.
+	if err := callHandler(t, a, b); err == nil {
+		t.Fatal("stream over the limit accepted")
+	}
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+	if err := callHandler(t, a, b); err != nil {
+		t.Fatalf("stream rejected once the limit was freed: %s", err)
+	}
+}
+
+func TestPeerRateLimitMiddleware(t *testing.T) {
+	a, b, c := newTestNode(t, nil), newTestNode(t, nil), newTestNode(t, nil)
+	connectNodes(t, a, b)
+	connectNodes(t, c, b)
+
+	b.Handle(testHandlerProtocol, okHandler, PeerRateLimit(RateLimit{Messages: 0.1, Burst: 20}))
+	for i := 0; i < 2; i++ {
+		if err := callHandler(t, a, b); err != nil {
+			t.Fatalf("stream %d: %s", i, err)
+		}
+	}
+	if err := callHandler(t, a, b); err == nil {
+		t.Fatal("stream over the rate limit accepted")
+	}
+	// Each peer has its own limit.
+	if err := callHandler(t, c, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerRateLimiterSweep(t *testing.T) {
+	rl := newPeerRateLimiter(RateLimit{Messages: 1})
+	start := rl.lastSweep
+	a, b := peer.ID("a"), peer.ID("b")
+
+	if !rl.allow(a, start) || rl.allow(a, start) {
+		t.Fatal("expected a single stream to be allowed")
+	}
+	// Idle buckets aren't removed until the sweep interval has passed.
+	rl.allow(b, start.Add(idleBucketTimeout/2))
+	if len(rl.buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(rl.buckets))
+	}
+
+	now := start.Add(idleBucketTimeout + time.Second)
+	rl.allow(b, now)
+	if _, ok := rl.buckets[a]; ok || len(rl.buckets) != 1 {
+		t.Fatal("idle bucket not removed")
+	}
+	if !rl.lastSweep.Equal(now) {
+		t.Fatal("sweep time not updated")
+	}
+}
+
+func TestPeerFilterMiddleware(t *testing.T) {
+	a, b, c := newTestNode(t, nil), newTestNode(t, nil), newTestNode(t, nil)
+	connectNodes(t, a, b)
+	connectNodes(t, c, b)
+
+	b.Handle(testHandlerProtocol, okHandler, AllowPeers(a.Host.ID()))
+	if err := callHandler(t, a, b); err != nil {
+		t.Fatalf("allowed peer rejected: %s", err)
+	}
+	if err := callHandler(t, c, b); err == nil {
+		t.Fatal("peer not in the allow list accepted")
+	}
+
+	b.Handle(testHandlerProtocol, okHandler, DenyPeers(a.Host.ID()))
+	if err := callHandler(t, a, b); err == nil {
+		t.Fatal("denied peer accepted")
+	}
+	if err := callHandler(t, c, b); err != nil {
+		t.Fatalf("peer not in the deny list rejected: %s", err)
+	}
+}
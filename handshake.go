@@ -0,0 +1,370 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gcash/bchd/chaincfg/chainhash"
+	"github.com/gcash/overlaynetwork/framing"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"sync"
+	"time"
+)
+
+// ProtocolHandshake is the protocol ID of the handshake which is run on every
+// new connection. It is not namespaced by network as the handshake is how
+// peers on the wrong network are detected.
+const ProtocolHandshake = protocol.ID("/bitcoincash/handshake/1.0.0")
+
+var (
+	// Version is the software version sent to peers in the handshake.
+	Version = "0.1.0"
+
+	// HandshakeTimeout is the max amount of time the handshake may take. A
+	// peer which connects to us and hasn't completed the handshake within
+	// this time is disconnected. Nodes use the value set when they're
+	// created.
+	HandshakeTimeout = time.Second * 30
+
+	// ErrNoHandshake is returned by PeerInfo if we haven't completed a
+	// handshake with the peer.
+	ErrNoHandshake = errors.New("no handshake with peer")
+
+	// ErrNetworkMismatch is returned when the peer is on a different network.
+	ErrNetworkMismatch = errors.New("peer is on a different network")
+)
+
+// maxHandshakeSize is the max size of a handshake message.
+const maxHandshakeSize = 1 << 16
+
+// handshakePeerstoreKey is the key the handshake results are stored under in
+// the peerstore.
+const handshakePeerstoreKey = "overlay/handshake"
+
+// ChainTip is the best block known to a node.
+type ChainTip struct {
+	Height int32
+	Hash   chainhash.Hash
+}
+
+// HandshakeInfo is what a peer told us about itself in the handshake.
+type HandshakeInfo struct {
+	// Network is the name of the network the peer is on.
+	Network string
+
+	// Version is the peer's software version.
+	Version string
+
+	// Services are the services the peer supports.
+	Services []string
+
+	// Tip is the peer's chain tip. It is nil if the peer did not send one.
+	Tip *ChainTip
+
+	// Time is when the handshake completed.
+	Time time.Time
+}
+
+// HasService returns whether the peer supports the service.
+func (hi *HandshakeInfo) HasService(service string) bool {
+	for _, s := range hi.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeMessage is the handshake message sent over the wire.
+type handshakeMessage struct {
+	Network   string   `json:"network"`
+	Version   string   `json:"version"`
+	Services  []string `json:"services,omitempty"`
+	TipHeight int32    `json:"tipHeight,omitempty"`
+	TipHash   string   `json:"tipHash,omitempty"`
+}
+
+// handshaker runs the handshake on every new connection and disconnects peers
+// which are on a different network or fail to complete the handshake. The
+// peer which dialed the connection opens the handshake stream.
+type handshaker struct {
+	ctx      context.Context
+	host     host.Host
+	network  string
+	services []string
+	tip      func() *ChainTip
+	timeout  time.Duration
+	mtx      sync.RWMutex
+
+	conns   map[peer.ID]*connHandshake
+	connMtx sync.Mutex
+}
+
+// connHandshake tracks the handshake with a connected peer. It is dropped
+// when the connection which started it closes.
+type connHandshake struct {
+	// conn is the connection which started the handshake.
+	conn inet.Conn
+
+	// initiated is set once we opened the handshake stream.
+	initiated bool
+
+	// expected is set if we're waiting for the peer to open it.
+	expected bool
+}
+
+func newHandshaker(ctx context.Context, h host.Host, network string, services []string, tip func() *ChainTip) *handshaker {
+	hs := &handshaker{
+		ctx:      ctx,
+		host:     h,
+		network:  network,
+		services: append([]string(nil), services...),
+		tip:      tip,
+		timeout:  HandshakeTimeout,
+		conns:    make(map[peer.ID]*connHandshake),
+	}
+	h.SetStreamHandler(ProtocolHandshake, hs.handleStream)
+	h.Network().Notify(&inet.NotifyBundle{
+		ConnectedF: func(n inet.Network, c inet.Conn) {
+			hs.connected(c)
+		},
+		DisconnectedF: func(n inet.Network, c inet.Conn) {
+			hs.disconnected(n, c)
+		},
+	})
+	return hs
+}
+
+// connected starts the handshake on a new connection. We only handshake once
+// while we're connected to the peer, but two connections may open at the same
+// time so we can't rely on the first one being the one we dialed.
+func (hs *handshaker) connected(c inet.Conn) {
+	p := c.RemotePeer()
+	hs.connMtx.Lock()
+	state, ok := hs.conns[p]
+	if !ok {
+		state = &connHandshake{conn: c}
+		hs.conns[p] = state
+	}
+	initiate := c.Stat().Direction == inet.DirOutbound && !state.initiated
+	expect := !initiate && !state.initiated && !state.expected
+	if initiate {
+		state.conn = c
+	}
+	state.initiated = state.initiated || initiate
+	state.expected = state.expected || expect
+	hs.connMtx.Unlock()
+
+	if initiate {
+		go hs.initiate(c)
+	} else if expect {
+		hs.expect(p)
+	}
+}
+
+// disconnected drops the handshake state if the connection which started it
+// closed. If we have other connections to the peer, such as a direct
+// connection which replaced a relayed one, the handshake is run again on
+// them.
+func (hs *handshaker) disconnected(n inet.Network, c inet.Conn) {
+	p := c.RemotePeer()
+	hs.connMtx.Lock()
+	state, ok := hs.conns[p]
+	if !ok || state.conn != c {
+		hs.connMtx.Unlock()
+		return
+	}
+	delete(hs.conns, p)
+	hs.connMtx.Unlock()
+
+	for _, conn := range n.ConnsToPeer(p) {
+		hs.connected(conn)
+	}
+}
+
+// initiate runs the handshake with a peer we dialed. The peer is
+// disconnected if the handshake fails, including when it doesn't speak the
+// handshake protocol, unless it failed because the connection closed.
+func (hs *handshaker) initiate(c inet.Conn) {
+	p := c.RemotePeer()
+	err := hs.handshake(hs.ctx, p)
+	if err == nil || hs.ctx.Err() != nil {
+		return
+	}
+	for _, conn := range hs.host.Network().ConnsToPeer(p) {
+		if conn == c {
+			log.Infof("disconnecting %s: handshake failed: %s", p, err)
+			hs.host.Network().ClosePeer(p)
+			return
+		}
+	}
+}
+
+// expect disconnects a peer which dialed us if it hasn't completed the
+// handshake within the HandshakeTimeout.
+func (hs *handshaker) expect(p peer.ID) {
+	start := time.Now()
+	time.AfterFunc(hs.timeout, func() {
+		if hs.ctx.Err() != nil || hs.host.Network().Connectedness(p) != inet.Connected {
+			return
+		}
+		if info, err := hs.peerInfo(p); err == nil && !info.Time.Before(start) {
+			return
+		}
+		log.Infof("disconnecting %s: no handshake within %s", p, hs.timeout)
+		hs.host.Network().ClosePeer(p)
+	})
+}
+
+// handshake opens a handshake stream to the peer, sends our message and
+// reads theirs.
+func (hs *handshaker) handshake(ctx context.Context, p peer.ID) error {
+	ctx, cancel := context.WithTimeout(ctx, hs.timeout)
+	defer cancel()
+
+	stream, err := hs.host.NewStream(ctx, p, ProtocolHandshake)
+	if err != nil {
+		log.Debugf("handshake: failed to open stream to %s: %s", p, err)
+		return err
+	}
+	s := framing.NewStream(stream, maxHandshakeSize)
+	s.SetDeadline(time.Now().Add(hs.timeout))
+
+	if err := hs.writeMessage(s); err != nil {
+		log.Debugf("handshake: failed to send handshake to %s: %s", p, err)
+		s.Reset()
+		return err
+	}
+	s.CloseWrite()
+	if err := hs.readMessage(s, p); err != nil {
+		log.Debugf("handshake: failed handshake with %s: %s", p, err)
+		s.Reset()
+		return err
+	}
+	return s.Close()
+}
+
+// handleStream handles a handshake from the remote peer. The peer is
+// disconnected if the handshake fails.
+func (hs *handshaker) handleStream(stream inet.Stream) {
+	p := stream.Conn().RemotePeer()
+	s := framing.NewStream(stream, maxHandshakeSize)
+	s.SetDeadline(time.Now().Add(hs.timeout))
+
+	if err := hs.readMessage(s, p); err != nil {
+		log.Infof("disconnecting %s: failed handshake: %s", p, err)
+		s.Reset()
+		hs.host.Network().ClosePeer(p)
+		return
+	}
+	if err := hs.writeMessage(s); err != nil {
+		log.Infof("disconnecting %s: failed to send handshake: %s", p, err)
+		s.Reset()
+		hs.host.Network().ClosePeer(p)
+		return
+	}
+	s.Close()
+}
+
+func (hs *handshaker) writeMessage(s *framing.Stream) error {
+	hs.mtx.RLock()
+	msg := handshakeMessage{
+		Network:  hs.network,
+		Version:  Version,
+		Services: append([]string(nil), hs.services...),
+	}
+	hs.mtx.RUnlock()
+	if hs.tip != nil {
+		if tip := hs.tip(); tip != nil {
+			msg.TipHeight = tip.Height
+			msg.TipHash = tip.Hash.String()
+		}
+	}
+	ser, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	return s.WriteFrame(ser)
+}
+
+// readMessage reads the peer's handshake message and stores it in the
+// peerstore. If the peer is on a different network it is disconnected.
+func (hs *handshaker) readMessage(s *framing.Stream, p peer.ID) error {
+	frame, err := s.ReadFrame()
+	if err != nil {
+		return err
+	}
+	defer framing.Put(frame)
+	msg := new(handshakeMessage)
+	if err := json.Unmarshal(frame, msg); err != nil {
+		return err
+	}
+
+	if msg.Network != hs.network {
+		log.Infof("disconnecting %s: peer is on %q, we are on %q", p, msg.Network, hs.network)
+		go hs.host.Network().ClosePeer(p)
+		return ErrNetworkMismatch
+	}
+
+	info := &HandshakeInfo{
+		Network:  msg.Network,
+		Version:  msg.Version,
+		Services: msg.Services,
+		Time:     time.Now(),
+	}
+	if msg.TipHash != "" {
+		hash, err := chainhash.NewHashFromStr(msg.TipHash)
+		if err != nil {
+			return err
+		}
+		info.Tip = &ChainTip{Height: msg.TipHeight, Hash: *hash}
+	}
+	return hs.host.Peerstore().Put(p, handshakePeerstoreKey, info)
+}
+
+// addService adds the service to the services we send in the handshake.
+func (hs *handshaker) addService(service string) {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	for _, s := range hs.services {
+		if s == service {
+			return
+		}
+	}
+	hs.services = append(hs.services, service)
+}
+
+// removeService removes the service from the services we send in the
+// handshake.
+func (hs *handshaker) removeService(service string) {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	for i, s := range hs.services {
+		if s == service {
+			hs.services = append(hs.services[:i], hs.services[i+1:]...)
+			return
+		}
+	}
+}
+
+// peerInfo returns the handshake results for the peer.
+func (hs *handshaker) peerInfo(p peer.ID) (*HandshakeInfo, error) {
+	v, err := hs.host.Peerstore().Get(p, handshakePeerstoreKey)
+	if err != nil {
+		return nil, ErrNoHandshake
+	}
+	info, ok := v.(*HandshakeInfo)
+	if !ok {
+		return nil, ErrNoHandshake
+	}
+	return info, nil
+}
+
+// PeerInfo returns what the peer told us about itself in the handshake. If
+// we haven't completed a handshake with the peer ErrNoHandshake is returned.
+func (n *OverlayNode) PeerInfo(p peer.ID) (*HandshakeInfo, error) {
+	return n.handshaker.peerInfo(p)
+}
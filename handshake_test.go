@@ -0,0 +1,100 @@
+package overlaynetwork
+
+import (
+	"context"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peerstore"
+	"testing"
+	"time"
+)
+
+// newBareHost returns a host which doesn't speak the handshake protocol.
+func newBareHost(t *testing.T) host.Host {
+	h, err := libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func disconnected(a, b host.Host) func() bool {
+	return func() bool {
+		return a.Network().Connectedness(b.ID()) != inet.Connected &&
+			b.Network().Connectedness(a.ID()) != inet.Connected
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	a := newTestNode(t, func(cfg *NodeConfig) { cfg.Services = []string{"swap"} })
+	b := newTestNode(t, nil)
+	connectNodes(t, a, b)
+
+	if !waitFor(t, time.Second*5, func() bool {
+		_, errA := a.PeerInfo(b.Host.ID())
+		_, errB := b.PeerInfo(a.Host.ID())
+		return errA == nil && errB == nil
+	}) {
+		t.Fatal("handshake not completed")
+	}
+	info, err := b.PeerInfo(a.Host.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Network != "testnet3" || !info.HasService("swap") {
+		t.Fatalf("unexpected handshake info %+v", info)
+	}
+	if b.Host.Network().Connectedness(a.Host.ID()) != inet.Connected {
+		t.Fatal("peers on the same network disconnected")
+	}
+}
+
+func TestHandshakeNetworkMismatch(t *testing.T) {
+	testnet := newTestNode(t, nil)
+	mainnet := newTestNode(t, func(cfg *NodeConfig) { cfg.Params = &chaincfg.MainNetParams })
+	connectNodes(t, testnet, mainnet)
+
+	if !waitFor(t, time.Second*5, disconnected(testnet.Host, mainnet.Host)) {
+		t.Fatal("peers on different networks still connected")
+	}
+	if _, err := testnet.PeerInfo(mainnet.Host.ID()); err != ErrNoHandshake {
+		t.Fatalf("expected ErrNoHandshake, got %v", err)
+	}
+}
+
+func TestHandshakeNotSpoken(t *testing.T) {
+	timeout := HandshakeTimeout
+	HandshakeTimeout = time.Millisecond * 500
+	defer func() { HandshakeTimeout = timeout }()
+
+	n := newTestNode(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// A peer we dial which doesn't speak the handshake protocol is
+	// disconnected straight away.
+	dialed := newBareHost(t)
+	if err := n.Host.Connect(ctx, peerstore.PeerInfo{ID: dialed.ID(), Addrs: dialed.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, time.Second*5, disconnected(n.Host, dialed)) {
+		t.Fatal("dialed peer without a handshake still connected")
+	}
+
+	// A peer which dials us and never sends a handshake is disconnected
+	// after the timeout.
+	dialer := newBareHost(t)
+	if err := dialer.Connect(ctx, peerstore.PeerInfo{ID: n.Host.ID(), Addrs: n.Host.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(HandshakeTimeout / 2)
+	if n.Host.Network().Connectedness(dialer.ID()) != inet.Connected {
+		t.Fatal("dialer disconnected before the handshake timeout")
+	}
+	if !waitFor(t, time.Second*5, disconnected(n.Host, dialer)) {
+		t.Fatal("dialer without a handshake still connected")
+	}
+}
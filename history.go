@@ -0,0 +1,667 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-crypto"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// HistoryServeLimit is the max number of messages we will return in
+	// response to a single history request. Responses are also cut short
+	// once they reach HistoryMessageSizeMax, in which case the requester
+	// asks for the next page.
+	HistoryServeLimit = 500
+
+	// HistoryMessageSizeMax is the max size of a history request or response.
+	// It must fit at least one pubsub message, which libp2p limits to 1MB,
+	// once JSON encoded.
+	HistoryMessageSizeMax = int64(1 << 22)
+
+	// historyResponseOverhead is the space we leave in a response for the
+	// fields other than the messages.
+	historyResponseOverhead = 1024
+
+	// HistoryRequestTimeout is the max amount of time we will wait for a peer
+	// to respond to a history request.
+	HistoryRequestTimeout = time.Second * 30
+
+	// HistoryPeerRateLimit is the rate at which each peer may send us
+	// history requests. Each page of a replay is a separate request.
+	HistoryPeerRateLimit = RateLimit{Messages: 2, Burst: 10}
+
+	// ErrHistoryNotEnabled is returned when requesting history for a topic
+	// which the peer is not storing.
+	ErrHistoryNotEnabled = errors.New("history not enabled for topic")
+
+	// historyPrefix is the datastore prefix under which we save messages.
+	historyPrefix = datastore.NewKey("/pubsub-history")
+)
+
+// HistoryOpts holds the retention limits for a topic's message history.
+type HistoryOpts struct {
+	// MaxMessages is the max number of messages to keep. Zero means no limit.
+	MaxMessages int
+
+	// MaxAge is the max age of the messages to keep. Zero means no limit.
+	MaxAge time.Duration
+}
+
+// HistoryMessage is a pubsub message saved in the history.
+type HistoryMessage struct {
+	From      []byte    `json:"from"`
+	Data      []byte    `json:"data"`
+	Seqno     []byte    `json:"seqno"`
+	Topics    []string  `json:"topics"`
+	Signature []byte    `json:"signature"`
+	Key       []byte    `json:"key"`
+	Received  time.Time `json:"received"`
+}
+
+// ID returns the pubsub message ID of the message.
+func (m *HistoryMessage) ID() string {
+	return string(m.From) + string(m.Seqno)
+}
+
+// verify checks the author's signature over the message.
+func (m *HistoryMessage) verify() error {
+	from, err := peer.IDFromBytes(m.From)
+	if err != nil {
+		return err
+	}
+	var pk crypto.PubKey
+	if m.Key != nil {
+		pk, err = crypto.UnmarshalPublicKey(m.Key)
+		if err != nil {
+			return err
+		}
+		if !from.MatchesPublicKey(pk) {
+			return errors.New("key does not match author")
+		}
+	} else {
+		pk, err = from.ExtractPublicKey()
+		if err != nil {
+			return err
+		}
+	}
+	ser, err := (&pb.Message{
+		From:     m.From,
+		Data:     m.Data,
+		Seqno:    m.Seqno,
+		TopicIDs: m.Topics,
+	}).Marshal()
+	if err != nil {
+		return err
+	}
+	valid, err := pk.Verify(append([]byte("libp2p-pubsub:"), ser...), m.Signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// historyRequest is sent to a peer to request the messages for a topic
+// received after a time or after a message ID.
+type historyRequest struct {
+	Topic   string    `json:"topic"`
+	Since   time.Time `json:"since"`
+	AfterID []byte    `json:"afterID"`
+}
+
+// historyResponse is the response to a historyRequest. More is set if the
+// response was cut short and there are more messages to request.
+type historyResponse struct {
+	Messages []*HistoryMessage `json:"messages"`
+	More     bool              `json:"more"`
+	Error    string            `json:"error"`
+}
+
+// historyTopic tracks a topic for which we are storing history.
+type historyTopic struct {
+	opts   HistoryOpts
+	sub    *Subscription
+	cancel context.CancelFunc
+}
+
+// messageHistory stores the messages for the topics which have history
+// enabled and serves history requests from other peers.
+type messageHistory struct {
+	ds     datastore.Datastore
+	topics map[string]*historyTopic
+	mtx    sync.Mutex
+
+	// indexes holds the sorted names of the stored message keys of each
+	// topic. It is guarded by indexMtx, which is taken after mtx.
+	indexes  map[string][]string
+	indexMtx sync.Mutex
+}
+
+// pubsubHistoryProtocol returns the protocol ID of the history protocol for
+// the given network name.
+func pubsubHistoryProtocol(network string) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/bitcoincash/%s/pubsub-history/1.0.0", network))
+}
+
+// EnableHistory stores the messages received on the topic and serves them to
+// peers which request them. This subscribes to the topic for as long as
+// history is enabled.
+func (p *Pubsub) EnableHistory(topic string, opts *HistoryOpts) error {
+	p.history.mtx.Lock()
+	defer p.history.mtx.Unlock()
+
+	if _, ok := p.history.topics[topic]; ok {
+		return nil
+	}
+	sub, err := p.Join(p.ctx, topic)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	ht := &historyTopic{sub: sub, cancel: cancel}
+	if opts != nil {
+		ht.opts = *opts
+	}
+	p.history.topics[topic] = ht
+	go p.history.record(ctx, topic, ht)
+	return nil
+}
+
+// DisableHistory stops storing messages for the topic. Messages which were
+// already stored are kept until DeleteHistory is called.
+func (p *Pubsub) DisableHistory(topic string) {
+	p.history.mtx.Lock()
+	defer p.history.mtx.Unlock()
+
+	ht, ok := p.history.topics[topic]
+	if !ok {
+		return
+	}
+	ht.cancel()
+	ht.sub.Cancel()
+	delete(p.history.topics, topic)
+}
+
+// DeleteHistory deletes all the stored messages for the topic.
+func (p *Pubsub) DeleteHistory(topic string) error {
+	p.history.mtx.Lock()
+	defer p.history.mtx.Unlock()
+
+	p.history.indexMtx.Lock()
+	defer p.history.indexMtx.Unlock()
+	delete(p.history.indexes, topic)
+
+	keys, err := p.history.keys(historyTopicKey(topic))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := p.history.ds.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History returns the stored messages for the topic which were received after
+// the since time, or after the message with the given ID if afterID is not
+// empty, in the order they were received.
+func (p *Pubsub) History(topic string, since time.Time, afterID string) ([]*HistoryMessage, error) {
+	return p.history.query(topic, since, afterID, 0)
+}
+
+// ReplayHistory requests the messages for the topic from our topic peers which
+// were received after the since time or after the message with the given ID.
+// The messages are deduplicated, checked against their author's signature
+// and the topic validators, as live messages are, and returned in the order
+// they were received. If we are storing history for
+// the topic, the messages are saved as well.
+func (p *Pubsub) ReplayHistory(ctx context.Context, topic string, since time.Time, afterID string) ([]*HistoryMessage, error) {
+	peers := p.ps.ListPeers(topic)
+	if len(peers) == 0 {
+		return nil, ErrNoTopicPeers
+	}
+	req := &historyRequest{Topic: topic, Since: since, AfterID: []byte(afterID)}
+
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		seen = make(map[string]*HistoryMessage)
+	)
+	for _, pid := range peers {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			msgs, err := p.requestHistory(ctx, pid, req)
+			if err != nil {
+				log.Debugf("pubsub history: request to %s failed: %s", pid, err)
+				return
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			for _, msg := range msgs {
+				id := msg.ID()
+				if _, ok := seen[id]; ok {
+					continue
+				}
+				if err := msg.verify(); err != nil {
+					log.Debugf("pubsub history: dropping message from %s: %s", pid, err)
+					continue
+				}
+				if !p.validateHistory(ctx, pid, topic, msg) {
+					log.Debugf("pubsub history: dropping invalid message from %s", pid)
+					continue
+				}
+				seen[id] = msg
+			}
+		}(pid)
+	}
+	wg.Wait()
+
+	msgs := make([]*HistoryMessage, 0, len(seen))
+	for _, msg := range seen {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Received.Before(msgs[j].Received)
+	})
+
+	p.history.mtx.Lock()
+	ht, ok := p.history.topics[topic]
+	p.history.mtx.Unlock()
+	if ok {
+		for _, msg := range msgs {
+			if err := p.history.store(topic, msg, ht.opts); err != nil {
+				log.Errorf("pubsub history: failed to save message: %s", err)
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// validateHistory runs the validators of the message's topics, as pubsub does
+// for live messages, and checks that the message belongs to the topic. The
+// peer which served the message is penalized if it fails. Our rate limits
+// aren't applied as they limit what peers push to us, not what we request.
+func (p *Pubsub) validateHistory(ctx context.Context, from peer.ID, topic string, hm *HistoryMessage) bool {
+	found := false
+	for _, t := range hm.Topics {
+		if t == topic {
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+	msg := &pubsub.Message{Message: &pb.Message{
+		From:      hm.From,
+		Data:      hm.Data,
+		Seqno:     hm.Seqno,
+		TopicIDs:  hm.Topics,
+		Signature: hm.Signature,
+		Key:       hm.Key,
+	}}
+	for _, t := range hm.Topics {
+		p.mtx.Lock()
+		fn, ok := p.validators[t]
+		p.mtx.Unlock()
+		if ok && !fn(ctx, from, msg) {
+			if p.penalizer != nil {
+				p.penalizer.invalidMessage(from, t)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// requestHistory requests the history from the peer one page at a time until
+// the peer has no more messages.
+func (p *Pubsub) requestHistory(ctx context.Context, pid peer.ID, req *historyRequest) ([]*HistoryMessage, error) {
+	var msgs []*HistoryMessage
+	page := *req
+	for {
+		resp, err := p.requestHistoryPage(ctx, pid, &page)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, resp.Messages...)
+		if !resp.More || len(resp.Messages) == 0 {
+			return msgs, nil
+		}
+		// The time is sent as well in case the peer prunes the last
+		// message before we request the next page.
+		last := resp.Messages[len(resp.Messages)-1]
+		page.AfterID = []byte(last.ID())
+		page.Since = last.Received
+	}
+}
+
+func (p *Pubsub) requestHistoryPage(ctx context.Context, pid peer.ID, req *historyRequest) (*historyResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, HistoryRequestTimeout)
+	defer cancel()
+
+	s, err := p.ht.NewStream(ctx, pid, p.historyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	resp := new(historyResponse)
+	if err := json.NewDecoder(io.LimitReader(s, HistoryMessageSizeMax)).Decode(resp); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// handleHistoryStream serves history requests from other peers. It is
+// registered behind a PeerRateLimit of HistoryPeerRateLimit.
+func (p *Pubsub) handleHistoryStream(s inet.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(HistoryRequestTimeout))
+
+	req := new(historyRequest)
+	if err := json.NewDecoder(io.LimitReader(s, HistoryMessageSizeMax)).Decode(req); err != nil {
+		s.Reset()
+		return
+	}
+
+	resp := new(historyResponse)
+	p.history.mtx.Lock()
+	_, ok := p.history.topics[req.Topic]
+	p.history.mtx.Unlock()
+	if !ok {
+		resp.Error = ErrHistoryNotEnabled.Error()
+	} else {
+		// We query one message more than we serve to tell whether there
+		// are more to request.
+		msgs, err := p.history.query(req.Topic, req.Since, string(req.AfterID), HistoryServeLimit+1)
+		if err != nil {
+			log.Errorf("pubsub history: failed to query %s: %s", req.Topic, err)
+			resp.Error = "internal error"
+		}
+		size := int64(historyResponseOverhead)
+		for i, msg := range msgs {
+			ser, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			size += int64(len(ser)) + 1
+			if i == HistoryServeLimit || (size > HistoryMessageSizeMax && len(resp.Messages) > 0) {
+				resp.More = true
+				break
+			}
+			resp.Messages = append(resp.Messages, msg)
+		}
+	}
+	if err := json.NewEncoder(s).Encode(resp); err != nil {
+		s.Reset()
+	}
+}
+
+// record saves each message received on the subscription and periodically
+// prunes the messages which fall outside of the retention limits.
+func (h *messageHistory) record(ctx context.Context, topic string, ht *historyTopic) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := h.prune(topic, ht.opts); err != nil {
+					log.Errorf("pubsub history: failed to prune %s: %s", topic, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := ht.sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		hm := &HistoryMessage{
+			From:      []byte(msg.GetFrom()),
+			Data:      msg.GetData(),
+			Seqno:     msg.GetSeqno(),
+			Topics:    msg.GetTopicIDs(),
+			Signature: msg.GetSignature(),
+			Key:       msg.GetKey(),
+			Received:  time.Now(),
+		}
+		if err := h.store(topic, hm, ht.opts); err != nil {
+			log.Errorf("pubsub history: failed to save message: %s", err)
+		}
+	}
+}
+
+// store saves the message unless a message with the same ID is already saved.
+// If the topic is over its MaxMessages the oldest messages are pruned.
+func (h *messageHistory) store(topic string, msg *HistoryMessage, opts HistoryOpts) error {
+	h.indexMtx.Lock()
+	defer h.indexMtx.Unlock()
+
+	topicKey := historyTopicKey(topic)
+	idKey := topicKey.ChildString("ids").ChildString(encodeHistoryID(msg.ID()))
+	has, err := h.ds.Has(idKey)
+	if err != nil {
+		return err
+	}
+	if has {
+		return nil
+	}
+	index, err := h.index(topic)
+	if err != nil {
+		return err
+	}
+	ser, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s", msg.Received.UnixNano(), encodeHistoryID(msg.ID()))
+	msgKey := topicKey.ChildString("msgs").ChildString(name)
+	if err := h.ds.Put(msgKey, ser); err != nil {
+		return err
+	}
+	if err := h.ds.Put(idKey, []byte(msgKey.String())); err != nil {
+		return err
+	}
+
+	// Live messages are received in order so this is almost always an
+	// append.
+	i := sort.SearchStrings(index, name)
+	index = append(index, "")
+	copy(index[i+1:], index[i:])
+	index[i] = name
+	h.indexes[topic] = index
+
+	if opts.MaxMessages > 0 && len(index) > opts.MaxMessages {
+		return h.pruneIndex(topic, index, len(index)-opts.MaxMessages, opts.MaxAge)
+	}
+	return nil
+}
+
+// query returns up to limit messages received after the since time or after
+// the message with the given ID. A limit of zero means no limit.
+func (h *messageHistory) query(topic string, since time.Time, afterID string, limit int) ([]*HistoryMessage, error) {
+	h.indexMtx.Lock()
+	defer h.indexMtx.Unlock()
+
+	topicKey := historyTopicKey(topic)
+	if afterID != "" {
+		val, err := h.ds.Get(topicKey.ChildString("ids").ChildString(encodeHistoryID(afterID)))
+		if err == nil {
+			if received, ok := historyKeyTime(datastore.NewKey(string(val)).Name()); ok {
+				since = time.Unix(0, received)
+			}
+		} else if err != datastore.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	index, err := h.index(topic)
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	if !since.IsZero() {
+		after := since.UnixNano()
+		start = sort.Search(len(index), func(i int) bool {
+			received, _ := historyKeyTime(index[i])
+			return received > after
+		})
+	}
+	var msgs []*HistoryMessage
+	for _, name := range index[start:] {
+		ser, err := h.ds.Get(topicKey.ChildString("msgs").ChildString(name))
+		if err != nil {
+			return nil, err
+		}
+		msg := new(HistoryMessage)
+		if err := json.Unmarshal(ser, msg); err != nil || msg.ID() == afterID {
+			continue
+		}
+		msgs = append(msgs, msg)
+		if limit > 0 && len(msgs) >= limit {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+// prune deletes the oldest messages until the topic is within its retention
+// limits.
+func (h *messageHistory) prune(topic string, opts HistoryOpts) error {
+	h.indexMtx.Lock()
+	defer h.indexMtx.Unlock()
+
+	index, err := h.index(topic)
+	if err != nil {
+		return err
+	}
+	excess := 0
+	if opts.MaxMessages > 0 && len(index) > opts.MaxMessages {
+		excess = len(index) - opts.MaxMessages
+	}
+	return h.pruneIndex(topic, index, excess, opts.MaxAge)
+}
+
+// pruneIndex deletes the first excess messages of the index and any messages
+// after them which are older than maxAge. The caller must hold the index
+// lock.
+func (h *messageHistory) pruneIndex(topic string, index []string, excess int, maxAge time.Duration) error {
+	topicKey := historyTopicKey(topic)
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+	n := 0
+	for ; n < len(index); n++ {
+		received, _ := historyKeyTime(index[n])
+		if n >= excess && (maxAge <= 0 || received >= cutoff) {
+			// The index is sorted oldest first so there is nothing left
+			// to prune.
+			break
+		}
+		if err := h.ds.Delete(topicKey.ChildString("msgs").ChildString(index[n])); err != nil {
+			h.indexes[topic] = index[n:]
+			return err
+		}
+		if err := h.ds.Delete(topicKey.ChildString("ids").ChildString(historyKeyID(index[n]))); err != nil {
+			h.indexes[topic] = index[n+1:]
+			return err
+		}
+	}
+	h.indexes[topic] = index[n:]
+	return nil
+}
+
+// index returns the names of the topic's message keys sorted oldest first.
+// The names are loaded from the datastore the first time the topic is used
+// and then kept up to date as messages are stored and pruned, so that we
+// don't have to query every message of the topic each time. The caller must
+// hold the index lock.
+func (h *messageHistory) index(topic string) ([]string, error) {
+	if index, ok := h.indexes[topic]; ok {
+		return index, nil
+	}
+	keys, err := h.keys(historyTopicKey(topic).ChildString("msgs"))
+	if err != nil {
+		return nil, err
+	}
+	index := make([]string, 0, len(keys))
+	for _, key := range keys {
+		index = append(index, key.Name())
+	}
+	sort.Strings(index)
+	h.indexes[topic] = index
+	return index, nil
+}
+
+func (h *messageHistory) keys(prefix datastore.Key) ([]datastore.Key, error) {
+	res, err := h.ds.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]datastore.Key, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, datastore.NewKey(entry.Key))
+	}
+	return keys, nil
+}
+
+func historyTopicKey(topic string) datastore.Key {
+	return historyPrefix.ChildString(rawBase32.EncodeToString([]byte(topic)))
+}
+
+func encodeHistoryID(id string) string {
+	return rawBase32.EncodeToString([]byte(id))
+}
+
+// historyKeyTime returns the time, in nanoseconds, at which the message saved
+// under the key name was received.
+func historyKeyTime(name string) (int64, bool) {
+	if len(name) < 21 {
+		return 0, false
+	}
+	received, err := strconv.ParseInt(name[:20], 10, 64)
+	return received, err == nil
+}
+
+// historyKeyID returns the encoded ID of the message saved under the key name.
+func historyKeyID(name string) string {
+	if len(name) < 21 {
+		return ""
+	}
+	return name[21:]
+}
@@ -0,0 +1,200 @@
+package overlaynetwork
+
+import (
+	"context"
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-pubsub"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHistoryTestNet returns a node storing the history of the topic with the
+// given number of messages published to it, and a peer subscribed to the
+// topic.
+func newHistoryTestNet(t *testing.T, topic string, count int) (*OverlayNode, *OverlayNode) {
+	server := newTestNode(t, func(cfg *NodeConfig) { cfg.PubsubRouter = PubsubRouterFloodSub })
+	client := newTestNode(t, func(cfg *NodeConfig) { cfg.PubsubRouter = PubsubRouterFloodSub })
+	if err := server.PubSub.EnableHistory(topic, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err := server.PubSub.Publish(context.Background(), topic, []byte(fmt.Sprintf("msg-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ok := waitFor(t, time.Second*10, func() bool {
+		msgs, err := server.PubSub.History(topic, time.Time{}, "")
+		return err == nil && len(msgs) == count
+	})
+	if !ok {
+		t.Fatal("messages not saved in the history")
+	}
+
+	sub, err := client.PubSub.Subscribe(context.Background(), topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sub.Cancel)
+	connectNodes(t, client, server)
+	ok = waitFor(t, time.Second*10, func() bool {
+		return len(client.PubSub.ps.ListPeers(topic)) > 0
+	})
+	if !ok {
+		t.Fatal("topic peers not found")
+	}
+	return server, client
+}
+
+func TestReplayHistoryPages(t *testing.T) {
+	// Small responses force the history to be served over several pages.
+	sizeMax := HistoryMessageSizeMax
+	HistoryMessageSizeMax = 2048
+	defer func() { HistoryMessageSizeMax = sizeMax }()
+
+	const count = 20
+	_, client := newHistoryTestNet(t, "history-pages", count)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	msgs, err := client.PubSub.ReplayHistory(ctx, "history-pages", time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != count {
+		t.Fatalf("expected %d messages, got %d", count, len(msgs))
+	}
+	for i, msg := range msgs {
+		if string(msg.Data) != fmt.Sprintf("msg-%d", i) {
+			t.Fatalf("message %d out of order: %s", i, msg.Data)
+		}
+	}
+}
+
+func TestReplayHistoryValidated(t *testing.T) {
+	const topic = "history-validated"
+	server, client := newHistoryTestNet(t, topic, 10)
+
+	// The validator is registered after the messages were published so the
+	// invalid ones only reach the client through the history.
+	err := client.PubSub.RegisterTopicValidator(topic, func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		return !strings.HasSuffix(string(msg.GetData()), "5")
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	msgs, err := client.PubSub.ReplayHistory(ctx, topic, time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 9 {
+		t.Fatalf("expected 9 messages, got %d", len(msgs))
+	}
+	for _, msg := range msgs {
+		if string(msg.Data) == "msg-5" {
+			t.Fatal("invalid message replayed")
+		}
+	}
+	client.misbehavior.mtx.Lock()
+	_, penalized := client.misbehavior.scores[server.Host.ID()]
+	client.misbehavior.mtx.Unlock()
+	if !penalized {
+		t.Fatal("peer which served an invalid message not penalized")
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	newHistory := func() *messageHistory {
+		return &messageHistory{ds: ds, topics: make(map[string]*historyTopic), indexes: make(map[string][]string)}
+	}
+	h := newHistory()
+	opts := HistoryOpts{MaxMessages: 5}
+	start := time.Now().Add(-time.Hour)
+	message := func(i int) *HistoryMessage {
+		return &HistoryMessage{
+			From:     []byte("author"),
+			Data:     []byte(fmt.Sprintf("msg-%d", i)),
+			Seqno:    []byte{byte(i)},
+			Received: start.Add(time.Minute * time.Duration(i)),
+		}
+	}
+	// The messages are stored out of order, as replayed ones may be.
+	for _, i := range []int{0, 1, 2, 3, 4, 5, 6, 7, 9, 8} {
+		if err := h.store("topic", message(i), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(h *messageHistory, since time.Time, afterID string, first, last int) {
+		t.Helper()
+		msgs, err := h.query("topic", since, afterID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != last-first+1 {
+			t.Fatalf("expected %d messages, got %d", last-first+1, len(msgs))
+		}
+		for i, msg := range msgs {
+			if string(msg.Data) != fmt.Sprintf("msg-%d", first+i) {
+				t.Fatalf("expected msg-%d, got %s", first+i, msg.Data)
+			}
+		}
+	}
+	check(h, time.Time{}, "", 5, 9)
+	check(h, message(6).Received, "", 7, 9)
+	check(h, time.Time{}, message(7).ID(), 8, 9)
+
+	// The pruned messages are gone from the datastore, not just the index.
+	keys, err := h.keys(historyTopicKey("topic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got %d", len(keys))
+	}
+
+	// A new history loads the index from the datastore.
+	h = newHistory()
+	check(h, time.Time{}, "", 5, 9)
+	if err := h.prune("topic", HistoryOpts{MaxAge: time.Hour - time.Minute*7 - time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	check(h, time.Time{}, "", 8, 9)
+	if err := h.prune("topic", HistoryOpts{MaxMessages: 1}); err != nil {
+		t.Fatal(err)
+	}
+	check(h, time.Time{}, "", 9, 9)
+	keys, err = h.keys(historyTopicKey("topic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+}
+
+func TestHistoryRequestRateLimited(t *testing.T) {
+	limit := HistoryPeerRateLimit
+	HistoryPeerRateLimit = RateLimit{Messages: 0.1, Burst: 20}
+	defer func() { HistoryPeerRateLimit = limit }()
+
+	const topic = "history-limited"
+	server, client := newHistoryTestNet(t, topic, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	req := &historyRequest{Topic: topic}
+	for i := 0; i < 2; i++ {
+		if _, err := client.PubSub.requestHistoryPage(ctx, server.Host.ID(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.PubSub.requestHistoryPage(ctx, server.Host.ID(), req); err == nil {
+		t.Fatal("request over the rate limit served")
+	}
+}
@@ -0,0 +1,408 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gcash/overlaynetwork/framing"
+	"github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-peerstore"
+	"github.com/libp2p/go-libp2p-protocol"
+	"github.com/libp2p/go-libp2p-swarm"
+	"github.com/libp2p/go-reuseport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"net"
+	"sync"
+	"time"
+)
+
+// ProtocolHolePunch is the protocol ID used to upgrade relayed connections to
+// direct connections.
+const ProtocolHolePunch = protocol.ID("/bitcoincash/holepunch/1.0.0")
+
+var (
+	// HolePunchTimeout is the max amount of time an attempt to upgrade a
+	// relayed connection may take.
+	HolePunchTimeout = time.Second * 30
+
+	// HolePunchBackoff is how long we wait after trying to upgrade the
+	// relayed connections to a peer before we try again.
+	HolePunchBackoff = time.Minute * 10
+
+	// holePunchSYNTimeout is how long the dial which opens the hole in our
+	// NAT is given. It only needs to get the SYN out.
+	holePunchSYNTimeout = time.Millisecond * 100
+)
+
+const (
+	maxHolePunchSize  = 4096
+	maxHolePunchAddrs = 16
+
+	// holePunchRetries is the number of times we start the upgrade over if
+	// the relayed connection we ran it on closed.
+	holePunchRetries = 3
+
+	holePunchConnect = "connect"
+	holePunchSync    = "sync"
+)
+
+type holePunchMessage struct {
+	Type  string   `json:"type"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// holePuncher upgrades relayed connections to direct connections. The peer
+// which received the relayed connection, usually the one behind a NAT, runs
+// the upgrade:
+//
+//  1. It sends its direct addresses over the relayed connection and the
+//     other peer replies with its own.
+//  2. It opens a hole in its NAT by dialing the other peer's public
+//     addresses from its listen port. The dial is abandoned once the SYN is
+//     out, the other peer's NAT is expected to drop it.
+//  3. It tells the other peer to dial it, which gets through the hole.
+//
+// The swarm hands back the connection it already has when we dial a peer, so
+// the dialing peer closes the relayed connection before it dials directly and
+// dials through the relay again if the direct dial fails.
+type holePuncher struct {
+	ctx       context.Context
+	host      host.Host
+	attempts  map[peer.ID]time.Time
+	lastSweep time.Time
+	mtx       sync.Mutex
+}
+
+func newHolePuncher(ctx context.Context, h host.Host) *holePuncher {
+	hp := &holePuncher{
+		ctx:       ctx,
+		host:      h,
+		attempts:  make(map[peer.ID]time.Time),
+		lastSweep: time.Now(),
+	}
+	h.SetStreamHandler(ProtocolHolePunch, hp.handleStream)
+	h.Network().Notify(&inet.NotifyBundle{
+		ConnectedF: func(n inet.Network, c inet.Conn) {
+			if c.Stat().Direction == inet.DirInbound && isRelayedAddr(c.RemoteMultiaddr()) {
+				go hp.upgrade(c.RemotePeer())
+			}
+		},
+	})
+	return hp
+}
+
+// upgrade tries to replace the relayed connection the peer opened to us with
+// a direct connection.
+func (hp *holePuncher) upgrade(p peer.ID) {
+	if hp.direct(p) || !hp.attempt(p) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(hp.ctx, HolePunchTimeout)
+	defer cancel()
+
+	// Dialing a peer's relayed addresses can open a relayed connection
+	// through each relay, and the ones which lost the race are closed
+	// again. If we ran the upgrade on one of those we start over.
+	var err error
+	for i := 0; i < holePunchRetries; i++ {
+		if err = hp.initiate(ctx, p); err == nil || !hp.relayed(p) || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Debugf("holepunch: failed to upgrade connection to %s: %s", p, err)
+		return
+	}
+
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	for !hp.direct(p) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Debugf("holepunch: %s didn't connect directly", p)
+			return
+		}
+	}
+	log.Debugf("holepunch: upgraded connection to %s", p)
+}
+
+// initiate exchanges addresses with the peer, opens the hole in our NAT and
+// tells the peer to dial us.
+func (hp *holePuncher) initiate(ctx context.Context, p peer.ID) error {
+	stream, err := hp.host.NewStream(ctx, p, ProtocolHolePunch)
+	if err != nil {
+		return err
+	}
+	s := framing.NewStream(stream, maxHolePunchSize)
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	if err := writeHolePunchMessage(s, holePunchConnect, hp.directAddrs()); err != nil {
+		s.Reset()
+		return err
+	}
+	msg, err := readHolePunchMessage(s)
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	if msg.Type != holePunchConnect {
+		s.Reset()
+		return errors.New("unexpected hole punch message " + msg.Type)
+	}
+
+	hp.punch(parseHolePunchAddrs(msg.Addrs))
+	if err := writeHolePunchMessage(s, holePunchSync, nil); err != nil {
+		s.Reset()
+		return err
+	}
+	// The peer closes the relayed connection once it has the sync.
+	s.Close()
+	return nil
+}
+
+// handleStream handles an upgrade started by the peer. Once it tells us to
+// dial, we replace the relayed connection with a direct one.
+func (hp *holePuncher) handleStream(stream inet.Stream) {
+	p := stream.Conn().RemotePeer()
+	if hp.direct(p) {
+		stream.Reset()
+		return
+	}
+	s := framing.NewStream(stream, maxHolePunchSize)
+	s.SetDeadline(time.Now().Add(HolePunchTimeout))
+
+	msg, err := readHolePunchMessage(s)
+	if err != nil || msg.Type != holePunchConnect {
+		log.Debugf("holepunch: bad connect from %s: %v", p, err)
+		s.Reset()
+		return
+	}
+	addrs := parseHolePunchAddrs(msg.Addrs)
+	if err := writeHolePunchMessage(s, holePunchConnect, hp.directAddrs()); err != nil {
+		s.Reset()
+		return
+	}
+	msg, err = readHolePunchMessage(s)
+	if err != nil || msg.Type != holePunchSync {
+		log.Debugf("holepunch: bad sync from %s: %v", p, err)
+		s.Reset()
+		return
+	}
+	s.Close()
+
+	if len(addrs) == 0 {
+		log.Debugf("holepunch: %s sent no addresses to dial", p)
+		return
+	}
+	// Dropping the relayed connection is disruptive so a peer only gets
+	// us to do it once per HolePunchBackoff.
+	if !hp.attempt(p) {
+		log.Debugf("holepunch: ignoring repeated upgrade from %s", p)
+		return
+	}
+	if err := hp.dialDirect(p, addrs); err != nil {
+		log.Debugf("holepunch: failed to dial %s directly: %s", p, err)
+		return
+	}
+	log.Debugf("holepunch: upgraded connection to %s", p)
+}
+
+// dialDirect replaces our relayed connections to the peer with a direct
+// connection to one of the addresses. The relayed addresses are held back
+// from the peerstore while we dial so the swarm doesn't pick them. If the
+// direct dial fails we connect through the relay again.
+func (hp *holePuncher) dialDirect(p peer.ID, addrs []ma.Multiaddr) error {
+	ps := hp.host.Peerstore()
+	var relayed []ma.Multiaddr
+	for _, addr := range ps.Addrs(p) {
+		if isRelayedAddr(addr) {
+			relayed = append(relayed, addr)
+		}
+	}
+	ps.SetAddrs(p, relayed, 0)
+	ps.AddAddrs(p, addrs, peerstore.TempAddrTTL)
+	defer ps.AddAddrs(p, relayed, peerstore.RecentlyConnectedAddrTTL)
+
+	for _, c := range hp.host.Network().ConnsToPeer(p) {
+		if isRelayedAddr(c.RemoteMultiaddr()) {
+			c.Close()
+		}
+	}
+	hp.clearBackoff(p)
+
+	ctx, cancel := context.WithTimeout(hp.ctx, HolePunchTimeout)
+	defer cancel()
+	err := hp.host.Connect(ctx, peerstore.PeerInfo{ID: p})
+	if err == nil || len(relayed) == 0 {
+		return err
+	}
+
+	hp.clearBackoff(p)
+	if rerr := hp.host.Connect(ctx, peerstore.PeerInfo{ID: p, Addrs: relayed}); rerr != nil {
+		log.Debugf("holepunch: failed to reconnect to %s through the relay: %s", p, rerr)
+	}
+	return err
+}
+
+// punch opens a hole in our NAT for each of the peer's public TCP addresses by
+// dialing it from our listen port.
+func (hp *holePuncher) punch(addrs []ma.Multiaddr) {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		if !manet.IsPublicAddr(addr) {
+			continue
+		}
+		network, raddr, err := manet.DialArgs(addr)
+		if err != nil {
+			continue
+		}
+		laddr := hp.listenAddr(network)
+		if laddr == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(network, raddr string) {
+			defer wg.Done()
+			d := net.Dialer{
+				LocalAddr: laddr,
+				Control:   reuseport.Control,
+				Timeout:   holePunchSYNTimeout,
+			}
+			if conn, err := d.Dial(network, raddr); err == nil {
+				conn.Close()
+			}
+		}(network, raddr)
+	}
+	wg.Wait()
+}
+
+// listenAddr returns the TCP address we listen on for the network.
+func (hp *holePuncher) listenAddr(network string) *net.TCPAddr {
+	for _, addr := range hp.host.Network().ListenAddresses() {
+		n, host, err := manet.DialArgs(addr)
+		if err != nil || n != network {
+			continue
+		}
+		laddr, err := net.ResolveTCPAddr(network, host)
+		if err == nil {
+			return laddr
+		}
+	}
+	return nil
+}
+
+// directAddrs returns the addresses the peer can dial us on directly.
+func (hp *holePuncher) directAddrs() []string {
+	var addrs []string
+	for _, addr := range hp.host.Addrs() {
+		if len(addrs) == maxHolePunchAddrs {
+			break
+		}
+		if !isRelayedAddr(addr) {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	return addrs
+}
+
+// relayed returns whether we have a relayed connection to the peer.
+func (hp *holePuncher) relayed(p peer.ID) bool {
+	for _, c := range hp.host.Network().ConnsToPeer(p) {
+		if isRelayedAddr(c.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// direct returns whether we have a direct connection to the peer.
+func (hp *holePuncher) direct(p peer.ID) bool {
+	for _, c := range hp.host.Network().ConnsToPeer(p) {
+		if !isRelayedAddr(c.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// attempt records an upgrade attempt with the peer. It returns false if we
+// already tried within the HolePunchBackoff.
+func (hp *holePuncher) attempt(p peer.ID) bool {
+	hp.mtx.Lock()
+	defer hp.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(hp.lastSweep) >= HolePunchBackoff {
+		for id, last := range hp.attempts {
+			if now.Sub(last) >= HolePunchBackoff {
+				delete(hp.attempts, id)
+			}
+		}
+		hp.lastSweep = now
+	}
+	if last, ok := hp.attempts[p]; ok && now.Sub(last) < HolePunchBackoff {
+		return false
+	}
+	hp.attempts[p] = now
+	return true
+}
+
+// clearBackoff lets us dial the peer again straight away after a failed
+// dial.
+func (hp *holePuncher) clearBackoff(p peer.ID) {
+	if sw, ok := hp.host.Network().(*swarm.Swarm); ok {
+		sw.Backoff().Clear(p)
+	}
+}
+
+func writeHolePunchMessage(s *framing.Stream, typ string, addrs []string) error {
+	ser, err := json.Marshal(&holePunchMessage{Type: typ, Addrs: addrs})
+	if err != nil {
+		return err
+	}
+	return s.WriteFrame(ser)
+}
+
+func readHolePunchMessage(s *framing.Stream) (*holePunchMessage, error) {
+	frame, err := s.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	defer framing.Put(frame)
+	msg := new(holePunchMessage)
+	if err := json.Unmarshal(frame, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseHolePunchAddrs returns the direct TCP addresses in addrs.
+func parseHolePunchAddrs(addrs []string) []ma.Multiaddr {
+	var out []ma.Multiaddr
+	for _, s := range addrs {
+		if len(out) == maxHolePunchAddrs {
+			break
+		}
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil || isRelayedAddr(addr) {
+			continue
+		}
+		if network, _, err := manet.DialArgs(addr); err != nil || (network != "tcp4" && network != "tcp6") {
+			continue
+		}
+		out = append(out, addr)
+	}
+	return out
+}
+
+// isRelayedAddr returns whether the address goes through a relay.
+func isRelayedAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(relay.P_CIRCUIT)
+	return err == nil
+}
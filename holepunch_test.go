@@ -0,0 +1,146 @@
+package overlaynetwork
+
+import (
+	"context"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// newRelayedNode returns a node with hole punching enabled which holds a
+// reservation with the relay, and its relayed addresses.
+func newRelayedNode(t *testing.T, relayNode *OverlayNode) (*OverlayNode, []ma.Multiaddr) {
+	t.Helper()
+	n := newTestNode(t, func(cfg *NodeConfig) {
+		cfg.AutoRelay = true
+		cfg.HolePunching = true
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	connectNodes(t, n, relayNode)
+	if !n.relays.reserve(ctx, relayNode.Host.ID()) {
+		t.Fatal("reservation with relay failed")
+	}
+	var relayed []ma.Multiaddr
+	for _, addr := range n.Host.Addrs() {
+		if isRelayedAddr(addr) {
+			relayed = append(relayed, addr)
+		}
+	}
+	if len(relayed) == 0 {
+		t.Fatal("no relayed addresses advertised")
+	}
+	return n, relayed
+}
+
+// connTypes returns whether a has relayed and direct connections to b.
+func connTypes(a, b *OverlayNode) (relayed, direct bool) {
+	for _, c := range a.Host.Network().ConnsToPeer(b.Host.ID()) {
+		if isRelayedAddr(c.RemoteMultiaddr()) {
+			relayed = true
+		} else {
+			direct = true
+		}
+	}
+	return relayed, direct
+}
+
+func TestHolePunchUpgradesRelayedConnection(t *testing.T) {
+	// Our test nodes only listen on private addresses.
+	allowed := relayAddrAllowed
+	relayAddrAllowed = func(ma.Multiaddr) bool { return true }
+	defer func() { relayAddrAllowed = allowed }()
+
+	relayNode := newTestNode(t, func(cfg *NodeConfig) { cfg.RelayService = &RelayConfig{} })
+	private, relayed := newRelayedNode(t, relayNode)
+	dialer := newTestNode(t, func(cfg *NodeConfig) { cfg.HolePunching = true })
+
+	const echoProtocol = "/overlay/test/echo"
+	private.Host.SetStreamHandler(echoProtocol, func(s inet.Stream) {
+		defer s.Close()
+		io.Copy(s, s)
+	})
+
+	// The dialer only knows the relayed addresses. Once connected through
+	// the relay the private node asks it to dial directly.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := dialer.Host.Connect(ctx, peerstore.PeerInfo{ID: private.Host.ID(), Addrs: relayed}); err != nil {
+		t.Fatalf("failed to dial through relay: %s", err)
+	}
+	if !waitFor(t, time.Second*10, func() bool {
+		relayed, direct := connTypes(dialer, private)
+		return direct && !relayed
+	}) {
+		t.Fatal("relayed connection not upgraded")
+	}
+	if _, direct := connTypes(private, dialer); !direct {
+		t.Fatal("private node has no direct connection")
+	}
+
+	// The direct connection is usable and the handshake ran on it.
+	s, err := dialer.Host.NewStream(ctx, private.Host.ID(), echoProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	resp, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "ping" {
+		t.Fatalf("expected ping, got %q", resp)
+	}
+	if !waitFor(t, time.Second*5, func() bool {
+		_, err := private.PeerInfo(dialer.Host.ID())
+		return err == nil
+	}) {
+		t.Fatal("no handshake over the direct connection")
+	}
+	time.Sleep(time.Millisecond * 500)
+	if _, direct := connTypes(dialer, private); !direct {
+		t.Fatal("direct connection closed after the handshake")
+	}
+}
+
+func TestHolePunchNotSupported(t *testing.T) {
+	allowed := relayAddrAllowed
+	relayAddrAllowed = func(ma.Multiaddr) bool { return true }
+	defer func() { relayAddrAllowed = allowed }()
+
+	relayNode := newTestNode(t, func(cfg *NodeConfig) { cfg.RelayService = &RelayConfig{} })
+	private, relayed := newRelayedNode(t, relayNode)
+	dialer := newTestNode(t, nil)
+
+	// Without hole punching on the dialer the connection stays relayed.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := dialer.Host.Connect(ctx, peerstore.PeerInfo{ID: private.Host.ID(), Addrs: relayed}); err != nil {
+		t.Fatalf("failed to dial through relay: %s", err)
+	}
+	time.Sleep(time.Second)
+	relayedConn, direct := connTypes(dialer, private)
+	if !relayedConn || direct {
+		t.Fatalf("expected only a relayed connection, got relayed %v direct %v", relayedConn, direct)
+	}
+}
+
+func TestParseHolePunchAddrs(t *testing.T) {
+	addrs := parseHolePunchAddrs([]string{
+		"/ip4/1.2.3.4/tcp/4001",
+		"/ip6/::1/tcp/4001",
+		"/ip4/1.2.3.4/udp/4001",
+		"/ip4/1.2.3.4/tcp/4001/p2p-circuit",
+		"garbage",
+	})
+	if len(addrs) != 2 || addrs[0].String() != "/ip4/1.2.3.4/tcp/4001" || addrs[1].String() != "/ip6/::1/tcp/4001" {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+}
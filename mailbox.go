@@ -0,0 +1,689 @@
+package overlaynetwork
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg/chainhash"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// MailboxReplication is the number of peers closest to the mailbox key
+	// which a message is deposited with.
+	MailboxReplication = 5
+
+	// MailboxPollInterval is how often a mailbox subscription polls the
+	// mailbox nodes for new messages.
+	MailboxPollInterval = time.Minute * 5
+
+	// ErrMailboxFull is returned by a mailbox node when the mailbox or the
+	// node's storage is full.
+	ErrMailboxFull = errors.New("mailbox full")
+
+	// ErrMailboxSenderQuota is returned by a mailbox node when the sender
+	// already has as many messages stored with it as it allows.
+	ErrMailboxSenderQuota = errors.New("mailbox sender quota exceeded")
+
+	// ErrMailboxMessageTooLarge is returned when depositing a message which is
+	// larger than the mailbox node accepts.
+	ErrMailboxMessageTooLarge = errors.New("mailbox message too large")
+
+	// ErrNoMailboxNodes is returned when no mailbox node could be reached.
+	ErrNoMailboxNodes = errors.New("no mailbox nodes reachable")
+
+	// ErrInvalidMailboxAck is returned by a mailbox node when an ack isn't
+	// signed by the mailbox's key or contains an invalid message ID.
+	ErrInvalidMailboxAck = errors.New("invalid mailbox ack")
+
+	mailboxPrefix = datastore.NewKey("/mailbox")
+)
+
+// MailboxConfig holds the limits enforced by this node when it stores
+// messages for other peers' mailboxes.
+type MailboxConfig struct {
+	// Serve stores messages for other peers. If false we only use the
+	// mailbox nodes of the network.
+	Serve bool
+
+	// MaxMessageSize is the max size of an encrypted message.
+	MaxMessageSize int
+
+	// MaxMessagesPerMailbox is the max number of messages stored for a
+	// single mailbox.
+	MaxMessagesPerMailbox int
+
+	// MaxBytesPerMailbox is the max number of bytes stored for a single
+	// mailbox.
+	MaxBytesPerMailbox int
+
+	// MaxTotalBytes is the max number of bytes stored across all mailboxes.
+	MaxTotalBytes int64
+
+	// MaxMessagesPerSender is the max number of messages stored from a
+	// single peer across all mailboxes. Zero means no limit.
+	//
+	// Senders are identified by their peer ID, which costs nothing to
+	// create, so the per sender limits only stop a spammer which doesn't
+	// bother to rotate its ID. The per mailbox and total limits are what
+	// bound the storage used.
+	MaxMessagesPerSender int
+
+	// MaxBytesPerSender is the max number of bytes stored from a single
+	// peer across all mailboxes. Zero means no limit.
+	MaxBytesPerSender int64
+
+	// MaxTTL is the max amount of time a message is kept. Messages are
+	// deleted after their ttl even if they haven't been acknowledged.
+	MaxTTL time.Duration
+}
+
+// DefaultMailboxConfig specifies default sane mailbox limits.
+var DefaultMailboxConfig = MailboxConfig{
+	Serve:                 true,
+	MaxMessageSize:        1 << 16,
+	MaxMessagesPerMailbox: 100,
+	MaxBytesPerMailbox:    1 << 20,
+	MaxTotalBytes:         1 << 26,
+	MaxMessagesPerSender:  200,
+	MaxBytesPerSender:     1 << 22,
+	MaxTTL:                time.Hour * 24 * 7,
+}
+
+// mailboxProtocol returns the protocol ID of the mailbox RPC service for the
+// given network name.
+func mailboxProtocol(network string) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/bitcoincash/%s/mailbox/1.0.0", network))
+}
+
+// MailboxID returns the ID of the mailbox for the public key. It is the hex
+// encoded sha256 hash of the compressed key.
+func MailboxID(pub *bchec.PublicKey) string {
+	h := sha256.Sum256(pub.SerializeCompressed())
+	return hex.EncodeToString(h[:])
+}
+
+// MailboxMessage is a decrypted message fetched from our mailbox.
+type MailboxMessage struct {
+	// ID is the ID used to acknowledge the message.
+	ID string
+
+	// Payload is the decrypted message.
+	Payload []byte
+
+	// Received is when the mailbox node received the message.
+	Received time.Time
+}
+
+// mailboxRecord is a message stored by a mailbox node. The sender is the peer
+// which deposited the message. It is only used to enforce the per sender
+// limits and isn't returned to the recipient.
+type mailboxRecord struct {
+	ID         string    `json:"id"`
+	Ciphertext []byte    `json:"ciphertext"`
+	Received   time.Time `json:"received"`
+	Expires    time.Time `json:"expires"`
+	Sender     string    `json:"sender,omitempty"`
+}
+
+// mailboxUsage is the storage used by the messages from one sender.
+type mailboxUsage struct {
+	messages int
+	bytes    int64
+}
+
+type mailboxDepositRequest struct {
+	Mailbox    string `json:"mailbox"`
+	Ciphertext []byte `json:"ciphertext"`
+	TTL        int64  `json:"ttl"`
+}
+
+type mailboxDepositResponse struct {
+	ID string `json:"id"`
+}
+
+type mailboxFetchRequest struct {
+	Mailbox string `json:"mailbox"`
+}
+
+type mailboxFetchResponse struct {
+	Messages []*mailboxRecord `json:"messages"`
+}
+
+type mailboxAckRequest struct {
+	Mailbox   string   `json:"mailbox"`
+	IDs       []string `json:"ids"`
+	Signature []byte   `json:"signature"`
+}
+
+// Mailbox is a store-and-forward mailbox for peers which are offline. Messages
+// are encrypted to the recipient's public key and deposited with the
+// MailboxReplication peers closest to the mailbox ID in the DHT. The recipient
+// fetches them later and acknowledges them so the mailbox nodes can delete
+// them.
+type Mailbox struct {
+	n       *OverlayNode
+	client  *RPCClient
+	cfg     MailboxConfig
+	used    int64
+	senders map[string]*mailboxUsage
+	mtx     sync.Mutex
+}
+
+func newMailbox(n *OverlayNode, cfg MailboxConfig) (*Mailbox, error) {
+	pid := mailboxProtocol(networkName(n.Params))
+	m := &Mailbox{
+		n:       n,
+		client:  n.RPCClient(pid, nil),
+		cfg:     cfg,
+		senders: make(map[string]*mailboxUsage),
+	}
+	if !cfg.Serve {
+		return m, nil
+	}
+	entries, err := m.entries(mailboxPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		m.add(entry.Value)
+	}
+	n.RegisterService(pid, map[string]RPCHandler{
+		"deposit": m.handleDeposit,
+		"fetch":   m.handleFetch,
+		"ack":     m.handleAck,
+	}, nil)
+	return m, nil
+}
+
+// Send encrypts the payload to the recipient's key and deposits it in the
+// recipient's mailbox. A ttl of zero uses the mailbox nodes' max ttl. It
+// succeeds if at least one mailbox node stored the message.
+func (m *Mailbox) Send(ctx context.Context, recipient *bchec.PublicKey, payload []byte, ttl time.Duration) error {
+	ciphertext, err := bchec.Encrypt(recipient, payload)
+	if err != nil {
+		return err
+	}
+	mailbox := MailboxID(recipient)
+	peers, err := m.closestPeers(ctx, mailbox)
+	if err != nil {
+		return err
+	}
+
+	req := &mailboxDepositRequest{
+		Mailbox:    mailbox,
+		Ciphertext: ciphertext,
+		TTL:        int64(ttl / time.Second),
+	}
+	var (
+		wg     sync.WaitGroup
+		mtx    sync.Mutex
+		stored int
+		id     string
+	)
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			resp := new(mailboxDepositResponse)
+			if err := m.client.Call(ctx, p, "deposit", req, resp); err != nil {
+				log.Debugf("mailbox: failed to deposit with %s: %s", p, err)
+				return
+			}
+			mtx.Lock()
+			stored++
+			id = resp.ID
+			mtx.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	if stored == 0 {
+		return ErrNoMailboxNodes
+	}
+
+	// Let the recipient know there is mail if it is online.
+	if err := m.n.PubSub.Publish(ctx, mailboxTopic(mailbox), []byte(id)); err != nil {
+		log.Debugf("mailbox: failed to notify %s: %s", mailbox, err)
+	}
+	return nil
+}
+
+// Fetch returns the messages in the mailbox of the key. Messages stay in the
+// mailbox until they are acknowledged with Ack or expire.
+func (m *Mailbox) Fetch(ctx context.Context, key *bchec.PrivateKey) ([]*MailboxMessage, error) {
+	mailbox := MailboxID(key.PubKey())
+	peers, err := m.closestPeers(ctx, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		reached int
+		records = make(map[string]*mailboxRecord)
+	)
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			resp := new(mailboxFetchResponse)
+			if err := m.client.Call(ctx, p, "fetch", &mailboxFetchRequest{Mailbox: mailbox}, resp); err != nil {
+				log.Debugf("mailbox: failed to fetch from %s: %s", p, err)
+				return
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			reached++
+			for _, rec := range resp.Messages {
+				if _, ok := records[rec.ID]; !ok && rec.ID == mailboxMessageID(rec.Ciphertext) {
+					records[rec.ID] = rec
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	if reached == 0 {
+		return nil, ErrNoMailboxNodes
+	}
+
+	var msgs []*MailboxMessage
+	for _, rec := range records {
+		payload, err := bchec.Decrypt(key, rec.Ciphertext)
+		if err != nil {
+			log.Debugf("mailbox: failed to decrypt message %s: %s", rec.ID, err)
+			continue
+		}
+		msgs = append(msgs, &MailboxMessage{
+			ID:       rec.ID,
+			Payload:  payload,
+			Received: rec.Received,
+		})
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Received.Before(msgs[j].Received)
+	})
+	return msgs, nil
+}
+
+// Ack tells the mailbox nodes that we have the messages so they can delete
+// them. The ack is signed with the mailbox's key.
+func (m *Mailbox) Ack(ctx context.Context, key *bchec.PrivateKey, ids []string) error {
+	mailbox := MailboxID(key.PubKey())
+	sig, err := bchec.SignCompact(bchec.S256(), key, mailboxAckHash(mailbox, ids), true)
+	if err != nil {
+		return err
+	}
+	peers, err := m.closestPeers(ctx, mailbox)
+	if err != nil {
+		return err
+	}
+	req := &mailboxAckRequest{
+		Mailbox:   mailbox,
+		IDs:       ids,
+		Signature: sig,
+	}
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			if err := m.client.Call(ctx, p, "ack", req, &struct{}{}); err != nil {
+				log.Debugf("mailbox: failed to ack with %s: %s", p, err)
+			}
+		}(p)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Subscribe returns a channel on which new messages in the mailbox of the key
+// are delivered. We fetch whenever a sender notifies us over pubsub and poll
+// every MailboxPollInterval in case we missed a notification. Each message is
+// delivered once per subscription and should be acknowledged with Ack. The
+// channel is closed when the context is cancelled.
+//
+// The notification topic isn't advertised in the DHT as that would link our
+// peer ID to the mailbox, so notifications only reach us from senders we are
+// connected to.
+func (m *Mailbox) Subscribe(ctx context.Context, key *bchec.PrivateKey) (<-chan *MailboxMessage, error) {
+	sub, err := m.n.PubSub.subscribe(ctx, mailboxTopic(MailboxID(key.PubKey())), false)
+	if err != nil {
+		return nil, err
+	}
+	notify := make(chan struct{}, 1)
+	go func() {
+		for {
+			if _, err := sub.Next(ctx); err != nil {
+				return
+			}
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	out := make(chan *MailboxMessage)
+	go func() {
+		defer close(out)
+		defer sub.Cancel()
+		ticker := time.NewTicker(MailboxPollInterval)
+		defer ticker.Stop()
+
+		seen := make(map[string]struct{})
+		for {
+			msgs, err := m.Fetch(ctx, key)
+			if err != nil {
+				log.Debugf("mailbox: failed to fetch: %s", err)
+			}
+			for _, msg := range msgs {
+				if _, ok := seen[msg.ID]; ok {
+					continue
+				}
+				seen[msg.ID] = struct{}{}
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// closestPeers returns the peers closest to the mailbox in the DHT.
+func (m *Mailbox) closestPeers(ctx context.Context, mailbox string) ([]peer.ID, error) {
+	kad, ok := m.n.Routing.(*dht.IpfsDHT)
+	if !ok {
+		return nil, errors.New("mailbox requires the kademlia dht")
+	}
+	ch, err := kad.GetClosestPeers(ctx, "/mailbox/"+mailbox)
+	if err != nil {
+		return nil, err
+	}
+	var peers []peer.ID
+	for p := range ch {
+		if len(peers) < MailboxReplication {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, ErrNoMailboxNodes
+	}
+	return peers, nil
+}
+
+func (m *Mailbox) handleDeposit(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error) {
+	req := new(mailboxDepositRequest)
+	if err := decode(req); err != nil {
+		return nil, err
+	}
+	if !validMailboxID(req.Mailbox) {
+		return nil, errors.New("invalid mailbox")
+	}
+	if len(req.Ciphertext) > m.cfg.MaxMessageSize {
+		return nil, ErrMailboxMessageTooLarge
+	}
+	ttl := time.Duration(req.TTL) * time.Second
+	if ttl <= 0 || ttl > m.cfg.MaxTTL {
+		ttl = m.cfg.MaxTTL
+	}
+	now := time.Now()
+	rec := &mailboxRecord{
+		ID:         mailboxMessageID(req.Ciphertext),
+		Ciphertext: req.Ciphertext,
+		Received:   now,
+		Expires:    now.Add(ttl),
+		Sender:     from.Pretty(),
+	}
+	ser, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key := mailboxPrefix.ChildString(req.Mailbox).ChildString(rec.ID)
+	if has, err := m.n.Datastore.Has(key); err != nil {
+		return nil, err
+	} else if has {
+		return &mailboxDepositResponse{ID: rec.ID}, nil
+	}
+	entries, err := m.entries(mailboxPrefix.ChildString(req.Mailbox))
+	if err != nil {
+		return nil, err
+	}
+	size := len(ser)
+	for _, entry := range entries {
+		size += len(entry.Value)
+	}
+	if len(entries) >= m.cfg.MaxMessagesPerMailbox || size > m.cfg.MaxBytesPerMailbox ||
+		m.used+int64(len(ser)) > m.cfg.MaxTotalBytes {
+		return nil, ErrMailboxFull
+	}
+	var usage mailboxUsage
+	if u, ok := m.senders[rec.Sender]; ok {
+		usage = *u
+	}
+	if (m.cfg.MaxMessagesPerSender > 0 && usage.messages >= m.cfg.MaxMessagesPerSender) ||
+		(m.cfg.MaxBytesPerSender > 0 && usage.bytes+int64(len(ser)) > m.cfg.MaxBytesPerSender) {
+		return nil, ErrMailboxSenderQuota
+	}
+	if err := m.n.Datastore.Put(key, ser); err != nil {
+		return nil, err
+	}
+	m.add(ser)
+	log.Debugf("mailbox: stored message %s for %s from %s", rec.ID, req.Mailbox, from)
+	return &mailboxDepositResponse{ID: rec.ID}, nil
+}
+
+func (m *Mailbox) handleFetch(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error) {
+	req := new(mailboxFetchRequest)
+	if err := decode(req); err != nil {
+		return nil, err
+	}
+	if !validMailboxID(req.Mailbox) {
+		return nil, errors.New("invalid mailbox")
+	}
+	entries, err := m.entries(mailboxPrefix.ChildString(req.Mailbox))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(mailboxFetchResponse)
+	now := time.Now()
+	for _, entry := range entries {
+		rec := new(mailboxRecord)
+		if err := json.Unmarshal(entry.Value, rec); err != nil || now.After(rec.Expires) {
+			continue
+		}
+		rec.Sender = ""
+		resp.Messages = append(resp.Messages, rec)
+	}
+	return resp, nil
+}
+
+func (m *Mailbox) handleAck(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error) {
+	req := new(mailboxAckRequest)
+	if err := decode(req); err != nil {
+		return nil, err
+	}
+	if !validMailboxID(req.Mailbox) {
+		return nil, errors.New("invalid mailbox")
+	}
+	// The IDs end up in datastore keys so anything but a message ID could
+	// point outside the mailbox.
+	for _, id := range req.IDs {
+		if !validMailboxID(id) {
+			return nil, ErrInvalidMailboxAck
+		}
+	}
+	pub, _, err := bchec.RecoverCompact(bchec.S256(), req.Signature, mailboxAckHash(req.Mailbox, req.IDs))
+	if err != nil || MailboxID(pub) != req.Mailbox {
+		return nil, ErrInvalidMailboxAck
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	mailboxKey := mailboxPrefix.ChildString(req.Mailbox)
+	for _, id := range req.IDs {
+		key := mailboxKey.ChildString(id)
+		if !key.Parent().Equal(mailboxKey) {
+			return nil, ErrInvalidMailboxAck
+		}
+		val, err := m.n.Datastore.Get(key)
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := m.n.Datastore.Delete(key); err != nil {
+			return nil, err
+		}
+		m.remove(val)
+	}
+	return struct{}{}, nil
+}
+
+// run deletes expired messages every hour until the context is cancelled.
+func (m *Mailbox) run(ctx context.Context) {
+	if !m.cfg.Serve {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.deleteExpired(); err != nil {
+				log.Errorf("mailbox: failed to delete expired messages: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Mailbox) deleteExpired() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	entries, err := m.entries(mailboxPrefix)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		rec := new(mailboxRecord)
+		if err := json.Unmarshal(entry.Value, rec); err == nil && now.Before(rec.Expires) {
+			continue
+		}
+		if err := m.n.Datastore.Delete(datastore.NewKey(entry.Key)); err != nil {
+			return err
+		}
+		m.remove(entry.Value)
+	}
+	return nil
+}
+
+// add accounts for a stored message. The caller must hold the lock unless the
+// mailbox is still being created.
+func (m *Mailbox) add(value []byte) {
+	m.used += int64(len(value))
+	rec := new(mailboxRecord)
+	if err := json.Unmarshal(value, rec); err != nil || rec.Sender == "" {
+		return
+	}
+	usage, ok := m.senders[rec.Sender]
+	if !ok {
+		usage = new(mailboxUsage)
+		m.senders[rec.Sender] = usage
+	}
+	usage.messages++
+	usage.bytes += int64(len(value))
+}
+
+// remove accounts for a deleted message. The caller must hold the lock.
+func (m *Mailbox) remove(value []byte) {
+	m.used -= int64(len(value))
+	rec := new(mailboxRecord)
+	if err := json.Unmarshal(value, rec); err != nil || rec.Sender == "" {
+		return
+	}
+	usage, ok := m.senders[rec.Sender]
+	if !ok {
+		return
+	}
+	usage.messages--
+	usage.bytes -= int64(len(value))
+	if usage.messages <= 0 {
+		delete(m.senders, rec.Sender)
+	}
+}
+
+// entries returns the stored messages under the prefix. The prefix is matched
+// as a string so keys which aren't /mailbox/<mailbox>/<id> are skipped.
+func (m *Mailbox) entries(prefix datastore.Key) ([]query.Entry, error) {
+	res, err := m.n.Datastore.Query(query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	all, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	entries := all[:0]
+	for _, entry := range all {
+		if isMailboxKey(datastore.NewKey(entry.Key)) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// mailboxTopic returns the pubsub topic on which senders notify the recipient
+// of new mail.
+func mailboxTopic(mailbox string) string {
+	return "mailbox:" + mailbox
+}
+
+func mailboxMessageID(ciphertext []byte) string {
+	h := sha256.Sum256(ciphertext)
+	return hex.EncodeToString(h[:])
+}
+
+func mailboxAckHash(mailbox string, ids []string) []byte {
+	return chainhash.DoubleHashB([]byte("overlay-mailbox-ack:" + mailbox + ":" + strings.Join(ids, ",")))
+}
+
+// validMailboxID returns whether the mailbox is a hex encoded sha256 hash.
+// Message IDs are checked with it too as they have the same format.
+func validMailboxID(mailbox string) bool {
+	b, err := hex.DecodeString(mailbox)
+	return err == nil && len(b) == sha256.Size
+}
+
+// isMailboxKey returns whether the key is a stored message's key.
+func isMailboxKey(key datastore.Key) bool {
+	ns := key.Namespaces()
+	return len(ns) == 3 && ns[0] == mailboxPrefix.Name() &&
+		validMailboxID(ns[1]) && validMailboxID(ns[2])
+}
@@ -0,0 +1,280 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gcash/bchd/bchec"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p-peer"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mailboxCall calls the mailbox handler with the request as if it came from
+// the peer.
+func mailboxCall(handler RPCHandler, from peer.ID, req interface{}) (interface{}, error) {
+	ser, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.Background(), from, func(v interface{}) error {
+		return json.Unmarshal(ser, v)
+	})
+}
+
+func TestMailboxSubscribeNotAdvertised(t *testing.T) {
+	n := newTestNode(t, nil)
+	key := newTestKey(t)
+	topic := mailboxTopic(MailboxID(key.PubKey()))
+	advertised := func() bool {
+		n.PubSub.mtx.Lock()
+		defer n.PubSub.mtx.Unlock()
+		ts, ok := n.PubSub.topics[topic]
+		if !ok {
+			t.Fatal("not subscribed to the mailbox topic")
+		}
+		return ts.cancel != nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := n.Mailbox.Subscribe(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if advertised() {
+		t.Fatal("mailbox topic advertised")
+	}
+
+	// Explicitly subscribing to the topic still advertises it.
+	sub, err := n.PubSub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+	if !advertised() {
+		t.Fatal("topic not advertised")
+	}
+}
+
+func TestMailboxSenderQuota(t *testing.T) {
+	n := newTestNode(t, func(cfg *NodeConfig) {
+		mailboxCfg := DefaultMailboxConfig
+		mailboxCfg.MaxMessagesPerSender = 2
+		cfg.Mailbox = &mailboxCfg
+	})
+	m := n.Mailbox
+	key := newTestKey(t)
+	mailbox := MailboxID(key.PubKey())
+	spammer, other := peer.ID("spammer"), peer.ID("other")
+
+	deposit := func(from peer.ID, msg string) (string, error) {
+		resp, err := mailboxCall(m.handleDeposit, from, &mailboxDepositRequest{
+			Mailbox:    mailbox,
+			Ciphertext: []byte(msg),
+		})
+		if err != nil {
+			return "", err
+		}
+		return resp.(*mailboxDepositResponse).ID, nil
+	}
+	first, err := deposit(spammer, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deposit(spammer, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deposit(spammer, "3"); err != ErrMailboxSenderQuota {
+		t.Fatalf("expected ErrMailboxSenderQuota, got %v", err)
+	}
+	if _, err := deposit(other, "4"); err != nil {
+		t.Fatalf("quota of one sender applied to another: %s", err)
+	}
+
+	// The quota is rebuilt from the stored messages on restart.
+	restarted, err := newMailbox(n, m.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mailboxCall(restarted.handleDeposit, spammer, &mailboxDepositRequest{
+		Mailbox:    mailbox,
+		Ciphertext: []byte("5"),
+	}); err != ErrMailboxSenderQuota {
+		t.Fatalf("expected ErrMailboxSenderQuota after restart, got %v", err)
+	}
+
+	// Acknowledged messages no longer count against the sender.
+	ids := []string{first}
+	sig, err := bchec.SignCompact(bchec.S256(), key, mailboxAckHash(mailbox, ids), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mailboxCall(m.handleAck, other, &mailboxAckRequest{Mailbox: mailbox, IDs: ids, Signature: sig}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deposit(spammer, "6"); err != nil {
+		t.Fatalf("deposit after ack failed: %s", err)
+	}
+
+	// The sender isn't revealed to the recipient.
+	resp, err := mailboxCall(m.handleFetch, other, &mailboxFetchRequest{Mailbox: mailbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range resp.(*mailboxFetchResponse).Messages {
+		if rec.Sender != "" {
+			t.Fatalf("fetch returned the sender %s", rec.Sender)
+		}
+	}
+}
+
+func TestMailboxAckTraversal(t *testing.T) {
+	n := newTestNode(t, nil)
+	m := n.Mailbox
+	key := newTestKey(t)
+	mailbox := MailboxID(key.PubKey())
+
+	// A key outside the mailboxes which a traversal would reach.
+	target := datastore.NewKey("/secret")
+	if err := n.Datastore.Put(target, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if got := mailboxPrefix.ChildString(mailbox).ChildString("../../secret"); !got.Equal(target) {
+		t.Fatalf("expected the traversal to reach %s, got %s", target, got)
+	}
+
+	for _, id := range []string{"../../secret", "", "ab", strings.Repeat("zz", 32)} {
+		ids := []string{id}
+		sig, err := bchec.SignCompact(bchec.S256(), key, mailboxAckHash(mailbox, ids), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = mailboxCall(m.handleAck, peer.ID("acker"), &mailboxAckRequest{Mailbox: mailbox, IDs: ids, Signature: sig})
+		if err != ErrInvalidMailboxAck {
+			t.Errorf("ack of %q: expected ErrInvalidMailboxAck, got %v", id, err)
+		}
+	}
+	if has, err := n.Datastore.Has(target); err != nil || !has {
+		t.Fatalf("key outside the mailbox deleted: %v", err)
+	}
+	if m.used != 0 {
+		t.Fatalf("expected no storage used, got %d", m.used)
+	}
+}
+
+func TestMailboxDeleteExpired(t *testing.T) {
+	n := newTestNode(t, nil)
+	m := n.Mailbox
+	mailbox := MailboxID(newTestKey(t).PubKey())
+	sender := peer.ID("sender")
+
+	resp, err := mailboxCall(m.handleDeposit, sender, &mailboxDepositRequest{
+		Mailbox:    mailbox,
+		Ciphertext: []byte("live"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := resp.(*mailboxDepositResponse).ID
+	used := m.used
+
+	// Store an expired message, an unreadable one and a value which isn't
+	// a message but shares the prefix.
+	put := func(key datastore.Key, value []byte) {
+		if err := n.Datastore.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired, err := json.Marshal(&mailboxRecord{
+		ID:         mailboxMessageID([]byte("expired")),
+		Ciphertext: []byte("expired"),
+		Received:   time.Now().Add(-time.Hour),
+		Expires:    time.Now().Add(-time.Minute),
+		Sender:     sender.Pretty(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredKey := mailboxPrefix.ChildString(mailbox).ChildString(mailboxMessageID([]byte("expired")))
+	corruptKey := mailboxPrefix.ChildString(mailbox).ChildString(mailboxMessageID([]byte("corrupt")))
+	otherKey := datastore.NewKey("/mailboxes/other")
+	put(expiredKey, expired)
+	put(corruptKey, []byte("{"))
+	put(otherKey, []byte("other"))
+	m.mtx.Lock()
+	m.add(expired)
+	m.add([]byte("{"))
+	m.mtx.Unlock()
+
+	if err := m.deleteExpired(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []datastore.Key{expiredKey, corruptKey} {
+		if has, _ := n.Datastore.Has(key); has {
+			t.Errorf("%s not deleted", key)
+		}
+	}
+	if has, _ := n.Datastore.Has(otherKey); !has {
+		t.Error("key outside the mailboxes deleted")
+	}
+	if has, _ := n.Datastore.Has(mailboxPrefix.ChildString(mailbox).ChildString(live)); !has {
+		t.Error("live message deleted")
+	}
+	if m.used != used {
+		t.Fatalf("expected %d bytes used, got %d", used, m.used)
+	}
+	if usage := m.senders[sender.Pretty()]; usage == nil || usage.messages != 1 {
+		t.Fatalf("unexpected sender usage %+v", usage)
+	}
+}
+
+func TestMailboxSendFetchAck(t *testing.T) {
+	sender, server, recipient := newTestNode(t, nil), newTestNode(t, nil), newTestNode(t, nil)
+	connectNodes(t, sender, server)
+	connectNodes(t, recipient, server)
+	if !waitFor(t, time.Second*5, func() bool {
+		return sender.Routing.(*dht.IpfsDHT).RoutingTable().Find(server.Host.ID()) != "" &&
+			recipient.Routing.(*dht.IpfsDHT).RoutingTable().Find(server.Host.ID()) != ""
+	}) {
+		t.Fatal("server not added to the routing tables")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	key := newTestKey(t)
+	if err := sender.Mailbox.Send(ctx, key.PubKey(), []byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := recipient.Mailbox.Fetch(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || string(msgs[0].Payload) != "hello" {
+		t.Fatalf("unexpected messages %v", msgs)
+	}
+
+	// Only the mailbox's key can open the messages.
+	other, err := recipient.Mailbox.Fetch(ctx, newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other) != 0 {
+		t.Fatalf("fetched %d messages from another mailbox", len(other))
+	}
+
+	if err := recipient.Mailbox.Ack(ctx, key, []string{msgs[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err = recipient.Mailbox.Fetch(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("acknowledged message still in the mailbox: %v", msgs)
+	}
+	if server.Mailbox.used != 0 {
+		t.Fatalf("expected no storage used on the server, got %d", server.Mailbox.used)
+	}
+}
@@ -0,0 +1,650 @@
+package overlaynetwork
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gcash/bchd/bchec"
+	"github.com/gcash/bchd/chaincfg/chainhash"
+	"github.com/libp2p/go-libp2p-crypto"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"github.com/libp2p/go-libp2p-record"
+	"sync"
+	"time"
+)
+
+var (
+	// MessageRetries is the number of times we retry direct delivery of a
+	// message before falling back to the recipient's mailbox.
+	MessageRetries = 3
+
+	// MessageRetryBackoff is how long we wait before the first retry. It
+	// doubles with each retry.
+	MessageRetryBackoff = time.Second
+
+	// MessageInboxSize is the number of incoming messages which are buffered
+	// before we stop accepting more.
+	MessageInboxSize = 64
+
+	// ErrNoRecipient is returned when sending a message to a recipient with
+	// neither a peer ID nor a key.
+	ErrNoRecipient = errors.New("recipient has no peer id or key")
+
+	// ErrMessageUndelivered is returned when a message could not be delivered
+	// directly and the recipient has no key we could deposit it in a mailbox
+	// for.
+	ErrMessageUndelivered = errors.New("message could not be delivered")
+
+	// ErrInboxFull is returned by the recipient when its inbox is full.
+	ErrInboxFull = errors.New("inbox full")
+
+	// ErrInvalidWalletRecord is returned when a wallet record is malformed, is
+	// stored under the wrong key or is not signed by its key.
+	ErrInvalidWalletRecord = errors.New("invalid wallet record")
+
+	// ErrNoMessagingKey is returned when publishing a wallet record without a
+	// MessagingKey in the config.
+	ErrNoMessagingKey = errors.New("no messaging key configured")
+
+	// ErrInvalidPeerSignature is returned when a message isn't signed by the
+	// peer it claims to be from.
+	ErrInvalidPeerSignature = errors.New("message not signed by sender peer")
+)
+
+// messageProtocol returns the protocol ID of the direct messaging RPC service
+// for the given network name.
+func messageProtocol(network string) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/bitcoincash/%s/message/1.0.0", network))
+}
+
+// Recipient is who a message is sent to. If Peer is empty it is resolved from
+// Key through the wallet record in the DHT. Key is needed to fall back to the
+// recipient's mailbox when it can't be reached directly.
+type Recipient struct {
+	Peer peer.ID
+	Key  *bchec.PublicKey
+}
+
+// DirectMessage is a message received from another peer.
+type DirectMessage struct {
+	// ID is the unique ID of the message.
+	ID string
+
+	// From is the peer which sent the message. Messages from our mailbox are
+	// only delivered if they are signed by this peer.
+	From peer.ID
+
+	// SenderKey is the sender's key if the message was signed with one. The
+	// signature has been verified.
+	SenderKey *bchec.PublicKey
+
+	// Payload is the message itself.
+	Payload []byte
+
+	// Time is when the sender sent the message.
+	Time time.Time
+
+	// Mailbox is whether the message came through our mailbox rather than
+	// directly from the sender.
+	Mailbox bool
+}
+
+// MessageReceipt is returned when a message is sent.
+type MessageReceipt struct {
+	// ID is the ID of the message.
+	ID string
+
+	// Delivered is true if the recipient acknowledged the message. If false
+	// the message was deposited in the recipient's mailbox.
+	Delivered bool
+
+	// Time is when the message was delivered or deposited.
+	Time time.Time
+}
+
+// messageEnvelope is the message sent over the wire and deposited in
+// mailboxes. The signatures commit to the sender and recipient so that they
+// can't be replayed to another recipient. PeerSignature is made with the
+// identity key of the From peer so that mailbox messages, which don't arrive
+// over a connection to the sender, can be attributed to it. PeerKey is only
+// set if the key can't be extracted from the peer ID. Signature is made with
+// the sender's optional wallet key.
+type messageEnvelope struct {
+	ID            string    `json:"id"`
+	From          string    `json:"from"`
+	To            string    `json:"to"`
+	Payload       []byte    `json:"payload"`
+	Time          time.Time `json:"time"`
+	PeerKey       []byte    `json:"peerKey,omitempty"`
+	PeerSignature []byte    `json:"peerSignature,omitempty"`
+	SenderKey     []byte    `json:"senderKey,omitempty"`
+	Signature     []byte    `json:"signature,omitempty"`
+}
+
+// peerSigHash returns the data the From peer signs.
+func (e *messageEnvelope) peerSigHash() ([]byte, error) {
+	ser, err := json.Marshal(&struct {
+		ID      string    `json:"id"`
+		From    string    `json:"from"`
+		To      string    `json:"to"`
+		Payload []byte    `json:"payload"`
+		Time    time.Time `json:"time"`
+	}{e.ID, e.From, e.To, e.Payload, e.Time})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("overlay-message-peer:"), ser...), nil
+}
+
+// verifyPeer checks that the envelope was signed by the From peer and returns
+// the peer.
+func (e *messageEnvelope) verifyPeer() (peer.ID, error) {
+	from, err := peer.IDB58Decode(e.From)
+	if err != nil {
+		return "", err
+	}
+	if len(e.PeerSignature) == 0 {
+		return "", ErrInvalidPeerSignature
+	}
+	var pk crypto.PubKey
+	if len(e.PeerKey) > 0 {
+		pk, err = crypto.UnmarshalPublicKey(e.PeerKey)
+		if err != nil || !from.MatchesPublicKey(pk) {
+			return "", ErrInvalidPeerSignature
+		}
+	} else {
+		pk, err = from.ExtractPublicKey()
+		if err != nil || pk == nil {
+			return "", ErrInvalidPeerSignature
+		}
+	}
+	data, err := e.peerSigHash()
+	if err != nil {
+		return "", err
+	}
+	if valid, err := pk.Verify(data, e.PeerSignature); err != nil || !valid {
+		return "", ErrInvalidPeerSignature
+	}
+	return from, nil
+}
+
+func (e *messageEnvelope) sigHash() ([]byte, error) {
+	cpy := *e
+	cpy.Signature = nil
+	ser, err := json.Marshal(&cpy)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.DoubleHashB(append([]byte("overlay-message:"), ser...)), nil
+}
+
+// verify checks the signature if the envelope was signed and returns the
+// sender's key.
+func (e *messageEnvelope) verify() (*bchec.PublicKey, error) {
+	if len(e.SenderKey) == 0 {
+		return nil, nil
+	}
+	senderKey, err := bchec.ParsePubKey(e.SenderKey, bchec.S256())
+	if err != nil {
+		return nil, err
+	}
+	hash, err := e.sigHash()
+	if err != nil {
+		return nil, err
+	}
+	pub, _, err := bchec.RecoverCompact(bchec.S256(), e.Signature, hash)
+	if err != nil || !pub.IsEqual(senderKey) {
+		return nil, errors.New("invalid message signature")
+	}
+	return senderKey, nil
+}
+
+// WalletRecord maps a wallet's key to the peer ID of the node it runs on. It
+// is stored in the DHT under WalletRecordKey and signed by the key.
+type WalletRecord struct {
+	// PubKey is the compressed public key of the wallet.
+	PubKey []byte `json:"pubKey"`
+
+	// Peer is the peer ID of the wallet's node.
+	Peer string `json:"peer"`
+
+	// Seq is the sequence number of the record. Higher numbers replace lower.
+	Seq uint64 `json:"seq"`
+
+	// Signature is the key's compact signature over the record.
+	Signature []byte `json:"signature"`
+}
+
+func (wr *WalletRecord) sigHash() ([]byte, error) {
+	cpy := *wr
+	cpy.Signature = nil
+	ser, err := json.Marshal(&cpy)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.DoubleHashB(append([]byte("overlay-wallet-record:"), ser...)), nil
+}
+
+// WalletRecordKey returns the DHT key of the wallet record for the key.
+func WalletRecordKey(pub *bchec.PublicKey) string {
+	return "/wallet/" + MailboxID(pub)
+}
+
+// WalletRecordValidator is the DHT validator for wallet records. It checks
+// that the record is stored under the key for its public key and is signed by
+// it.
+type WalletRecordValidator struct{}
+
+// Validate validates the given record, returning an error if it's
+// invalid (e.g., expired, signed by the wrong key, etc.).
+func (v *WalletRecordValidator) Validate(key string, value []byte) error {
+	ns, _, err := record.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	if ns != "wallet" {
+		return errors.New("namespace not 'wallet'")
+	}
+	wr := new(WalletRecord)
+	if err := json.Unmarshal(value, wr); err != nil {
+		return ErrInvalidWalletRecord
+	}
+	pub, err := bchec.ParsePubKey(wr.PubKey, bchec.S256())
+	if err != nil || key != WalletRecordKey(pub) {
+		return ErrInvalidWalletRecord
+	}
+	if _, err := peer.IDB58Decode(wr.Peer); err != nil {
+		return ErrInvalidWalletRecord
+	}
+	hash, err := wr.sigHash()
+	if err != nil {
+		return err
+	}
+	signer, _, err := bchec.RecoverCompact(bchec.S256(), wr.Signature, hash)
+	if err != nil || !signer.IsEqual(pub) {
+		return ErrInvalidWalletRecord
+	}
+	return nil
+}
+
+// Select selects the best record from the set of records (e.g., the
+// newest).
+//
+// Decisions made by select should be stable.
+func (v *WalletRecordValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestSeq := -1, uint64(0)
+	for i, value := range values {
+		wr := new(WalletRecord)
+		if err := json.Unmarshal(value, wr); err != nil {
+			continue
+		}
+		if best == -1 || wr.Seq > bestSeq {
+			best, bestSeq = i, wr.Seq
+		}
+	}
+	if best == -1 {
+		return 0, ErrInvalidWalletRecord
+	}
+	return best, nil
+}
+
+// messenger sends and receives direct messages.
+type messenger struct {
+	n      *OverlayNode
+	key    *bchec.PrivateKey
+	client *RPCClient
+	inbox  chan *DirectMessage
+	seen   map[string]time.Time
+	mtx    sync.Mutex
+}
+
+func newMessenger(n *OverlayNode, key *bchec.PrivateKey) *messenger {
+	pid := messageProtocol(networkName(n.Params))
+	m := &messenger{
+		n:      n,
+		key:    key,
+		client: n.RPCClient(pid, nil),
+		inbox:  make(chan *DirectMessage, MessageInboxSize),
+		seen:   make(map[string]time.Time),
+	}
+	n.RegisterService(pid, map[string]RPCHandler{
+		"deliver": m.handleDeliver,
+	}, nil)
+	return m
+}
+
+// SendMessage sends the payload to the recipient. If the recipient only has a
+// key we look up its peer ID in the DHT. Direct delivery is retried with
+// backoff and if the recipient still can't be reached the message is
+// deposited in its mailbox, as long as we have its key. If the node has a
+// MessagingKey the message is signed with it.
+func (n *OverlayNode) SendMessage(ctx context.Context, to Recipient, payload []byte) (*MessageReceipt, error) {
+	return n.messenger.send(ctx, to, payload)
+}
+
+// Messages returns the channel on which incoming messages are delivered. This
+// includes messages deposited in our mailbox if the node has a MessagingKey.
+func (n *OverlayNode) Messages() <-chan *DirectMessage {
+	return n.messenger.inbox
+}
+
+// PublishWalletRecord puts a record mapping our MessagingKey to our peer ID
+// in the DHT so that we can be messaged by key. The record is kept alive by
+// the Republisher.
+func (n *OverlayNode) PublishWalletRecord(ctx context.Context) error {
+	key := n.messenger.key
+	if key == nil {
+		return ErrNoMessagingKey
+	}
+	wr := &WalletRecord{
+		PubKey: key.PubKey().SerializeCompressed(),
+		Peer:   n.Host.ID().Pretty(),
+		Seq:    uint64(time.Now().Unix()),
+	}
+	hash, err := wr.sigHash()
+	if err != nil {
+		return err
+	}
+	wr.Signature, err = bchec.SignCompact(bchec.S256(), key, hash, true)
+	if err != nil {
+		return err
+	}
+	ser, err := json.Marshal(wr)
+	if err != nil {
+		return err
+	}
+	return n.Republisher.Publish(ctx, WalletRecordKey(key.PubKey()), ser, 0)
+}
+
+func (m *messenger) send(ctx context.Context, to Recipient, payload []byte) (*MessageReceipt, error) {
+	if to.Peer == "" && to.Key == nil {
+		return nil, ErrNoRecipient
+	}
+	p := to.Peer
+	if p == "" {
+		var err error
+		p, err = m.resolveWallet(ctx, to.Key)
+		if err != nil {
+			log.Debugf("messaging: failed to resolve wallet %s: %s", MailboxID(to.Key), err)
+		}
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	env := &messageEnvelope{
+		ID:      hex.EncodeToString(idBytes),
+		From:    m.n.Host.ID().Pretty(),
+		Payload: payload,
+		Time:    time.Now(),
+	}
+	if p != "" {
+		env.To = p.Pretty()
+	} else {
+		env.To = MailboxID(to.Key)
+	}
+	if err := m.sign(env); err != nil {
+		return nil, err
+	}
+
+	if p != "" {
+		err := m.deliver(ctx, p, env)
+		if err == nil {
+			return &MessageReceipt{ID: env.ID, Delivered: true, Time: time.Now()}, nil
+		}
+		log.Debugf("messaging: failed to deliver %s to %s: %s", env.ID, p, err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	if to.Key == nil {
+		return nil, ErrMessageUndelivered
+	}
+	// The envelope in the mailbox is addressed to the mailbox so it is
+	// re-signed.
+	env.To = MailboxID(to.Key)
+	if err := m.sign(env); err != nil {
+		return nil, err
+	}
+	ser, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.n.Mailbox.Send(ctx, to.Key, ser, 0); err != nil {
+		return nil, err
+	}
+	return &MessageReceipt{ID: env.ID, Time: time.Now()}, nil
+}
+
+// deliver sends the envelope directly to the peer, retrying with backoff.
+func (m *messenger) deliver(ctx context.Context, p peer.ID, env *messageEnvelope) error {
+	backoff := MessageRetryBackoff
+	var err error
+	for attempt := 0; attempt <= MessageRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+		if err = m.connect(ctx, p); err != nil {
+			continue
+		}
+		if err = m.client.Call(ctx, p, "deliver", env, &struct{}{}); err == nil {
+			return nil
+		}
+		if rpcErr, ok := err.(*RPCError); ok && rpcErr.Message != ErrInboxFull.Error() {
+			// The recipient rejected the message so retrying won't help.
+			return err
+		}
+	}
+	return err
+}
+
+// connect makes sure we're connected to the peer, looking up its addresses in
+// the DHT if we don't have any.
+func (m *messenger) connect(ctx context.Context, p peer.ID) error {
+	if m.n.Host.Network().Connectedness(p) == inet.Connected {
+		return nil
+	}
+	pi := m.n.Host.Peerstore().PeerInfo(p)
+	if len(pi.Addrs) == 0 {
+		var err error
+		pi, err = m.n.Routing.FindPeer(ctx, p)
+		if err != nil {
+			return err
+		}
+	}
+	return m.n.Host.Connect(ctx, pi)
+}
+
+// resolveWallet looks up the peer ID of the wallet's node in the DHT.
+func (m *messenger) resolveWallet(ctx context.Context, pub *bchec.PublicKey) (peer.ID, error) {
+	value, err := m.n.Routing.GetValue(ctx, WalletRecordKey(pub))
+	if err != nil {
+		return "", err
+	}
+	wr := new(WalletRecord)
+	if err := json.Unmarshal(value, wr); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(wr.PubKey, pub.SerializeCompressed()) {
+		return "", ErrInvalidWalletRecord
+	}
+	return peer.IDB58Decode(wr.Peer)
+}
+
+// sign signs the envelope with our identity key and, if we have one, our
+// wallet key.
+func (m *messenger) sign(env *messageEnvelope) error {
+	data, err := env.peerSigHash()
+	if err != nil {
+		return err
+	}
+	env.PeerSignature, err = m.n.PrivateKey.Sign(data)
+	if err != nil {
+		return err
+	}
+	env.PeerKey = nil
+	if _, err := m.n.Host.ID().ExtractPublicKey(); err != nil {
+		env.PeerKey, err = m.n.PrivateKey.GetPublic().Bytes()
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.key == nil {
+		return nil
+	}
+	env.SenderKey = m.key.PubKey().SerializeCompressed()
+	env.Signature = nil
+	hash, err := env.sigHash()
+	if err != nil {
+		return err
+	}
+	env.Signature, err = bchec.SignCompact(bchec.S256(), m.key, hash, true)
+	return err
+}
+
+func (m *messenger) handleDeliver(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error) {
+	env := new(messageEnvelope)
+	if err := decode(env); err != nil {
+		return nil, err
+	}
+	if env.From != from.Pretty() || env.To != m.n.Host.ID().Pretty() {
+		return nil, errors.New("message not from sender or not addressed to us")
+	}
+	if err := m.accept(ctx, env, from, false); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// accept verifies the envelope and delivers it to the inbox unless we have
+// already seen it. Messages sent to us directly are rejected with
+// ErrInboxFull if the inbox is full so the sender can retry. Messages from
+// our mailbox wait for room in the inbox.
+func (m *messenger) accept(ctx context.Context, env *messageEnvelope, from peer.ID, mailbox bool) error {
+	senderKey, err := env.verify()
+	if err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	if _, ok := m.seen[env.ID]; ok {
+		m.mtx.Unlock()
+		return nil
+	}
+	m.seen[env.ID] = time.Now()
+	m.mtx.Unlock()
+
+	msg := &DirectMessage{
+		ID:        env.ID,
+		From:      from,
+		SenderKey: senderKey,
+		Payload:   env.Payload,
+		Time:      env.Time,
+		Mailbox:   mailbox,
+	}
+	if mailbox {
+		select {
+		case m.inbox <- msg:
+			return nil
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	} else {
+		select {
+		case m.inbox <- msg:
+			return nil
+		default:
+			err = ErrInboxFull
+		}
+	}
+	m.mtx.Lock()
+	delete(m.seen, env.ID)
+	m.mtx.Unlock()
+	return err
+}
+
+// run receives the messages deposited in our mailbox and prunes the IDs of
+// seen messages until the context is cancelled.
+func (m *messenger) run(ctx context.Context) {
+	var mail <-chan *MailboxMessage
+	if m.key != nil {
+		var err error
+		mail, err = m.n.Mailbox.Subscribe(ctx, m.key)
+		if err != nil {
+			log.Errorf("messaging: failed to subscribe to mailbox: %s", err)
+		}
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-mail:
+			if !ok {
+				mail = nil
+				continue
+			}
+			m.acceptMail(ctx, msg)
+		case <-ticker.C:
+			m.pruneSeen(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pruneSeen forgets the IDs of messages seen longer ago than a message can be
+// kept in a mailbox, after which it can't be redelivered.
+func (m *messenger) pruneSeen(now time.Time) {
+	ttl := m.n.Mailbox.cfg.MaxTTL
+	if ttl <= 0 {
+		ttl = DefaultMailboxConfig.MaxTTL
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for id, t := range m.seen {
+		if now.Sub(t) > ttl {
+			delete(m.seen, id)
+		}
+	}
+}
+
+// acceptMail delivers a message from our mailbox to the inbox and acks it.
+// Anyone can deposit a message in our mailbox so messages which aren't signed
+// by the peer they claim to be from are dropped.
+func (m *messenger) acceptMail(ctx context.Context, msg *MailboxMessage) {
+	env := new(messageEnvelope)
+	if err := json.Unmarshal(msg.Payload, env); err != nil {
+		log.Debugf("messaging: malformed mailbox message %s: %s", msg.ID, err)
+	} else {
+		from, err := env.verifyPeer()
+		if err != nil {
+			log.Debugf("messaging: mailbox message %s has an invalid sender: %s", msg.ID, err)
+		} else if env.To != MailboxID(m.key.PubKey()) {
+			log.Debugf("messaging: mailbox message %s not addressed to us", msg.ID)
+		} else if err := m.accept(ctx, env, from, true); err != nil {
+			log.Debugf("messaging: rejected mailbox message %s: %s", msg.ID, err)
+			if ctx.Err() != nil {
+				// We're shutting down so leave it in the mailbox.
+				return
+			}
+		}
+	}
+	if err := m.n.Mailbox.Ack(ctx, m.key, []string{msg.ID}); err != nil {
+		log.Debugf("messaging: failed to ack mailbox message %s: %s", msg.ID, err)
+	}
+}
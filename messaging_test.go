@@ -0,0 +1,126 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/libp2p/go-libp2p-crypto"
+	"testing"
+	"time"
+)
+
+func TestMailboxMessageSenderVerified(t *testing.T) {
+	key := newTestKey(t)
+	recipient := newTestNode(t, func(cfg *NodeConfig) { cfg.MessagingKey = key })
+	sender := newTestNode(t, nil)
+	other := newTestNode(t, nil)
+
+	// RSA peer IDs don't contain the key so it is sent with the message.
+	rsaKey, _, err := crypto.GenerateKeyPair(crypto.RSA, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSender := newTestNode(t, func(cfg *NodeConfig) { cfg.PrivateKey = rsaKey })
+
+	envelope := func(n *OverlayNode) *messageEnvelope {
+		env := &messageEnvelope{
+			ID:      "id-" + n.Host.ID().Pretty(),
+			From:    n.Host.ID().Pretty(),
+			To:      MailboxID(key.PubKey()),
+			Payload: []byte("hello"),
+			Time:    time.Now(),
+		}
+		if err := n.messenger.sign(env); err != nil {
+			t.Fatal(err)
+		}
+		return env
+	}
+	forged := envelope(sender)
+	forged.From = other.Host.ID().Pretty()
+	unsigned := envelope(sender)
+	unsigned.ID = "unsigned"
+	unsigned.PeerSignature = nil
+	tampered := envelope(sender)
+	tampered.Payload = []byte("goodbye")
+	wrongKey := envelope(rsaSender)
+	wrongKey.PeerKey, _ = other.PrivateKey.GetPublic().Bytes()
+
+	tests := []struct {
+		name     string
+		env      *messageEnvelope
+		accepted bool
+	}{
+		{"valid", envelope(sender), true},
+		{"valid rsa", envelope(rsaSender), true},
+		{"forged sender", forged, false},
+		{"unsigned", unsigned, false},
+		{"tampered", tampered, false},
+		{"wrong peer key", wrongKey, false},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	for _, test := range tests {
+		ser, err := json.Marshal(test.env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipient.messenger.acceptMail(ctx, &MailboxMessage{ID: test.name, Payload: ser})
+		select {
+		case msg := <-recipient.Messages():
+			if !test.accepted {
+				t.Errorf("%s: message accepted", test.name)
+			} else if msg.From.Pretty() != test.env.From || !msg.Mailbox {
+				t.Errorf("%s: unexpected message %+v", test.name, msg)
+			}
+		default:
+			if test.accepted {
+				t.Errorf("%s: message rejected", test.name)
+			}
+		}
+	}
+}
+
+func TestMessagingSeenPrunedAfterMailboxTTL(t *testing.T) {
+	n := newTestNode(t, func(cfg *NodeConfig) {
+		mailboxCfg := DefaultMailboxConfig
+		mailboxCfg.MaxTTL = time.Hour
+		cfg.Mailbox = &mailboxCfg
+	})
+	m := n.messenger
+	now := time.Now()
+	m.mtx.Lock()
+	m.seen["old"] = now.Add(-time.Hour * 2)
+	m.seen["recent"] = now.Add(-time.Minute * 30)
+	m.mtx.Unlock()
+
+	m.pruneSeen(now)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.seen["old"]; ok {
+		t.Error("message older than the mailbox ttl not pruned")
+	}
+	if _, ok := m.seen["recent"]; !ok {
+		t.Error("recent message pruned")
+	}
+}
+
+func TestSendMessageSigned(t *testing.T) {
+	sender, recipient := newTestNode(t, nil), newTestNode(t, nil)
+	connectNodes(t, sender, recipient)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	receipt, err := sender.SendMessage(ctx, Recipient{Peer: recipient.Host.ID()}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !receipt.Delivered {
+		t.Fatal("message not delivered directly")
+	}
+	select {
+	case msg := <-recipient.Messages():
+		if msg.From != sender.Host.ID() || string(msg.Payload) != "hello" {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("message not received")
+	}
+}
@@ -0,0 +1,175 @@
+package overlaynetwork
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// BanThreshold is the ban score at which a peer is banned.
+	BanThreshold = 100.0
+
+	// BanDuration is how long a peer stays banned.
+	BanDuration = time.Hour * 24
+
+	// BanScoreHalfLife is the time it takes for a peer's ban score to decay
+	// to half its value.
+	BanScoreHalfLife = time.Minute * 10
+)
+
+// banScore is a ban score which decays exponentially over time.
+type banScore struct {
+	value float64
+	last  time.Time
+}
+
+func (b *banScore) add(now time.Time, score float64) float64 {
+	b.value = b.decayed(now) + score
+	b.last = now
+	return b.value
+}
+
+func (b *banScore) decayed(now time.Time) float64 {
+	elapsed := now.Sub(b.last)
+	return b.value * math.Pow(0.5, float64(elapsed)/float64(BanScoreHalfLife))
+}
+
+// misbehaviorTracker keeps track of the ban scores of our peers. When a peer's
+// score crosses the BanThreshold it is disconnected and any new connections
+// from it are closed until the ban expires.
+type misbehaviorTracker struct {
+	host   host.Host
+	scores map[peer.ID]*banScore
+	banned map[peer.ID]time.Time
+	mtx    sync.Mutex
+}
+
+func newMisbehaviorTracker(h host.Host) *misbehaviorTracker {
+	m := &misbehaviorTracker{
+		host:   h,
+		scores: make(map[peer.ID]*banScore),
+		banned: make(map[peer.ID]time.Time),
+	}
+	h.Network().Notify(&inet.NotifyBundle{
+		ConnectedF: func(n inet.Network, c inet.Conn) {
+			if m.isBanned(c.RemotePeer()) {
+				log.Debugf("closing connection from banned peer %s", c.RemotePeer())
+				go c.Close()
+			}
+		},
+	})
+	return m
+}
+
+// report adds to the peer's ban score and bans the peer if the score crosses
+// the threshold.
+func (m *misbehaviorTracker) report(p peer.ID, score float64, reason string) {
+	m.mtx.Lock()
+	now := time.Now()
+	bs, ok := m.scores[p]
+	if !ok {
+		bs = &banScore{last: now}
+		m.scores[p] = bs
+	}
+	total := bs.add(now, score)
+	log.Debugf("misbehavior from %s (%s): ban score now %.1f", p, reason, total)
+	ban := total >= BanThreshold
+	if ban {
+		m.banned[p] = now.Add(BanDuration)
+		delete(m.scores, p)
+	}
+	m.mtx.Unlock()
+
+	if ban {
+		log.Infof("banning peer %s for %s: %s", p, BanDuration, reason)
+		m.host.Network().ClosePeer(p)
+	}
+}
+
+func (m *misbehaviorTracker) isBanned(p peer.ID) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	until, ok := m.banned[p]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(m.banned, p)
+		return false
+	}
+	return true
+}
+
+func (m *misbehaviorTracker) unban(p peer.ID) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.banned, p)
+}
+
+// prune removes expired bans and scores which have decayed to nothing.
+func (m *misbehaviorTracker) prune() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now()
+	for p, until := range m.banned {
+		if now.After(until) {
+			delete(m.banned, p)
+		}
+	}
+	for p, bs := range m.scores {
+		if bs.decayed(now) < 1 {
+			delete(m.scores, p)
+		}
+	}
+}
+
+// run prunes the tracker every hour until the context is cancelled.
+func (m *misbehaviorTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.prune()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// misbehaviorBlacklist is the pubsub blacklist backed by the misbehavior
+// tracker. The router ignores banned peers and drops messages authored by
+// them even when they are relayed by other peers.
+type misbehaviorBlacklist struct {
+	m *misbehaviorTracker
+}
+
+func (b misbehaviorBlacklist) Add(p peer.ID) {
+	b.m.report(p, BanThreshold, "blacklisted by pubsub")
+}
+
+func (b misbehaviorBlacklist) Contains(p peer.ID) bool {
+	return b.m.isBanned(p)
+}
+
+// ReportMisbehavior adds the score to the peer's ban score. If the peer's
+// score reaches the BanThreshold the peer is disconnected and banned for the
+// BanDuration.
+func (n *OverlayNode) ReportMisbehavior(p peer.ID, score float64, reason string) {
+	n.misbehavior.report(p, score, reason)
+}
+
+// IsBanned returns whether the peer is currently banned.
+func (n *OverlayNode) IsBanned(p peer.ID) bool {
+	return n.misbehavior.isBanned(p)
+}
+
+// Unban lifts the ban on the peer.
+func (n *OverlayNode) Unban(p peer.ID) {
+	n.misbehavior.unban(p)
+}
@@ -0,0 +1,104 @@
+package overlaynetwork
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-autonat"
+	autonatsvc "github.com/libp2p/go-libp2p-autonat-svc"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"sync"
+)
+
+// Reachability is whether the node can be dialed from the public internet.
+type Reachability int
+
+const (
+	// ReachabilityUnknown means we don't know yet whether we're reachable.
+	ReachabilityUnknown Reachability = iota
+
+	// ReachabilityPublic means other peers can dial us.
+	ReachabilityPublic
+
+	// ReachabilityPrivate means we're behind a NAT or firewall which other
+	// peers can't dial through.
+	ReachabilityPrivate
+)
+
+// String returns the name of the reachability state.
+func (r Reachability) String() string {
+	switch r {
+	case ReachabilityPublic:
+		return "public"
+	case ReachabilityPrivate:
+		return "private"
+	}
+	return "unknown"
+}
+
+// natManager tracks our reachability. With AutoNAT enabled we ask our peers to
+// dial us back, otherwise we guess from our listen and observed addresses.
+type natManager struct {
+	n       *OverlayNode
+	enabled bool
+	service bool
+	autoNAT autonat.AutoNAT
+	mtx     sync.Mutex
+}
+
+func newNATManager(n *OverlayNode, enableAutoNAT, enableService bool) *natManager {
+	return &natManager{
+		n:       n,
+		enabled: enableAutoNAT,
+		service: enableService,
+	}
+}
+
+// start starts AutoNAT and the AutoNAT service if they are enabled. AutoNAT
+// needs peers to dial us back so it's started with the online services.
+func (nm *natManager) start(ctx context.Context) {
+	if nm.service {
+		if _, err := autonatsvc.NewAutoNATService(ctx, nm.n.Host); err != nil {
+			log.Errorf("failed to start autonat service: %s", err)
+		}
+	}
+	if nm.enabled {
+		nm.mtx.Lock()
+		nm.autoNAT = autonat.NewAutoNAT(ctx, nm.n.Host, nil)
+		nm.mtx.Unlock()
+	}
+}
+
+func (nm *natManager) reachability() Reachability {
+	nm.mtx.Lock()
+	an := nm.autoNAT
+	nm.mtx.Unlock()
+
+	if an != nil {
+		switch an.Status() {
+		case autonat.NATStatusPublic:
+			return ReachabilityPublic
+		case autonat.NATStatusPrivate:
+			return ReachabilityPrivate
+		}
+		return ReachabilityUnknown
+	}
+
+	// Without AutoNAT we consider the node reachable if it's listening on,
+	// or has been observed by its peers on, a public address. Relayed
+	// addresses don't count.
+	for _, addr := range nm.n.Host.Addrs() {
+		if isRelayedAddr(addr) {
+			continue
+		}
+		if manet.IsPublicAddr(addr) {
+			return ReachabilityPublic
+		}
+	}
+	return ReachabilityUnknown
+}
+
+// Reachability returns whether the node can be dialed from the public
+// internet. If AutoNAT is enabled this is what our peers found when dialing us
+// back, otherwise it is a guess based on our addresses.
+func (n *OverlayNode) Reachability() Reachability {
+	return n.nat.reachability()
+}
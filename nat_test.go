@@ -0,0 +1,84 @@
+package overlaynetwork
+
+import (
+	"context"
+	"errors"
+	"github.com/libp2p/go-libp2p-autonat"
+	ma "github.com/multiformats/go-multiaddr"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAutoNAT reports the NAT status it was last given.
+type fakeAutoNAT struct {
+	status autonat.NATStatus
+	mtx    sync.Mutex
+}
+
+func (f *fakeAutoNAT) Status() autonat.NATStatus {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.status
+}
+
+func (f *fakeAutoNAT) setStatus(status autonat.NATStatus) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.status = status
+}
+
+func (f *fakeAutoNAT) PublicAddr() (ma.Multiaddr, error) {
+	return nil, errors.New("no public address")
+}
+
+func TestReachabilityFromAutoNAT(t *testing.T) {
+	n := newTestNode(t, nil)
+	nat := &fakeAutoNAT{status: autonat.NATStatusUnknown}
+	n.nat.autoNAT = nat
+
+	for status, expected := range map[autonat.NATStatus]Reachability{
+		autonat.NATStatusUnknown: ReachabilityUnknown,
+		autonat.NATStatusPublic:  ReachabilityPublic,
+		autonat.NATStatusPrivate: ReachabilityPrivate,
+	} {
+		nat.setStatus(status)
+		if r := n.Reachability(); r != expected {
+			t.Errorf("status %d: expected %s, got %s", status, expected, r)
+		}
+	}
+}
+
+func TestDHTAutoModeFollowsReachability(t *testing.T) {
+	interval := DHTModeCheckInterval
+	DHTModeCheckInterval = time.Millisecond * 50
+	defer func() { DHTModeCheckInterval = interval }()
+
+	n := newTestNode(t, func(cfg *NodeConfig) { cfg.DHTMode = DHTModeAuto })
+	if n.DHTMode() != DHTModeClient {
+		t.Fatalf("auto mode started in %s mode", n.DHTMode())
+	}
+	nat := &fakeAutoNAT{status: autonat.NATStatusUnknown}
+	n.nat.autoNAT = nat
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.runDHTModeSwitcher(ctx)
+
+	mode := func(expected DHTMode) func() bool {
+		return func() bool { return n.DHTMode() == expected }
+	}
+	time.Sleep(DHTModeCheckInterval * 2)
+	if n.DHTMode() != DHTModeClient {
+		t.Fatal("switched to server mode while reachability is unknown")
+	}
+
+	nat.setStatus(autonat.NATStatusPublic)
+	if !waitFor(t, time.Second*5, mode(DHTModeServer)) {
+		t.Fatal("didn't switch to server mode once publicly reachable")
+	}
+	nat.setStatus(autonat.NATStatusPrivate)
+	if !waitFor(t, time.Second*5, mode(DHTModeClient)) {
+		t.Fatal("didn't switch back to client mode once private")
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"fmt"
 	"github.com/gcash/bchd/chaincfg"
 	"github.com/ipfs/go-datastore"
-	"github.com/ipfs/go-ds-leveldb"
+	"github.com/ipfs/go-datastore/namespace"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-circuit"
 	"github.com/libp2p/go-libp2p-crypto"
 	"github.com/libp2p/go-libp2p-host"
 	"github.com/libp2p/go-libp2p-kad-dht"
@@ -16,8 +17,8 @@ import (
 	"github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p-record"
 	"github.com/libp2p/go-libp2p-routing"
+	"io"
 	"net"
-	"path"
 )
 
 var (
@@ -32,6 +33,15 @@ var (
 	ProtocolDHTTestnet3 = protocol.ID("/bitcoincash/testnet3/kad/1.0.0")
 )
 
+// networkName returns the name of the network used in our protocol IDs. As
+// with the DHT, every network other than mainnet shares the testnet3 name.
+func networkName(params *chaincfg.Params) string {
+	if params == &chaincfg.MainNetParams {
+		return "mainnet"
+	}
+	return "testnet3"
+}
+
 // OverlayNode represents our node in the overlay network. It is
 // capable of making direct connections to other peers in the overlay and
 // maintaining a kademlia DHT for the purpose of resolving peerIDs into
@@ -56,15 +66,43 @@ type OverlayNode struct {
 	// publish messages to the topic using a gossip mechanism.
 	PubSub *Pubsub
 
+	// Groups manages the end-to-end encrypted pubsub groups this node is a
+	// member of.
+	Groups *GroupManager
+
 	// PrivateKey is the identity private key for this node
 	PrivateKey crypto.PrivKey
 
 	// Datastore is a datastore implementation that we will use to store routing
-	// data.
+	// data. The DHT records are kept under DHTNamespace while applications
+	// should use AppDatastore to store their own data.
 	Datastore datastore.Datastore
 
+	// Republisher tracks the records this node has put to the DHT and
+	// periodically republishes them so they don't drop out of the network.
+	Republisher *Republisher
+
+	// Mailbox stores encrypted messages for offline peers and lets us
+	// deposit messages for and fetch messages from mailboxes.
+	Mailbox *Mailbox
+
 	bootstrapPeers   []peerstore.PeerInfo
 	disableDNSSeeeds bool
+	dsCloser         io.Closer
+	storage          *storageManager
+	dhtHost          *dhtHost
+	dhtMode          DHTMode
+	misbehavior      *misbehaviorTracker
+	pubsubLimiter    *pubsubLimiter
+	handshaker       *handshaker
+	services         *serviceRegistry
+	messenger        *messenger
+	nat              *natManager
+	relays           *relayManager
+	relayService     bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewOverlayNode is a constructor for our Node object
@@ -80,6 +118,27 @@ func NewOverlayNode(config *NodeConfig) (*OverlayNode, error) {
 		libp2p.ListenAddrStrings(fmt.Sprintf("/ip6/::/tcp/%d", config.Port)),
 		libp2p.Identity(config.PrivateKey),
 	}
+	if config.NATPortMap {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+
+	// We can always dial peers through relays. When auto relay is on the
+	// relay manager adds our relayed addresses to the ones we advertise.
+	relays := newRelayManager(config.AutoRelay)
+	if config.AutoRelay {
+		opts = append(opts, libp2p.AddrsFactory(relays.addrsFactory))
+	}
+
+	// The relay service only relays connections to peers which are already
+	// connected to us.
+	var relayOpts []relay.RelayOpt
+	if config.RelayService != nil {
+		if err := config.RelayService.apply(); err != nil {
+			return nil, err
+		}
+		relayOpts = append(relayOpts, relay.OptHop)
+	}
+	opts = append(opts, libp2p.EnableRelay(relayOpts...))
 
 	// This function will initialize a new libp2p host with our options plus a bunch of default options
 	// The default options includes default transports, muxers, security, and peer store.
@@ -88,43 +147,162 @@ func NewOverlayNode(config *NodeConfig) (*OverlayNode, error) {
 		return nil, err
 	}
 
-	// Create a leveldb datastore
-	dstore, err := leveldb.NewDatastore(path.Join(config.DataDir, "libp2p"), nil)
+	// The context is shared by the DHT, pubsub and our own services. If we
+	// fail part way through it is cancelled and everything we have opened
+	// so far is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	var dsCloser io.Closer
+	success := false
+	defer func() {
+		if success {
+			return
+		}
+		cancel()
+		peerHost.Close()
+		if dsCloser != nil {
+			dsCloser.Close()
+		}
+	}()
+
+	// The misbehavior tracker keeps the ban scores of our peers and closes
+	// connections from banned peers.
+	misbehavior := newMisbehaviorTracker(peerHost)
+
+	// Open the datastore. Unless one was passed in the config this will be
+	// leveldb, badger or in-memory depending on the DatastoreType.
+	dstore, dsCloser, err := openDatastore(config)
 	if err != nil {
 		return nil, err
 	}
+	// Older versions stored the DHT records at the root of the leveldb
+	// datastore.
+	if config.Datastore == nil && config.DatastoreType == DatastoreLevelDB {
+		if err := migrateDHTRecords(dstore); err != nil {
+			return nil, err
+		}
+	}
 
 	protocol := ProtocolDHTTestnet3
 	if config.Params == &chaincfg.MainNetParams {
 		protocol = ProtocolDHTMainnet
 	}
 
+	// The DHT records are kept in their own namespace and wrapped by the
+	// storage manager which enforces the storage quota.
+	storageCfg := DefaultStorageConfig
+	if config.Storage != nil {
+		storageCfg = *config.Storage
+	}
+	storage, err := newStorageManager(namespace.Wrap(dstore, DHTNamespace), storageCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The difficulty of the pow namespace is set per network but can be
+	// overridden in the config.
+	powValidator := NewPowValidator(config.Params)
+	if config.PowDifficulty > 0 {
+		powValidator.Difficulty = config.PowDifficulty
+	}
+
 	// Create the DHT instance. It needs the host and a datastore instance.
+	// We pass in a wrapped host so that the per-peer store limits are
+	// enforced on the DHT's streams and so that we can control whether the
+	// DHT runs in client or server mode. In auto mode we start out as a
+	// client until we know we are publicly reachable.
+	dhtHost := newDHTHost(peerHost, storage.limiter, misbehavior, config.DHTMode == DHTModeServer)
 	routing, err := dht.New(
-		context.Background(), peerHost,
-		dhtopts.Datastore(dstore),
+		ctx, dhtHost,
+		dhtopts.Datastore(storage.ds),
 		dhtopts.Protocols(protocol),
 		dhtopts.Validator(record.NamespacedValidator{
 			"pk":     record.PublicKeyValidator{},
 			"sha256": &Sha256Validator{},
+			"pow":    powValidator,
+			"acl":    &ACLValidator{Params: config.Params},
+			"wallet": &WalletRecordValidator{},
 		}),
 	)
+	if err != nil {
+		return nil, err
+	}
 
-	ps, err := pubsub.NewGossipSub(context.Background(), peerHost)
+	// The pubsub limiter runs ahead of the validator of every topic and
+	// drops messages from peers which are over their rate limits. Peers
+	// which relay messages that fail validation are penalized.
+	limitCfg := DefaultPubsubLimitConfig
+	if config.PubsubLimits != nil {
+		limitCfg = *config.PubsubLimits
+	}
+	limiter := newPubsubLimiter(peerHost.ID(), limitCfg, misbehavior.report)
+	penalties := DefaultInvalidMessagePenalties
+	if config.InvalidMessagePenalties != nil {
+		penalties = *config.InvalidMessagePenalties
+	}
+	penalizer := newInvalidMessagePenalizer(peerHost.ID(), penalties, misbehavior.report)
+
+	// All messages we publish are signed and we drop any message which is
+	// unsigned or has an invalid signature before it is validated, forwarded
+	// or delivered to subscribers. Banned peers are blacklisted.
+	psOpts := []pubsub.Option{
+		pubsub.WithMessageSigning(true),
+		pubsub.WithStrictSignatureVerification(true),
+		pubsub.WithBlacklist(misbehaviorBlacklist{misbehavior}),
+	}
+	ps, err := newPubsubRouter(ctx, peerHost, config, psOpts)
 	if err != nil {
 		return nil, err
 	}
 
+	discoveryCfg := config.TopicDiscovery.withDefaults()
+
+	// Every new connection runs the handshake. Peers on a different network
+	// are disconnected.
+	handshaker := newHandshaker(ctx, peerHost, networkName(config.Params), config.Services, config.ChainTip)
+
+	// Peers which connect to us through a relay are asked to dial us
+	// directly instead.
+	if config.HolePunching {
+		newHolePuncher(ctx, peerHost)
+	}
+
 	node := &OverlayNode{
 		Params:           config.Params,
 		Host:             peerHost,
 		Routing:          routing,
-		PubSub:           &Pubsub{ps: ps, ht: peerHost, rt: routing},
+		PubSub:           newPubsub(ctx, ps, peerHost, routing, dstore, networkName(config.Params), discoveryCfg, limiter, penalizer),
 		PrivateKey:       config.PrivateKey,
 		Datastore:        dstore,
+		Republisher:      NewRepublisher(dstore, routing, config.RepublishInterval),
 		bootstrapPeers:   config.BootstrapPeers,
 		disableDNSSeeeds: config.DisableDNSSeeds,
+		dsCloser:         dsCloser,
+		storage:          storage,
+		dhtHost:          dhtHost,
+		dhtMode:          config.DHTMode,
+		misbehavior:      misbehavior,
+		pubsubLimiter:    limiter,
+		handshaker:       handshaker,
+		relays:           relays,
+		relayService:     config.RelayService != nil,
+		services:         newServiceRegistry(ctx, routing, peerHost, handshaker, discoveryCfg),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+	node.Groups = newGroupManager(node.PubSub, peerHost, networkName(config.Params))
+	node.nat = newNATManager(node, config.AutoNAT, config.AutoNATService)
+	relays.n = node
+
+	mailboxCfg := DefaultMailboxConfig
+	if config.Mailbox != nil {
+		mailboxCfg = *config.Mailbox
+	}
+	node.Mailbox, err = newMailbox(node, mailboxCfg)
+	if err != nil {
+		return nil, err
 	}
+	node.messenger = newMessenger(node, config.MessagingKey)
+	success = true
 	return node, nil
 }
 
@@ -132,6 +310,11 @@ func NewOverlayNode(config *NodeConfig) (*OverlayNode, error) {
 // has been bootstrapped it will proceed to bootstrap the DHT.
 func (n *OverlayNode) StartOnlineServices() error {
 	peers := n.bootstrapPeers
+	cached, err := loadPeerCache(n.Datastore)
+	if err != nil {
+		log.Warnf("failed to load peer cache: %s", err)
+	}
+	peers = append(peers, cached...)
 	if !n.disableDNSSeeeds {
 		// TODO: we don't want to do this in the clear if we're using Tor. We need to
 		// investigate if we can lookup a TXT record over Tor.
@@ -140,11 +323,48 @@ func (n *OverlayNode) StartOnlineServices() error {
 			peers = append(peers, pi)
 		}
 	}
-	return Bootstrap(n.Routing.(*dht.IpfsDHT), n.Host, bootstrapConfigWithPeers(peers))
+	if err := Bootstrap(n.Routing.(*dht.IpfsDHT), n.Host, bootstrapConfigWithPeers(peers)); err != nil {
+		return err
+	}
+	n.nat.start(n.ctx)
+	go n.Republisher.Run(n.ctx)
+	go n.storage.run(n.ctx)
+	go n.misbehavior.run(n.ctx)
+	go n.pubsubLimiter.run(n.ctx)
+	go n.Mailbox.run(n.ctx)
+	go n.messenger.run(n.ctx)
+	go n.relays.run(n.ctx)
+	if n.relayService {
+		go (&relayAdvertiser{n: n}).run(n.ctx)
+	}
+	if n.messenger.key != nil {
+		go func() {
+			if err := n.PublishWalletRecord(n.ctx); err != nil {
+				log.Warnf("failed to publish wallet record: %s", err)
+			}
+		}()
+	}
+	if n.dhtMode == DHTModeAuto {
+		go n.runDHTModeSwitcher(n.ctx)
+	}
+	return nil
 }
 
 // Shutdown will cancel the context shared by the various components which will shut them all down
 // disconnecting all peers in the process.
 func (n *OverlayNode) Shutdown() {
+	n.cancel()
+
+	var connected []peerstore.PeerInfo
+	for _, p := range n.Host.Network().Peers() {
+		connected = append(connected, n.Host.Peerstore().PeerInfo(p))
+	}
+	if err := savePeerCache(n.Datastore, connected); err != nil {
+		log.Warnf("failed to save peer cache: %s", err)
+	}
+
 	n.Host.Close()
+	if n.dsCloser != nil {
+		n.dsCloser.Close()
+	}
 }
@@ -0,0 +1,61 @@
+package overlaynetwork
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/libp2p/go-libp2p-crypto"
+	"github.com/libp2p/go-libp2p-peerstore"
+	"testing"
+	"time"
+)
+
+// newTestNode returns an in-memory node listening on a random port. The
+// config can be adjusted with fn before the node is created. The node is shut
+// down when the test ends.
+func newTestNode(t *testing.T, fn func(cfg *NodeConfig)) *OverlayNode {
+	t.Helper()
+	privKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &NodeConfig{
+		PrivateKey:      privKey,
+		Params:          &chaincfg.TestNet3Params,
+		DisableDNSSeeds: true,
+		DatastoreType:   DatastoreInMemory,
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+	n, err := NewOverlayNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Shutdown)
+	return n
+}
+
+// connectNodes connects a to b.
+func connectNodes(t *testing.T, a, b *OverlayNode) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	pi := peerstore.PeerInfo{ID: b.Host.ID(), Addrs: b.Host.Addrs()}
+	if err := a.Host.Connect(ctx, pi); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it returns true or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return cond()
+}
@@ -0,0 +1,98 @@
+package overlaynetwork
+
+import (
+	"encoding/json"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// MaxCachedPeers is the maximum number of peers we will save to the peer cache.
+var MaxCachedPeers = 50
+
+// savePeerCache saves the addresses of the peers we're currently connected to
+// so that they can be used to bootstrap the next time the node starts. If we
+// aren't connected to anyone the existing cache is left alone.
+func savePeerCache(ds datastore.Datastore, peers []peerstore.PeerInfo) error {
+	if len(peers) == 0 {
+		return nil
+	}
+	if err := clearPeerCache(ds); err != nil {
+		return err
+	}
+	for i, pi := range peers {
+		if i >= MaxCachedPeers {
+			break
+		}
+		if len(pi.Addrs) == 0 {
+			continue
+		}
+		addrs := make([]string, 0, len(pi.Addrs))
+		for _, addr := range pi.Addrs {
+			addrs = append(addrs, addr.String())
+		}
+		ser, err := json.Marshal(addrs)
+		if err != nil {
+			return err
+		}
+		if err := ds.Put(PeerCacheNamespace.ChildString(peer.IDB58Encode(pi.ID)), ser); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPeerCache returns the peers saved by savePeerCache. Corrupt entries are
+// skipped.
+func loadPeerCache(ds datastore.Datastore) ([]peerstore.PeerInfo, error) {
+	res, err := ds.Query(query.Query{Prefix: PeerCacheNamespace.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	var peers []peerstore.PeerInfo
+	for _, entry := range entries {
+		pid, err := peer.IDB58Decode(datastore.NewKey(entry.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		var addrStrs []string
+		if err := json.Unmarshal(entry.Value, &addrStrs); err != nil {
+			continue
+		}
+		pi := peerstore.PeerInfo{ID: pid}
+		for _, s := range addrStrs {
+			addr, err := ma.NewMultiaddr(s)
+			if err != nil {
+				continue
+			}
+			pi.Addrs = append(pi.Addrs, addr)
+		}
+		if len(pi.Addrs) > 0 {
+			peers = append(peers, pi)
+		}
+	}
+	return peers, nil
+}
+
+func clearPeerCache(ds datastore.Datastore) error {
+	res, err := ds.Query(query.Query{Prefix: PeerCacheNamespace.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ds.Delete(datastore.NewKey(entry.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package overlaynetwork
+
+import (
+	"context"
+	"errors"
+	"github.com/coreos/go-semver/semver"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"strings"
+)
+
+// ErrNoCommonVersion is returned when we and the peer don't support any
+// common version of a protocol.
+var ErrNoCommonVersion = errors.New("no common protocol version")
+
+// VersionRange is a range of protocol versions. Both ends are inclusive. Max
+// is the version we implement. Both ends are advertised to other peers so
+// they can tell which versions we accept.
+type VersionRange struct {
+	Min semver.Version
+	Max semver.Version
+}
+
+// NewVersionRange parses the min and max versions into a VersionRange.
+func NewVersionRange(min, max string) (VersionRange, error) {
+	minVersion, err := semver.NewVersion(min)
+	if err != nil {
+		return VersionRange{}, err
+	}
+	maxVersion, err := semver.NewVersion(max)
+	if err != nil {
+		return VersionRange{}, err
+	}
+	if maxVersion.LessThan(*minVersion) {
+		return VersionRange{}, errors.New("max version is less than min version")
+	}
+	return VersionRange{Min: *minVersion, Max: *maxVersion}, nil
+}
+
+// Contains returns whether the version is in the range.
+func (r VersionRange) Contains(v semver.Version) bool {
+	return !v.LessThan(r.Min) && !r.Max.LessThan(v)
+}
+
+// VersionedHandler handles a stream for a versioned protocol. The version is
+// the one agreed with the remote peer.
+type VersionedHandler func(s inet.Stream, version semver.Version)
+
+// VersionedProtocol returns the protocol ID for the version of the base
+// protocol. For example /bitcoincash/mycustomprotocol and 1.2.0 give
+// /bitcoincash/mycustomprotocol/1.2.0.
+func VersionedProtocol(base protocol.ID, version semver.Version) protocol.ID {
+	return protocol.ID(string(base) + "/" + version.String())
+}
+
+// ProtocolVersion splits the version off a versioned protocol ID. It returns
+// false if the ID isn't a version of the base protocol.
+func ProtocolVersion(base protocol.ID, pid protocol.ID) (semver.Version, bool) {
+	prefix := string(base) + "/"
+	if !strings.HasPrefix(string(pid), prefix) {
+		return semver.Version{}, false
+	}
+	v, err := semver.NewVersion(strings.TrimPrefix(string(pid), prefix))
+	if err != nil {
+		return semver.Version{}, false
+	}
+	return *v, true
+}
+
+// HandleVersions registers the handler for every version of the base protocol
+// in the range. We advertise the min and max versions of the range to other
+// peers and accept streams for any version in it. The handler is told which
+// version the remote peer picked. The middlewares are applied as with Handle.
+func (n *OverlayNode) HandleVersions(base protocol.ID, versions VersionRange, handler VersionedHandler, middlewares ...Middleware) {
+	match := func(s string) bool {
+		v, ok := ProtocolVersion(base, protocol.ID(s))
+		return ok && versions.Contains(v)
+	}
+	for _, v := range []semver.Version{versions.Max, versions.Min} {
+		pid := VersionedProtocol(base, v)
+		h := n.wrapHandler(pid, func(s inet.Stream) {
+			v, _ := ProtocolVersion(base, s.Protocol())
+			handler(s, v)
+		}, middlewares)
+		n.Host.SetStreamHandlerMatch(pid, match, h)
+		if versions.Min.Equal(versions.Max) {
+			break
+		}
+	}
+}
+
+// NewVersionedStream opens a stream to the peer for the highest version of the
+// base protocol which we both support. We connect to the peer first so that
+// we know which versions it advertises. The agreed version is returned with
+// the stream.
+func (n *OverlayNode) NewVersionedStream(ctx context.Context, p peer.ID, base protocol.ID, versions VersionRange) (inet.Stream, semver.Version, error) {
+	if err := n.Host.Connect(ctx, n.Host.Peerstore().PeerInfo(p)); err != nil {
+		return nil, semver.Version{}, err
+	}
+
+	v, ok := negotiateVersion(base, versions, n.peerProtocols(p))
+	if !ok {
+		return nil, semver.Version{}, ErrNoCommonVersion
+	}
+	s, err := n.Host.NewStream(ctx, p, VersionedProtocol(base, v))
+	if err != nil {
+		return nil, semver.Version{}, err
+	}
+	return s, v, nil
+}
+
+// peerProtocols returns the protocols the peer told us it supports in
+// identify.
+func (n *OverlayNode) peerProtocols(p peer.ID) []protocol.ID {
+	protos, err := n.Host.Peerstore().GetProtocols(p)
+	if err != nil {
+		return nil
+	}
+	pids := make([]protocol.ID, 0, len(protos))
+	for _, proto := range protos {
+		pids = append(pids, protocol.ID(proto))
+	}
+	return pids
+}
+
+// negotiateVersion returns the highest version in both our range and the
+// peer's. The peer's range spans the lowest and highest versions of the base
+// protocol it advertises. If the peer doesn't advertise any valid version of
+// the protocol we don't know what it accepts so we treat it as incompatible.
+func negotiateVersion(base protocol.ID, versions VersionRange, peerProtocols []protocol.ID) (semver.Version, bool) {
+	var (
+		theirs     VersionRange
+		advertised bool
+	)
+	for _, pid := range peerProtocols {
+		v, ok := ProtocolVersion(base, pid)
+		if !ok {
+			continue
+		}
+		if !advertised || v.LessThan(theirs.Min) {
+			theirs.Min = v
+		}
+		if !advertised || theirs.Max.LessThan(v) {
+			theirs.Max = v
+		}
+		advertised = true
+	}
+	if !advertised {
+		return semver.Version{}, false
+	}
+
+	v := versions.Max
+	if theirs.Max.LessThan(v) {
+		v = theirs.Max
+	}
+	if !versions.Contains(v) || !theirs.Contains(v) {
+		return semver.Version{}, false
+	}
+	return v, true
+}
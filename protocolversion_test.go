@@ -0,0 +1,121 @@
+package overlaynetwork
+
+import (
+	"context"
+	"github.com/coreos/go-semver/semver"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-protocol"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+const testVersionedProtocol = protocol.ID("/bitcoincash/test/versioned")
+
+func mustVersionRange(t *testing.T, min, max string) VersionRange {
+	t.Helper()
+	r, err := NewVersionRange(min, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	ours := mustVersionRange(t, "1.0.0", "1.2.0")
+	pid := func(v string) protocol.ID {
+		return VersionedProtocol(testVersionedProtocol, *semver.New(v))
+	}
+	tests := []struct {
+		name     string
+		theirs   []protocol.ID
+		expected string
+	}{
+		{"same range", []protocol.ID{pid("1.2.0"), pid("1.0.0")}, "1.2.0"},
+		{"newer peer", []protocol.ID{pid("1.3.0"), pid("1.1.0")}, "1.2.0"},
+		{"older peer", []protocol.ID{pid("1.1.0"), pid("0.9.0")}, "1.1.0"},
+		{"only max advertised", []protocol.ID{pid("1.1.0")}, "1.1.0"},
+		{"peer too new", []protocol.ID{pid("2.0.0"), pid("1.5.0")}, ""},
+		{"peer too old", []protocol.ID{pid("0.9.0"), pid("0.5.0")}, ""},
+		{"not advertised", []protocol.ID{"/other/1.0.0"}, ""},
+		{"unknown version", []protocol.ID{testVersionedProtocol + "/latest"}, ""},
+		{"no protocols", nil, ""},
+	}
+	for _, test := range tests {
+		v, ok := negotiateVersion(testVersionedProtocol, ours, test.theirs)
+		if test.expected == "" {
+			if ok {
+				t.Errorf("%s: expected no common version, got %s", test.name, v)
+			}
+			continue
+		}
+		if !ok || v.String() != test.expected {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.expected, v, ok)
+		}
+	}
+}
+
+// newVersionedTestNode returns a node which handles the versions in the range
+// by writing back the agreed version.
+func newVersionedTestNode(t *testing.T, versions *VersionRange) *OverlayNode {
+	n := newTestNode(t, nil)
+	if versions != nil {
+		n.HandleVersions(testVersionedProtocol, *versions, func(s inet.Stream, version semver.Version) {
+			defer s.Close()
+			s.Write([]byte(version.String()))
+		})
+	}
+	return n
+}
+
+func TestVersionedStreamMixedVersions(t *testing.T) {
+	v1 := mustVersionRange(t, "1.0.0", "1.2.0")
+	v2 := mustVersionRange(t, "1.1.0", "1.3.0")
+	incompatible := mustVersionRange(t, "2.0.0", "2.0.0")
+	a := newVersionedTestNode(t, &v1)
+	b := newVersionedTestNode(t, &v2)
+	c := newVersionedTestNode(t, &incompatible)
+	none := newVersionedTestNode(t, nil)
+	for _, n := range []*OverlayNode{b, c, none} {
+		connectNodes(t, a, n)
+	}
+	connectNodes(t, b, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	tests := []struct {
+		name     string
+		from, to *OverlayNode
+		versions VersionRange
+		expected string
+	}{
+		{"old to new", a, b, v1, "1.2.0"},
+		{"new to old", b, a, v2, "1.2.0"},
+		{"incompatible", a, c, v1, ""},
+		{"incompatible reverse", c, a, incompatible, ""},
+		{"no common version", b, c, v2, ""},
+		{"not supported", a, none, v1, ""},
+	}
+	for _, test := range tests {
+		s, v, err := test.from.NewVersionedStream(ctx, test.to.Host.ID(), testVersionedProtocol, test.versions)
+		if test.expected == "" {
+			if err != ErrNoCommonVersion {
+				t.Errorf("%s: expected ErrNoCommonVersion, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		resp, err := ioutil.ReadAll(s)
+		s.Close()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if v.String() != test.expected || string(resp) != test.expected {
+			t.Errorf("%s: expected %s, got %s and the handler got %s", test.name, test.expected, v, resp)
+		}
+	}
+}
@@ -3,14 +3,20 @@ package overlaynetwork
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
 	"github.com/libp2p/go-libp2p-peer"
 	"github.com/libp2p/go-libp2p-peerstore"
+	"github.com/libp2p/go-libp2p-protocol"
 	"github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p-routing"
 	"github.com/multiformats/go-multihash"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,35 +25,595 @@ type Pubsub struct {
 	ps *pubsub.PubSub
 	rt routing.IpfsRouting
 	ht host.Host
+
+	discovery TopicDiscoveryConfig
+
+	history         *messageHistory
+	historyProtocol protocol.ID
+
+	limiter    *pubsubLimiter
+	penalizer  *invalidMessagePenalizer
+	validators map[string]TopicValidator
+
+	ctx    context.Context
+	topics map[string]*topicState
+	mtx    sync.Mutex
+}
+
+// topicState tracks our subscriptions to a topic. The topic is advertised in
+// the DHT for as long as there is at least one subscription which asked for
+// it. cancel stops advertising and is nil if the topic isn't advertised.
+type topicState struct {
+	subs   map[*Subscription]struct{}
+	cancel context.CancelFunc
+}
+
+// Subscription is a subscription to a pubsub topic. Cancelling it releases
+// our interest in the topic. Once every subscription to a topic is cancelled
+// we stop advertising the topic and stop looking for peers.
+type Subscription struct {
+	*pubsub.Subscription
+
+	p     *Pubsub
+	topic string
+	once  sync.Once
+	done  chan struct{}
+
+	// external is set if the pubsub subscription was handed to the caller
+	// of Subscribe, who is then responsible for cancelling it.
+	external bool
+}
+
+// Cancel cancels the subscription.
+func (s *Subscription) Cancel() {
+	s.once.Do(func() {
+		close(s.done)
+		if !s.external {
+			s.Subscription.Cancel()
+		}
+		s.p.release(s)
+	})
+}
+
+// TopicDiscoveryConfig controls how we advertise the topics we're subscribed
+// to and how we search for other peers subscribed to them.
+type TopicDiscoveryConfig struct {
+	// TargetPeers is the number of topic peers we try to stay connected to.
+	// If we have fewer than this we will search the DHT for more.
+	TargetPeers int
+
+	// MaxProviders is the max number of providers to look up per search.
+	MaxProviders int
+
+	// CheckInterval governs how often we check the number of topic peers.
+	CheckInterval time.Duration
+
+	// MaxBackoff is the max amount of time between searches when the
+	// searches don't turn up any new peers.
+	MaxBackoff time.Duration
+
+	// ReprovideInterval is how often we re-provide the topic CID. This must
+	// be less than the time it takes for a provider record to expire.
+	ReprovideInterval time.Duration
+
+	// ProvideTimeout is the max amount of time a provide may take.
+	ProvideTimeout time.Duration
+}
+
+// DefaultTopicDiscoveryConfig specifies default sane parameters for topic
+// discovery.
+var DefaultTopicDiscoveryConfig = TopicDiscoveryConfig{
+	TargetPeers:       6,
+	MaxProviders:      20,
+	CheckInterval:     time.Minute,
+	MaxBackoff:        time.Minute * 30,
+	ReprovideInterval: time.Hour * 12,
+	ProvideTimeout:    time.Minute * 2,
+}
+
+// withDefaults returns a copy of the config with every field which isn't set
+// filled in from DefaultTopicDiscoveryConfig.
+func (c *TopicDiscoveryConfig) withDefaults() TopicDiscoveryConfig {
+	cfg := DefaultTopicDiscoveryConfig
+	if c == nil {
+		return cfg
+	}
+	if c.TargetPeers > 0 {
+		cfg.TargetPeers = c.TargetPeers
+	}
+	if c.MaxProviders > 0 {
+		cfg.MaxProviders = c.MaxProviders
+	}
+	if c.CheckInterval > 0 {
+		cfg.CheckInterval = c.CheckInterval
+	}
+	if c.MaxBackoff > 0 {
+		cfg.MaxBackoff = c.MaxBackoff
+	}
+	if c.ReprovideInterval > 0 {
+		cfg.ReprovideInterval = c.ReprovideInterval
+	}
+	if c.ProvideTimeout > 0 {
+		cfg.ProvideTimeout = c.ProvideTimeout
+	}
+	return cfg
+}
+
+func newPubsub(ctx context.Context, ps *pubsub.PubSub, ht host.Host, rt routing.IpfsRouting,
+	ds datastore.Datastore, network string, discovery TopicDiscoveryConfig,
+	limiter *pubsubLimiter, penalizer *invalidMessagePenalizer) *Pubsub {
+
+	p := &Pubsub{
+		ps:        ps,
+		rt:        rt,
+		ht:        ht,
+		discovery: discovery,
+		history: &messageHistory{
+			ds:      ds,
+			topics:  make(map[string]*historyTopic),
+			indexes: make(map[string][]string),
+		},
+		historyProtocol: pubsubHistoryProtocol(network),
+		limiter:         limiter,
+		penalizer:       penalizer,
+		validators:      make(map[string]TopicValidator),
+		ctx:             ctx,
+		topics:          make(map[string]*topicState),
+	}
+	ht.SetStreamHandler(p.historyProtocol, PeerRateLimit(HistoryPeerRateLimit)(p.historyProtocol, p.handleHistoryStream))
+	return p
+}
+
+// ErrNoTopicPeers is returned by Publish when waiting for topic peers and none
+// could be found before the timeout.
+var ErrNoTopicPeers = errors.New("no peers found for topic")
+
+// PublishOption is an option for Publish.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	minPeers int
+	timeout  time.Duration
+}
+
+// WaitForPeers makes Publish look up the topic's providers in the DHT, connect
+// to them and wait until we have at least minPeers topic peers before
+// publishing. If the timeout passes with fewer peers the message is still
+// published to the peers we have, but if we have none ErrNoTopicPeers is
+// returned. A timeout of zero means we wait until the context passed to
+// Publish is done.
+func WaitForPeers(minPeers int, timeout time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.minPeers = minPeers
+		o.timeout = timeout
+	}
 }
 
 // Publish will publish the provided data to the peers subscribed to the topic
-func (p *Pubsub) Publish(ctx context.Context, topic string, data []byte) error {
+func (p *Pubsub) Publish(ctx context.Context, topic string, data []byte, opts ...PublishOption) error {
+	var options publishOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.minPeers > 0 {
+		if err := p.waitForTopicPeers(ctx, topic, options.minPeers, options.timeout); err != nil {
+			return err
+		}
+	}
 	return p.ps.Publish(topic, data)
 }
 
-// Subscribe will subscribe you to  the given topic
+// waitForTopicPeers searches the DHT for peers subscribed to the topic until we
+// are connected to minPeers of them, the timeout passes, or the context is
+// done. A zero timeout means no timeout.
+func (p *Pubsub) waitForTopicPeers(ctx context.Context, topic string, minPeers int, timeout time.Duration) error {
+	if len(p.ps.ListPeers(topic)) >= minPeers {
+		return nil
+	}
+	id, err := topicCID(topic)
+	if err != nil {
+		return err
+	}
+
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	go func() {
+		for {
+			p.connectToPubSubPeers(ctx, id, p.discovery.MaxProviders)
+			select {
+			case <-time.After(time.Second * 5):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Once connected it takes a moment for the new peers to tell us which
+	// topics they are subscribed to so we poll until we have enough.
+	ticker := time.NewTicker(time.Millisecond * 250)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if len(p.ps.ListPeers(topic)) >= minPeers {
+				return nil
+			}
+		case <-ctx.Done():
+			if len(p.ps.ListPeers(topic)) == 0 {
+				return ErrNoTopicPeers
+			}
+			return nil
+		}
+	}
+}
+
+// Subscribe will subscribe you to  the given topic. The topic is advertised
+// in the DHT, and we keep connecting to the other subscribers, until the
+// context is done or the subscription is cancelled. Cancelling the
+// subscription is up to the caller; libp2p panics if it is cancelled twice so
+// unlike Join we never cancel it ourselves. We notice that it was cancelled
+// within the topic's CheckInterval.
 func (p *Pubsub) Subscribe(ctx context.Context, topic string) (*pubsub.Subscription, error) {
+	s, err := p.addSubscription(ctx, topic, true, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.Subscription, nil
+}
+
+// Join subscribes to the given topic. The first subscription to a topic
+// advertises it in the DHT and connects to the other subscribers. Multiple
+// subscriptions to the same topic share the advertisement. The subscription
+// is cancelled when the context is done, by Unsubscribe or by calling its
+// Cancel method.
+func (p *Pubsub) Join(ctx context.Context, topic string) (*Subscription, error) {
+	return p.subscribe(ctx, topic, true)
+}
+
+// subscribe subscribes to the topic and, if advertise is set, advertises the
+// topic in the DHT. Topics which would reveal who we are, such as our
+// mailbox, aren't advertised.
+func (p *Pubsub) subscribe(ctx context.Context, topic string, advertise bool) (*Subscription, error) {
+	return p.addSubscription(ctx, topic, advertise, false)
+}
+
+// addSubscription subscribes to the topic and tracks the subscription in the
+// topic's state. If external is set the pubsub subscription is handed to the
+// caller and cancelling our Subscription only releases our interest in the
+// topic.
+func (p *Pubsub) addSubscription(ctx context.Context, topic string, advertise, external bool) (*Subscription, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	// The rate limits are enforced by the topic's validator so a topic
+	// without one of its own gets the default validator before we start
+	// receiving messages on it.
+	ts, ok := p.topics[topic]
+	if !ok {
+		if err := p.registerDefaultValidator(topic); err != nil {
+			return nil, err
+		}
+	}
 	sub, err := p.ps.Subscribe(topic)
 	if err != nil {
+		if !ok {
+			p.unregisterDefaultValidator(topic)
+		}
 		return nil, err
 	}
+	s := &Subscription{Subscription: sub, p: p, topic: topic, done: make(chan struct{}), external: external}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.Cancel()
+			case <-s.done:
+			}
+		}()
+	}
 
-	go func() {
-		h := sha256.Sum256([]byte("gossipsub:" + topic))
-		encoded, err := multihash.Encode(h[:], multihash.SHA2_256)
-		if err != nil {
+	if !ok {
+		ts = &topicState{subs: make(map[*Subscription]struct{})}
+		p.topics[topic] = ts
+	}
+	if advertise && ts.cancel == nil {
+		tctx, cancel := context.WithCancel(p.ctx)
+		ts.cancel = cancel
+		go p.advertiseTopic(tctx, topic)
+	}
+	ts.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Unsubscribe cancels all of our subscriptions to the topic which were made
+// with Join and stops advertising it. Subscriptions returned by Subscribe
+// must still be cancelled by their caller.
+func (p *Pubsub) Unsubscribe(topic string) {
+	p.mtx.Lock()
+	ts, ok := p.topics[topic]
+	var subs []*Subscription
+	if ok {
+		for s := range ts.subs {
+			subs = append(subs, s)
+		}
+	}
+	p.mtx.Unlock()
+
+	for _, s := range subs {
+		s.Cancel()
+	}
+}
+
+// release removes the subscription from the topic state. If it was the last
+// subscription, the topic's context is cancelled which stops the goroutines
+// advertising the topic and looking for peers.
+func (p *Pubsub) release(s *Subscription) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	ts, ok := p.topics[s.topic]
+	if !ok {
+		return
+	}
+	delete(ts.subs, s)
+	if len(ts.subs) == 0 {
+		if ts.cancel != nil {
+			ts.cancel()
+		}
+		delete(p.topics, s.topic)
+		p.unregisterDefaultValidator(s.topic)
+	}
+}
+
+// releaseCancelled releases every subscription to the topic if pubsub is no
+// longer subscribed to it. This happens once the caller cancelled all the
+// subscriptions we handed out from Subscribe.
+func (p *Pubsub) releaseCancelled(topic string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	ts, ok := p.topics[topic]
+	if !ok {
+		return
+	}
+	for _, t := range p.ps.GetTopics() {
+		if t == topic {
 			return
 		}
-		mh, err := multihash.Cast(encoded)
-		if err != nil {
+	}
+	for s := range ts.subs {
+		s.once.Do(func() { close(s.done) })
+	}
+	if ts.cancel != nil {
+		ts.cancel()
+	}
+	delete(p.topics, topic)
+	p.unregisterDefaultValidator(topic)
+}
+
+// advertiseTopic provides the topic's CID in the DHT and connects to the
+// other peers providing it. It keeps running until the context is cancelled,
+// re-providing the CID before the provider record expires and searching for
+// more peers, with backoff, whenever the number of topic peers falls below
+// the target.
+func (p *Pubsub) advertiseTopic(ctx context.Context, topic string) {
+	id, err := topicCID(topic)
+	if err != nil {
+		log.Errorf("pubsub: failed to create cid for topic %s: %s", topic, err)
+		return
+	}
+	cfg := p.discovery
+
+	provide := func() {
+		ctx, cancel := context.WithTimeout(ctx, cfg.ProvideTimeout)
+		defer cancel()
+		if err := p.rt.Provide(ctx, id, true); err != nil {
+			log.Debugf("pubsub: failed to provide topic %s: %s", topic, err)
+		}
+	}
+	go provide()
+	p.connectToPubSubPeers(ctx, id, cfg.MaxProviders)
+
+	reprovideTicker := time.NewTicker(cfg.ReprovideInterval)
+	defer reprovideTicker.Stop()
+	checkTicker := time.NewTicker(cfg.CheckInterval)
+	defer checkTicker.Stop()
+
+	backoff := cfg.CheckInterval
+	nextSearch := time.Now().Add(backoff)
+	for {
+		select {
+		case <-reprovideTicker.C:
+			go provide()
+		case <-checkTicker.C:
+			p.releaseCancelled(topic)
+			if ctx.Err() != nil {
+				return
+			}
+			if len(p.ps.ListPeers(topic)) >= cfg.TargetPeers {
+				backoff = cfg.CheckInterval
+				continue
+			}
+			if time.Now().Before(nextSearch) {
+				continue
+			}
+			if p.connectToPubSubPeers(ctx, id, cfg.MaxProviders) > 0 {
+				backoff = cfg.CheckInterval
+			} else {
+				backoff *= 2
+				if backoff > cfg.MaxBackoff {
+					backoff = cfg.MaxBackoff
+				}
+			}
+			nextSearch = time.Now().Add(backoff)
+		case <-ctx.Done():
 			return
 		}
-		id := cid.NewCidV1(cid.Raw, mh)
-		go p.rt.Provide(ctx, id, true)
-		p.connectToPubSubPeers(ctx, id)
-	}()
-	return sub, nil
+	}
+}
+
+// TopicPeerCounts returns, for each of the topics we're subscribed to, the
+// number of connected peers which told us they're subscribed to it. This is
+// what pubsub's ListPeers reports, not the size of our gossipsub mesh for the
+// topic, which the pubsub release we build against doesn't expose.
+func (p *Pubsub) TopicPeerCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, topic := range p.ps.GetTopics() {
+		counts[topic] = len(p.ps.ListPeers(topic))
+	}
+	return counts
+}
+
+// topicCID returns the CID which subscribers to the topic provide in the DHT.
+func topicCID(topic string) (cid.Cid, error) {
+	return providerCID("gossipsub", topic)
+}
+
+// providerCID returns the CID used to find the providers of the name in the
+// namespace. The CID is just the sha256 hash of the namespace and name and
+// doesn't refer to any content. We use it so that peers offering the same
+// thing can find each other through the DHT provider records.
+func providerCID(namespace, name string) (cid.Cid, error) {
+	h := sha256.Sum256([]byte(namespace + ":" + name))
+	encoded, err := multihash.Encode(h[:], multihash.SHA2_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+	mh, err := multihash.Cast(encoded)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, mh), nil
+}
+
+// TopicValidator is a function which validates a pubsub message before it is
+// delivered to subscribers or forwarded to other peers. The from peer is the
+// peer which propagated the message to us, not necessarily its author. Returning
+// false drops the message.
+type TopicValidator func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool
+
+// ValidatorOpts holds the options for a topic validator.
+type ValidatorOpts struct {
+	// Async runs the validator in the background so that slow validators
+	// don't block the processing of other messages. Sync validators run
+	// inline and should be fast.
+	Async bool
+
+	// Timeout is the max amount of time an async validator may take. The
+	// message is dropped if the validator does not return in time. Zero
+	// uses the pubsub default.
+	Timeout time.Duration
+
+	// Concurrency is the max number of async validations which may run at
+	// the same time for this topic. Zero uses the pubsub default.
+	Concurrency int
+}
+
+// RegisterTopicValidator registers a validator for the topic. Only one
+// validator may be registered per topic. Messages which fail validation are
+// dropped before they are propagated to other peers or delivered to any of
+// our subscriptions, and the peer which relayed them is penalized according
+// to the node's InvalidMessagePenalties.
+func (p *Pubsub) RegisterTopicValidator(topic string, fn TopicValidator, opts *ValidatorOpts) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if _, ok := p.validators[topic]; ok {
+		return fmt.Errorf("duplicate validator for topic %s", topic)
+	}
+
+	var psOpts []pubsub.ValidatorOpt
+	if opts == nil || !opts.Async {
+		psOpts = append(psOpts, pubsub.WithValidatorInline(true))
+	}
+	if opts != nil && opts.Timeout > 0 {
+		psOpts = append(psOpts, pubsub.WithValidatorTimeout(opts.Timeout))
+	}
+	if opts != nil && opts.Concurrency > 0 {
+		psOpts = append(psOpts, pubsub.WithValidatorConcurrency(opts.Concurrency))
+	}
+
+	// The router only allows one validator per topic so the default
+	// validator of a topic we're subscribed to is swapped out.
+	_, subscribed := p.topics[topic]
+	if subscribed {
+		p.unregisterDefaultValidator(topic)
+	}
+	if err := p.ps.RegisterTopicValidator(topic, p.validator(topic, fn), psOpts...); err != nil {
+		if subscribed {
+			p.registerDefaultValidator(topic)
+		}
+		return err
+	}
+	p.validators[topic] = fn
+	return nil
+}
+
+// UnregisterTopicValidator removes the validator for the topic.
+func (p *Pubsub) UnregisterTopicValidator(topic string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if _, ok := p.validators[topic]; !ok {
+		return fmt.Errorf("no validator for topic %s", topic)
+	}
+	if err := p.ps.UnregisterTopicValidator(topic); err != nil {
+		return err
+	}
+	delete(p.validators, topic)
+	if _, subscribed := p.topics[topic]; subscribed {
+		return p.registerDefaultValidator(topic)
+	}
+	return nil
+}
+
+// SetInvalidMessagePenalty sets the penalty for relaying an invalid message
+// on the topic, overriding the one from the node's InvalidMessagePenalties.
+func (p *Pubsub) SetInvalidMessagePenalty(topic string, penalty float64) {
+	if p.penalizer != nil {
+		p.penalizer.setTopicPenalty(topic, penalty)
+	}
+}
+
+// validator returns the validator we register with the router for the topic.
+// It drops messages from peers which are over their rate limits and then
+// runs the topic's own validator, if any, penalizing the peer which relayed
+// the message if it fails.
+func (p *Pubsub) validator(topic string, fn TopicValidator) pubsub.Validator {
+	return func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		if p.limiter != nil && !p.limiter.validate(ctx, from, msg) {
+			return false
+		}
+		if fn == nil || fn(ctx, from, msg) {
+			return true
+		}
+		if p.penalizer != nil {
+			p.penalizer.invalidMessage(from, topic)
+		}
+		return false
+	}
+}
+
+// registerDefaultValidator registers the default validator for a topic which
+// has no validator of its own. The caller must hold the lock.
+func (p *Pubsub) registerDefaultValidator(topic string) error {
+	if _, ok := p.validators[topic]; ok || p.limiter == nil {
+		return nil
+	}
+	return p.ps.RegisterTopicValidator(topic, p.validator(topic, nil), pubsub.WithValidatorInline(true))
+}
+
+// unregisterDefaultValidator removes the default validator of the topic. The
+// caller must hold the lock.
+func (p *Pubsub) unregisterDefaultValidator(topic string) {
+	if _, ok := p.validators[topic]; ok || p.limiter == nil {
+		return
+	}
+	if err := p.ps.UnregisterTopicValidator(topic); err != nil {
+		log.Debugf("pubsub: failed to unregister default validator for %s: %s", topic, err)
+	}
 }
 
 // GetTopics returns the list of topics were currently subscribed to
@@ -60,13 +626,22 @@ func (p *Pubsub) ListPeers(topic string) []peer.ID {
 	return p.ps.ListPeers(topic)
 }
 
-func (p *Pubsub) connectToPubSubPeers(ctx context.Context, cid *cid.Cid) {
+// connectToPubSubPeers looks up to max providers of the topic CID and
+// connects to the ones we aren't already connected to. It returns the number
+// of new connections.
+func (p *Pubsub) connectToPubSubPeers(ctx context.Context, cid cid.Cid, max int) int {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	provs := p.rt.FindProvidersAsync(ctx, cid, 10)
-	var wg sync.WaitGroup
+	provs := p.rt.FindProvidersAsync(ctx, cid, max)
+	var (
+		wg        sync.WaitGroup
+		connected int32
+	)
 	for prov := range provs {
+		if prov.ID == p.ht.ID() || p.ht.Network().Connectedness(prov.ID) == inet.Connected {
+			continue
+		}
 		wg.Add(1)
 		go func(pi peerstore.PeerInfo) {
 			defer wg.Done()
@@ -77,8 +652,10 @@ func (p *Pubsub) connectToPubSubPeers(ctx context.Context, cid *cid.Cid) {
 				log.Info("pubsub discover: ", err)
 				return
 			}
+			atomic.AddInt32(&connected, 1)
 			log.Info("connected to pubsub peer:", pi.ID)
 		}(prov)
 	}
 	wg.Wait()
+	return int(atomic.LoadInt32(&connected))
 }
@@ -0,0 +1,367 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/binary"
+	ggio "github.com/gogo/protobuf/io"
+	"github.com/ipfs/go-cid"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-peerstore"
+	"github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p-routing"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscribeCancelledWithContext(t *testing.T) {
+	n := newTestNode(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := n.PubSub.Join(ctx, "ctx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	ok := waitFor(t, time.Second*5, func() bool {
+		n.PubSub.mtx.Lock()
+		defer n.PubSub.mtx.Unlock()
+		_, ok := n.PubSub.topics["ctx"]
+		return !ok
+	})
+	if !ok {
+		t.Fatal("topic not released after the context was cancelled")
+	}
+	if _, err := sub.Next(context.Background()); err == nil {
+		t.Fatal("expected the subscription to be cancelled")
+	}
+	// Cancelling again is a no-op.
+	sub.Cancel()
+}
+
+func TestSubscribeReleasedAfterCancel(t *testing.T) {
+	discovery := DefaultTopicDiscoveryConfig
+	discovery.CheckInterval = time.Millisecond * 50
+	n := newTestNode(t, func(cfg *NodeConfig) { cfg.TopicDiscovery = &discovery })
+	released := func(topic string) bool {
+		n.PubSub.mtx.Lock()
+		defer n.PubSub.mtx.Unlock()
+		_, ok := n.PubSub.topics[topic]
+		return !ok
+	}
+
+	sub, err := n.PubSub.Subscribe(context.Background(), "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined, err := n.PubSub.Join(context.Background(), "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Cancel()
+	time.Sleep(time.Millisecond * 200)
+	if released("raw") {
+		t.Fatal("topic released while joined")
+	}
+	joined.Cancel()
+	if !waitFor(t, time.Second*5, func() bool { return released("raw") }) {
+		t.Fatal("topic not released after the subscription was cancelled")
+	}
+
+	// Unsubscribe leaves the subscription to its owner.
+	sub, err = n.PubSub.Subscribe(context.Background(), "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.PubSub.Unsubscribe("raw")
+	if !released("raw") {
+		t.Fatal("topic not released by Unsubscribe")
+	}
+	sub.Cancel()
+	if _, err := sub.Next(context.Background()); err == nil {
+		t.Fatal("expected the subscription to be cancelled")
+	}
+}
+
+func TestWaitForPeersWithoutTimeout(t *testing.T) {
+	publisher := newTestNode(t, nil)
+	subscriber := newTestNode(t, nil)
+	sub, err := subscriber.PubSub.Subscribe(context.Background(), "wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+
+	// With no timeout Publish keeps waiting for a topic peer rather than
+	// giving up straight away.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- publisher.PubSub.Publish(context.Background(), "wait", []byte("hello"), WaitForPeers(1, 0))
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("publish returned before a peer was found: %v", err)
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	connectNodes(t, publisher, subscriber)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("publish did not return after a peer was found")
+	}
+
+	// The context still bounds the wait.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	err = publisher.PubSub.Publish(ctx, "nobody", []byte("hello"), WaitForPeers(1, 0))
+	if err != ErrNoTopicPeers {
+		t.Fatalf("expected ErrNoTopicPeers, got %v", err)
+	}
+}
+
+func TestStrictSignatureVerification(t *testing.T) {
+	receiver := newTestNode(t, nil)
+	sender := newTestNode(t, nil)
+	other := newTestNode(t, nil)
+
+	var (
+		validated []string
+		mtx       sync.Mutex
+	)
+	err := receiver.PubSub.RegisterTopicValidator("strict", func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		validated = append(validated, string(msg.GetData()))
+		return string(msg.GetData()) != "invalid"
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := receiver.PubSub.Subscribe(context.Background(), "strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+	connectNodes(t, sender, receiver)
+
+	// The messages are written to the receiver directly so that we control
+	// exactly what is signed.
+	seqno := uint64(0)
+	message := func(data string) *pb.Message {
+		seqno++
+		m := &pb.Message{
+			From:     []byte(sender.Host.ID()),
+			Data:     []byte(data),
+			Seqno:    make([]byte, 8),
+			TopicIDs: []string{"strict"},
+		}
+		binary.BigEndian.PutUint64(m.Seqno, seqno)
+		return m
+	}
+	sign := func(n *OverlayNode, m *pb.Message) *pb.Message {
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := n.Host.Peerstore().PrivKey(n.Host.ID()).Sign(append([]byte(pubsub.SignPrefix), b...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Signature = sig
+		return m
+	}
+	tampered := sign(sender, message("signed"))
+	tampered.Data = []byte("tampered")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	s, err := sender.Host.NewStream(ctx, receiver.Host.ID(), pubsubProtocol("testnet3", pubsub.FloodSubID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	w := ggio.NewDelimitedWriter(s)
+	for _, m := range []*pb.Message{
+		message("unsigned"),
+		sign(other, message("wrong key")),
+		tampered,
+		sign(sender, message("invalid")),
+		sign(sender, message("valid")),
+	} {
+		if err := w.WriteMsg(&pb.RPC{Publish: []*pb.Message{m}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetData()) != "valid" {
+		t.Fatalf("delivered %q", msg.GetData())
+	}
+	nextCtx, nextCancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer nextCancel()
+	if msg, err := sub.Next(nextCtx); err == nil {
+		t.Fatalf("delivered %q", msg.GetData())
+	}
+
+	// Messages without a valid signature never reach the validator.
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(validated) != 2 || validated[0] != "invalid" || validated[1] != "valid" {
+		t.Fatalf("validator saw %q", validated)
+	}
+}
+
+// fakeProviderRouting counts provides and searches and records the count
+// asked for by the last search. Searches return no providers until more than
+// emptySearches have been made. Only Provide and FindProvidersAsync are
+// implemented.
+type fakeProviderRouting struct {
+	routing.IpfsRouting
+
+	providers     []peerstore.PeerInfo
+	emptySearches int
+
+	provides  int
+	searches  int
+	lastCount int
+	mtx       sync.Mutex
+}
+
+func (f *fakeProviderRouting) Provide(ctx context.Context, id cid.Cid, announce bool) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.provides++
+	return nil
+}
+
+func (f *fakeProviderRouting) FindProvidersAsync(ctx context.Context, id cid.Cid, max int) <-chan peerstore.PeerInfo {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.searches++
+	f.lastCount = max
+	ch := make(chan peerstore.PeerInfo, len(f.providers))
+	if f.searches > f.emptySearches {
+		for _, pi := range f.providers {
+			ch <- pi
+		}
+	}
+	close(ch)
+	return ch
+}
+
+func (f *fakeProviderRouting) counts() (provides, searches int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.provides, f.searches
+}
+
+// newDiscoveryPubsub returns a Pubsub for the node which advertises topics
+// through rt.
+func newDiscoveryPubsub(t *testing.T, n *OverlayNode, rt routing.IpfsRouting, cfg TopicDiscoveryConfig) *Pubsub {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newPubsub(ctx, n.PubSub.ps, n.Host, rt, n.Datastore, "testnet3", cfg.withDefaults(), nil, nil)
+}
+
+func TestTopicDiscoveryConfigDefaults(t *testing.T) {
+	var nilCfg *TopicDiscoveryConfig
+	if nilCfg.withDefaults() != DefaultTopicDiscoveryConfig {
+		t.Fatal("nil config doesn't use the defaults")
+	}
+	cfg := (&TopicDiscoveryConfig{TargetPeers: 2, CheckInterval: time.Second}).withDefaults()
+	expected := DefaultTopicDiscoveryConfig
+	expected.TargetPeers = 2
+	expected.CheckInterval = time.Second
+	if cfg != expected {
+		t.Fatalf("expected %+v, got %+v", expected, cfg)
+	}
+
+	// A partially filled config must not leave any interval at zero.
+	n := newTestNode(t, func(cfg *NodeConfig) {
+		cfg.TopicDiscovery = &TopicDiscoveryConfig{TargetPeers: 2}
+	})
+	sub, err := n.PubSub.Join(context.Background(), "partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	sub.Cancel()
+}
+
+func TestTopicReprovide(t *testing.T) {
+	n := newTestNode(t, nil)
+	rt := new(fakeProviderRouting)
+	p := newDiscoveryPubsub(t, n, rt, TopicDiscoveryConfig{ReprovideInterval: time.Millisecond * 50})
+
+	sub, err := p.Join(context.Background(), "reprovide")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, time.Second*5, func() bool {
+		provides, _ := rt.counts()
+		return provides >= 4
+	}) {
+		t.Fatal("topic not re-provided")
+	}
+
+	// Once the last subscription is cancelled we stop providing.
+	sub.Cancel()
+	time.Sleep(time.Millisecond * 100)
+	provides, _ := rt.counts()
+	time.Sleep(time.Millisecond * 200)
+	if after, _ := rt.counts(); after != provides {
+		t.Fatalf("topic provided %d more times after the subscription was cancelled", after-provides)
+	}
+}
+
+func TestTopicContinuousDiscovery(t *testing.T) {
+	n := newTestNode(t, nil)
+	provider := newTestNode(t, nil)
+	joined, err := provider.PubSub.Join(context.Background(), "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joined.Cancel()
+
+	// The provider only shows up in the DHT after a few searches.
+	rt := &fakeProviderRouting{
+		providers:     []peerstore.PeerInfo{{ID: provider.Host.ID(), Addrs: provider.Host.Addrs()}},
+		emptySearches: 3,
+	}
+	p := newDiscoveryPubsub(t, n, rt, TopicDiscoveryConfig{
+		TargetPeers:   1,
+		CheckInterval: time.Millisecond * 20,
+		MaxBackoff:    time.Millisecond * 40,
+	})
+	sub, err := p.Join(context.Background(), "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+
+	if !waitFor(t, time.Second*10, func() bool {
+		return n.Host.Network().Connectedness(provider.Host.ID()) == inet.Connected &&
+			len(p.ps.ListPeers("discovery")) == 1
+	}) {
+		t.Fatal("provider not found")
+	}
+	if _, searches := rt.counts(); searches <= rt.emptySearches {
+		t.Fatalf("only searched %d times", searches)
+	}
+
+	// We stop searching once we have enough topic peers.
+	_, searches := rt.counts()
+	time.Sleep(time.Millisecond * 200)
+	if _, after := rt.counts(); after != searches {
+		t.Fatalf("searched %d more times with enough topic peers", after-searches)
+	}
+}
@@ -0,0 +1,268 @@
+package overlaynetwork
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-pubsub"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket rate limit. A zero rate means no limit.
+type RateLimit struct {
+	// Messages is the number of messages per second.
+	Messages float64
+
+	// Bytes is the number of bytes per second.
+	Bytes float64
+
+	// Burst is the number of seconds worth of messages or bytes that may be
+	// sent at once.
+	Burst float64
+}
+
+// PubsubLimitConfig holds the per-peer limits enforced on the pubsub messages
+// relayed to us. Messages over the limits are dropped before they are
+// delivered or forwarded and the offending peer is reported to the node's
+// misbehavior tracker.
+type PubsubLimitConfig struct {
+	// PerPeer is the limit applied to each peer across all topics.
+	PerPeer RateLimit
+
+	// Topics are additional limits applied to each peer per topic.
+	Topics map[string]RateLimit
+
+	// BanScore is added to a peer's ban score for each message dropped
+	// because it was over the limits.
+	BanScore float64
+}
+
+// DefaultPubsubLimitConfig specifies default sane pubsub limits.
+var DefaultPubsubLimitConfig = PubsubLimitConfig{
+	PerPeer: RateLimit{
+		Messages: 100,
+		Bytes:    1 << 20,
+		Burst:    5,
+	},
+	BanScore: 2,
+}
+
+// InvalidMessagePenalties holds the penalties for peers which relay pubsub
+// messages that fail topic validation. Each invalid message adds its penalty
+// to the relaying peer's ban score in the node's misbehavior tracker. Once the
+// score crosses the BanThreshold the peer is disconnected and blacklisted by
+// the router.
+//
+// These are not gossipsub peer scores. The pubsub release we build against
+// has no peer scoring so the penalties feed our own ban scores instead.
+type InvalidMessagePenalties struct {
+	// Penalty is added to the ban score of a peer for each invalid message
+	// it relays on a topic without its own penalty.
+	Penalty float64
+
+	// Topics are the penalties for each topic. They override Penalty.
+	Topics map[string]float64
+}
+
+// DefaultInvalidMessagePenalties specifies default sane penalties for
+// invalid messages.
+var DefaultInvalidMessagePenalties = InvalidMessagePenalties{
+	Penalty: 10,
+}
+
+// invalidMessagePenalizer penalizes the peers which relay invalid messages
+// to us.
+type invalidMessagePenalizer struct {
+	self      peer.ID
+	penalties InvalidMessagePenalties
+	report    func(p peer.ID, score float64, reason string)
+	mtx       sync.RWMutex
+}
+
+func newInvalidMessagePenalizer(self peer.ID, penalties InvalidMessagePenalties, report func(peer.ID, float64, string)) *invalidMessagePenalizer {
+	topics := make(map[string]float64, len(penalties.Topics))
+	for topic, penalty := range penalties.Topics {
+		topics[topic] = penalty
+	}
+	penalties.Topics = topics
+	return &invalidMessagePenalizer{
+		self:      self,
+		penalties: penalties,
+		report:    report,
+	}
+}
+
+func (s *invalidMessagePenalizer) setTopicPenalty(topic string, penalty float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.penalties.Topics[topic] = penalty
+}
+
+// invalidMessage penalizes the peer for relaying an invalid message on the
+// topic.
+func (s *invalidMessagePenalizer) invalidMessage(from peer.ID, topic string) {
+	if from == s.self || s.report == nil {
+		return
+	}
+	s.mtx.RLock()
+	penalty := s.penalties.Penalty
+	if topicPenalty, ok := s.penalties.Topics[topic]; ok {
+		penalty = topicPenalty
+	}
+	s.mtx.RUnlock()
+	if penalty > 0 {
+		s.report(from, penalty, "invalid pubsub message on "+topic)
+	}
+}
+
+// tokenBucket is a basic token bucket.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  rate * burst,
+		tokens: rate * burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+type limitKey struct {
+	peer  peer.ID
+	topic string
+}
+
+// limitBuckets holds the message and byte buckets for a peer or peer/topic.
+type limitBuckets struct {
+	msgs  *tokenBucket
+	bytes *tokenBucket
+}
+
+// allow takes a message of the given size from the buckets. Tokens are only
+// taken if both buckets have enough.
+func (lb *limitBuckets) allow(now time.Time, size int) bool {
+	if lb.msgs != nil {
+		lb.msgs.refill(now)
+		if lb.msgs.tokens < 1 {
+			return false
+		}
+	}
+	if lb.bytes != nil {
+		lb.bytes.refill(now)
+		if lb.bytes.tokens < float64(size) {
+			return false
+		}
+	}
+	if lb.msgs != nil {
+		lb.msgs.tokens--
+	}
+	if lb.bytes != nil {
+		lb.bytes.tokens -= float64(size)
+	}
+	return true
+}
+
+func newLimitBuckets(limit RateLimit, now time.Time) *limitBuckets {
+	lb := new(limitBuckets)
+	if limit.Messages > 0 {
+		lb.msgs = newTokenBucket(limit.Messages, limit.Burst, now)
+	}
+	if limit.Bytes > 0 {
+		lb.bytes = newTokenBucket(limit.Bytes, limit.Burst, now)
+	}
+	return lb
+}
+
+// pubsubLimiter enforces the PubsubLimitConfig. It runs ahead of the
+// validator of every topic we're subscribed to.
+type pubsubLimiter struct {
+	self    peer.ID
+	cfg     PubsubLimitConfig
+	report  func(p peer.ID, score float64, reason string)
+	buckets map[limitKey]*limitBuckets
+	mtx     sync.Mutex
+}
+
+func newPubsubLimiter(self peer.ID, cfg PubsubLimitConfig, report func(peer.ID, float64, string)) *pubsubLimiter {
+	return &pubsubLimiter{
+		self:    self,
+		cfg:     cfg,
+		report:  report,
+		buckets: make(map[limitKey]*limitBuckets),
+	}
+}
+
+// validate drops the message if the peer which relayed it to us is over its
+// limits.
+func (l *pubsubLimiter) validate(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+	if from == l.self {
+		return true
+	}
+	size := len(msg.GetData())
+	now := time.Now()
+
+	l.mtx.Lock()
+	ok := l.allow(limitKey{peer: from}, l.cfg.PerPeer, now, size)
+	for _, topic := range msg.GetTopicIDs() {
+		if limit, exists := l.cfg.Topics[topic]; exists && ok {
+			ok = l.allow(limitKey{peer: from, topic: topic}, limit, now, size)
+		}
+	}
+	l.mtx.Unlock()
+
+	if !ok && l.report != nil {
+		l.report(from, l.cfg.BanScore, "pubsub rate limit exceeded")
+	}
+	return ok
+}
+
+func (l *pubsubLimiter) allow(key limitKey, limit RateLimit, now time.Time, size int) bool {
+	if limit.Messages == 0 && limit.Bytes == 0 {
+		return true
+	}
+	lb, ok := l.buckets[key]
+	if !ok {
+		lb = newLimitBuckets(limit, now)
+		l.buckets[key] = lb
+	}
+	return lb.allow(now, size)
+}
+
+// run removes idle buckets until the context is cancelled. A bucket which
+// hasn't been used in a while is full again so there is no need to keep it.
+func (l *pubsubLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mtx.Lock()
+			cutoff := time.Now().Add(-time.Minute * 10)
+			for key, lb := range l.buckets {
+				if (lb.msgs == nil || lb.msgs.last.Before(cutoff)) &&
+					(lb.bytes == nil || lb.bytes.last.Before(cutoff)) {
+					delete(l.buckets, key)
+				}
+			}
+			l.mtx.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
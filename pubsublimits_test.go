@@ -0,0 +1,156 @@
+package overlaynetwork
+
+import (
+	"bytes"
+	"context"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-pubsub"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// spamTestNet is an in-process floodsub network of a spammer and a victim.
+// received counts the spammer's messages which passed validation and were
+// delivered to the victim's subscription, and would have been forwarded to
+// the victim's other topic peers.
+type spamTestNet struct {
+	spammer  *OverlayNode
+	victim   *OverlayNode
+	received int32
+}
+
+func newSpamTestNet(t *testing.T, topic string, victimCfg func(cfg *NodeConfig)) *spamTestNet {
+	floodsub := func(cfg *NodeConfig) { cfg.PubsubRouter = PubsubRouterFloodSub }
+	tn := &spamTestNet{
+		spammer: newTestNode(t, floodsub),
+		victim: newTestNode(t, func(cfg *NodeConfig) {
+			floodsub(cfg)
+			victimCfg(cfg)
+		}),
+	}
+	connectNodes(t, tn.spammer, tn.victim)
+
+	ctx := context.Background()
+	sub, err := tn.victim.PubSub.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sub.Cancel)
+	go func() {
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+			if msg.GetFrom() == tn.spammer.Host.ID() {
+				atomic.AddInt32(&tn.received, 1)
+			}
+		}
+	}()
+
+	ok := waitFor(t, time.Second*10, func() bool {
+		return len(tn.spammer.PubSub.ps.ListPeers(topic)) > 0
+	})
+	if !ok {
+		t.Fatal("topic peers not found")
+	}
+	return tn
+}
+
+// checkBanned checks that the victim banned and disconnected the spammer.
+func (tn *spamTestNet) checkBanned(t *testing.T) {
+	t.Helper()
+	spammer := tn.spammer.Host.ID()
+	ok := waitFor(t, time.Second*10, func() bool {
+		return tn.victim.IsBanned(spammer) &&
+			tn.victim.Host.Network().Connectedness(spammer) != inet.Connected
+	})
+	if !ok {
+		t.Fatal("spammer was not banned and disconnected")
+	}
+	if !(misbehaviorBlacklist{tn.victim.misbehavior}).Contains(spammer) {
+		t.Fatal("spammer not blacklisted by pubsub")
+	}
+}
+
+func TestPubsubRateLimitBansSpammer(t *testing.T) {
+	const topic = "spam-rate"
+	tn := newSpamTestNet(t, topic, func(cfg *NodeConfig) {
+		cfg.PubsubLimits = &PubsubLimitConfig{
+			PerPeer:  RateLimit{Messages: 5, Burst: 1},
+			BanScore: 20,
+		}
+	})
+
+	const sent = 200
+	for i := 0; i < sent; i++ {
+		if err := tn.spammer.PubSub.Publish(context.Background(), topic, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tn.checkBanned(t)
+
+	// The burst gets through, then every message is dropped until the
+	// spammer has been dropped five times and is banned.
+	time.Sleep(time.Millisecond * 200)
+	received := atomic.LoadInt32(&tn.received)
+	if received == 0 || received > 20 {
+		t.Fatalf("victim accepted %d of %d spam messages", received, sent)
+	}
+}
+
+func TestPubsubInvalidMessagesBanSpammer(t *testing.T) {
+	const topic = "spam-invalid"
+	tn := newSpamTestNet(t, topic, func(cfg *NodeConfig) {
+		cfg.InvalidMessagePenalties = &InvalidMessagePenalties{
+			Penalty: 1,
+			Topics:  map[string]float64{topic: 25},
+		}
+	})
+	err := tn.victim.PubSub.RegisterTopicValidator(topic, func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		return !bytes.HasPrefix(msg.GetData(), []byte("bad"))
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := tn.spammer.PubSub.Publish(context.Background(), topic, []byte{'b', 'a', 'd', byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tn.checkBanned(t)
+
+	time.Sleep(time.Millisecond * 200)
+	if received := atomic.LoadInt32(&tn.received); received != 0 {
+		t.Fatalf("victim accepted %d invalid messages", received)
+	}
+}
+
+func TestPubsubDefaultValidatorSwap(t *testing.T) {
+	n := newTestNode(t, nil)
+	ctx := context.Background()
+	sub, err := n.PubSub.Subscribe(ctx, "swap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept := func(context.Context, peer.ID, *pubsub.Message) bool { return true }
+	if err := n.PubSub.RegisterTopicValidator("swap", accept, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.PubSub.RegisterTopicValidator("swap", accept, nil); err == nil {
+		t.Fatal("expected duplicate validator error")
+	}
+	if err := n.PubSub.UnregisterTopicValidator("swap"); err != nil {
+		t.Fatal(err)
+	}
+	sub.Cancel()
+
+	// The default validator is removed with the last subscription so a
+	// topic validator can be registered on a topic we aren't subscribed to.
+	if err := n.PubSub.RegisterTopicValidator("swap", accept, nil); err != nil {
+		t.Fatal(err)
+	}
+}
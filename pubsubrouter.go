@@ -0,0 +1,186 @@
+package overlaynetwork
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"github.com/libp2p/go-libp2p-pubsub"
+	"strings"
+	"time"
+)
+
+// PubsubRouter selects the pubsub routing algorithm.
+type PubsubRouter int
+
+const (
+	// PubsubRouterGossipSub uses gossipsub which maintains a mesh of peers
+	// per topic and gossips message IDs to the rest. This is the default.
+	PubsubRouterGossipSub PubsubRouter = iota
+
+	// PubsubRouterFloodSub uses floodsub which forwards every message to
+	// every topic peer. It is simple and deterministic which makes it a good
+	// fit for small private overlays and testing.
+	PubsubRouterFloodSub
+
+	// PubsubRouterRandomSub forwards each message to a random subset of the
+	// topic peers. The number of peers is set by pubsub.RandomSubD.
+	PubsubRouterRandomSub
+)
+
+// GossipSubParams are the gossipsub mesh parameters. Zero values keep the
+// libp2p defaults.
+//
+// The pubsub release we build against has no per-router options for these.
+// It keeps them in package level variables, so they can't be set per node:
+// they apply to every gossipsub router in the process, including the ones
+// which are already running, and should only be set before the first node
+// is started.
+type GossipSubParams struct {
+	// D is the target number of peers in the mesh of each topic.
+	D int
+
+	// Dlo is the number of mesh peers below which we graft more.
+	Dlo int
+
+	// Dhi is the number of mesh peers above which we prune some.
+	Dhi int
+
+	// HeartbeatInterval is how often the mesh is maintained and gossip is
+	// emitted.
+	HeartbeatInterval time.Duration
+}
+
+// validate checks that the parameters, with the current libp2p values in
+// place of the zero ones, satisfy 0 < Dlo <= D <= Dhi.
+func (p *GossipSubParams) validate() error {
+	d, dlo, dhi := pubsub.GossipSubD, pubsub.GossipSubDlo, pubsub.GossipSubDhi
+	if p.D > 0 {
+		d = p.D
+	}
+	if p.Dlo > 0 {
+		dlo = p.Dlo
+	}
+	if p.Dhi > 0 {
+		dhi = p.Dhi
+	}
+	if p.D < 0 || p.Dlo < 0 || p.Dhi < 0 || p.HeartbeatInterval < 0 {
+		return errors.New("gossipsub params must not be negative")
+	}
+	if dlo > d || d > dhi {
+		return fmt.Errorf("gossipsub params must satisfy Dlo <= D <= Dhi, got Dlo=%d D=%d Dhi=%d", dlo, d, dhi)
+	}
+	return nil
+}
+
+// apply validates the parameters and sets the libp2p gossipsub parameters.
+// Nothing is changed if they are inconsistent.
+func (p *GossipSubParams) apply() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.D > 0 {
+		pubsub.GossipSubD = p.D
+	}
+	if p.Dlo > 0 {
+		pubsub.GossipSubDlo = p.Dlo
+	}
+	if p.Dhi > 0 {
+		pubsub.GossipSubDhi = p.Dhi
+	}
+	if p.HeartbeatInterval > 0 {
+		pubsub.GossipSubHeartbeatInterval = p.HeartbeatInterval
+	}
+	return nil
+}
+
+// GossipSubProtocol returns the gossipsub protocol ID for the network.
+func GossipSubProtocol(network string) protocol.ID {
+	return pubsubProtocol(network, pubsub.GossipSubID)
+}
+
+// FloodSubProtocol returns the floodsub protocol ID for the network.
+func FloodSubProtocol(network string) protocol.ID {
+	return pubsubProtocol(network, pubsub.FloodSubID)
+}
+
+// RandomSubProtocol returns the randomsub protocol ID for the network.
+func RandomSubProtocol(network string) protocol.ID {
+	return pubsubProtocol(network, pubsub.RandomSubID)
+}
+
+func pubsubProtocol(network string, pid protocol.ID) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/bitcoincash/%s", network)) + pid
+}
+
+// newPubsubRouter returns the pubsub instance using the router selected in the config.
+// The protocol IDs of every router are namespaced by network so that pubsub
+// on different networks can never interconnect. Gossipsub and randomsub also
+// speak our floodsub protocol so that they can talk to floodsub nodes on the
+// same network.
+func newPubsubRouter(ctx context.Context, h host.Host, config *NodeConfig, opts []pubsub.Option) (*pubsub.PubSub, error) {
+	ph := &pubsubHost{
+		Host:   h,
+		prefix: pubsubProtocol(networkName(config.Params), ""),
+	}
+
+	switch config.PubsubRouter {
+	case PubsubRouterFloodSub:
+		return pubsub.NewFloodSub(ctx, ph, opts...)
+	case PubsubRouterRandomSub:
+		return pubsub.NewRandomSub(ctx, ph, opts...)
+	}
+	if config.GossipSubParams != nil {
+		if err := config.GossipSubParams.apply(); err != nil {
+			return nil, err
+		}
+	}
+	return pubsub.NewGossipSub(ctx, ph, opts...)
+}
+
+// pubsubHost wraps the host that is passed into pubsub. libp2p doesn't let us
+// change the protocol IDs of gossipsub and randomsub so we prefix them with
+// the network here instead. The streams handed to pubsub report the libp2p
+// protocol ID so the routers can tell which protocol a peer speaks.
+type pubsubHost struct {
+	host.Host
+
+	prefix protocol.ID
+}
+
+func (h *pubsubHost) SetStreamHandler(pid protocol.ID, handler inet.StreamHandler) {
+	h.Host.SetStreamHandler(h.prefix+pid, func(s inet.Stream) {
+		handler(&pubsubStream{Stream: s, pid: pid})
+	})
+}
+
+func (h *pubsubHost) RemoveStreamHandler(pid protocol.ID) {
+	h.Host.RemoveStreamHandler(h.prefix + pid)
+}
+
+func (h *pubsubHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (inet.Stream, error) {
+	prefixed := make([]protocol.ID, len(pids))
+	for i, pid := range pids {
+		prefixed[i] = h.prefix + pid
+	}
+	s, err := h.Host.NewStream(ctx, p, prefixed...)
+	if err != nil {
+		return nil, err
+	}
+	pid := protocol.ID(strings.TrimPrefix(string(s.Protocol()), string(h.prefix)))
+	return &pubsubStream{Stream: s, pid: pid}, nil
+}
+
+// pubsubStream is a stream on a network prefixed pubsub protocol.
+type pubsubStream struct {
+	inet.Stream
+
+	pid protocol.ID
+}
+
+func (s *pubsubStream) Protocol() protocol.ID {
+	return s.pid
+}
@@ -0,0 +1,93 @@
+package overlaynetwork
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/libp2p/go-libp2p-crypto"
+	"github.com/libp2p/go-libp2p-pubsub"
+	"testing"
+	"time"
+)
+
+func TestPubsubRoutersAreNamespaced(t *testing.T) {
+	for _, router := range []PubsubRouter{PubsubRouterGossipSub, PubsubRouterFloodSub, PubsubRouterRandomSub} {
+		a := newTestNode(t, func(cfg *NodeConfig) { cfg.PubsubRouter = router })
+		b := newTestNode(t, func(cfg *NodeConfig) { cfg.PubsubRouter = router })
+
+		for _, pid := range a.Host.Mux().Protocols() {
+			switch pid {
+			case "/meshsub/1.0.0", "/floodsub/1.0.0", "/randomsub/1.0.0":
+				t.Fatalf("router %d registered un-namespaced protocol %s", router, pid)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		sub, err := b.PubSub.Subscribe(ctx, "namespaced")
+		if err != nil {
+			t.Fatal(err)
+		}
+		connectNodes(t, a, b)
+		ok := waitFor(t, time.Second*10, func() bool {
+			return len(a.PubSub.ListPeers("namespaced")) > 0
+		})
+		if !ok {
+			t.Fatalf("router %d: topic peer not found", router)
+		}
+		if err := a.PubSub.Publish(ctx, "namespaced", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("router %d: %s", router, err)
+		}
+		if string(msg.GetData()) != "hello" {
+			t.Fatalf("router %d: expected hello, got %q", router, msg.GetData())
+		}
+		sub.Cancel()
+		cancel()
+	}
+}
+
+func TestGossipSubParamsValidated(t *testing.T) {
+	d, dlo, dhi := pubsub.GossipSubD, pubsub.GossipSubDlo, pubsub.GossipSubDhi
+	tests := []struct {
+		name   string
+		params GossipSubParams
+		valid  bool
+	}{
+		{"defaults", GossipSubParams{}, true},
+		{"consistent", GossipSubParams{D: d + 1, Dlo: dlo, Dhi: dhi + 2}, true},
+		{"equal", GossipSubParams{D: 3, Dlo: 3, Dhi: 3}, true},
+		{"dlo above d", GossipSubParams{D: 3, Dlo: 4, Dhi: 6}, false},
+		{"d above dhi", GossipSubParams{D: 7, Dlo: 2, Dhi: 6}, false},
+		{"d above default dhi", GossipSubParams{D: dhi + 1}, false},
+		{"negative", GossipSubParams{HeartbeatInterval: -time.Second}, false},
+	}
+	for _, test := range tests {
+		if err := test.params.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got error %v", test.name, test.valid, err)
+		}
+	}
+
+	// A node with inconsistent params fails to start and leaves the libp2p
+	// parameters alone.
+	privKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewOverlayNode(&NodeConfig{
+		PrivateKey:      privKey,
+		Params:          &chaincfg.TestNet3Params,
+		DisableDNSSeeds: true,
+		DatastoreType:   DatastoreInMemory,
+		GossipSubParams: &GossipSubParams{D: 3, Dlo: 4, Dhi: 6},
+	})
+	if err == nil {
+		n.Shutdown()
+		t.Fatal("node started with inconsistent gossipsub params")
+	}
+	if pubsub.GossipSubD != d || pubsub.GossipSubDlo != dlo || pubsub.GossipSubDhi != dhi {
+		t.Fatal("inconsistent gossipsub params applied")
+	}
+}
@@ -0,0 +1,328 @@
+package overlaynetwork
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ggio "github.com/gogo/protobuf/io"
+	"github.com/libp2p/go-libp2p-circuit"
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"sync"
+	"time"
+)
+
+// RelayServiceName is the name relays advertise themselves under in the
+// service registry.
+const RelayServiceName = "circuit-relay"
+
+// relayTag is the connection manager tag which protects our connections to
+// the relays we use.
+const relayTag = "overlay-relay"
+
+var (
+	// DesiredRelays is the number of relays an unreachable node keeps
+	// reservations with.
+	DesiredRelays = 2
+
+	// RelayCheckInterval is how often we check our reachability and
+	// reservations.
+	RelayCheckInterval = time.Minute
+
+	// relayAddrAllowed decides which of a relay's addresses we build our
+	// relayed addresses from.
+	relayAddrAllowed = manet.IsPublicAddr
+)
+
+// RelayConfig holds the limits of the relay service. Zero values use the
+// libp2p defaults.
+//
+// libp2p keeps these limits in package level variables so they apply to every
+// relay in the process. Once a node has set a limit, creating another node
+// which sets it to a different value fails.
+type RelayConfig struct {
+	// MaxCircuits is the max number of connections relayed at once.
+	MaxCircuits int
+
+	// ConnectTimeout is the max amount of time we wait to open a stream to
+	// the destination of a relayed connection.
+	ConnectTimeout time.Duration
+}
+
+// appliedRelayConfig holds the relay limits set by the nodes in this process.
+var (
+	appliedRelayConfig RelayConfig
+	appliedRelayMtx    sync.Mutex
+)
+
+// apply sets the libp2p relay limits. Nothing is changed if the limits are
+// negative or conflict with the ones another node set.
+func (c *RelayConfig) apply() error {
+	if c.MaxCircuits < 0 || c.ConnectTimeout < 0 {
+		return errors.New("relay limits must not be negative")
+	}
+	appliedRelayMtx.Lock()
+	defer appliedRelayMtx.Unlock()
+	applied := &appliedRelayConfig
+	if c.MaxCircuits > 0 && applied.MaxCircuits > 0 && c.MaxCircuits != applied.MaxCircuits {
+		return fmt.Errorf("relay MaxCircuits %d conflicts with %d set by another node", c.MaxCircuits, applied.MaxCircuits)
+	}
+	if c.ConnectTimeout > 0 && applied.ConnectTimeout > 0 && c.ConnectTimeout != applied.ConnectTimeout {
+		return fmt.Errorf("relay ConnectTimeout %s conflicts with %s set by another node", c.ConnectTimeout, applied.ConnectTimeout)
+	}
+	if c.MaxCircuits > 0 {
+		relay.HopStreamLimit = c.MaxCircuits
+		applied.MaxCircuits = c.MaxCircuits
+	}
+	if c.ConnectTimeout > 0 {
+		relay.HopConnectTimeout = c.ConnectTimeout
+		applied.ConnectTimeout = c.ConnectTimeout
+	}
+	return nil
+}
+
+// relayReservation is a relay we use. The relay only relays connections to
+// peers which are connected to it, so the reservation is our connection to
+// the relay, which we protect in the connection manager.
+type relayReservation struct {
+	addrs []ma.Multiaddr
+}
+
+// relayManager keeps reservations with relays while we aren't publicly
+// reachable and adds the relayed addresses to the addresses we advertise.
+type relayManager struct {
+	n            *OverlayNode
+	enabled      bool
+	reservations map[peer.ID]*relayReservation
+	mtx          sync.RWMutex
+}
+
+func newRelayManager(enabled bool) *relayManager {
+	return &relayManager{
+		enabled:      enabled,
+		reservations: make(map[peer.ID]*relayReservation),
+	}
+}
+
+// addrsFactory is passed to libp2p to add our relayed addresses to the
+// addresses we advertise.
+func (rm *relayManager) addrsFactory(addrs []ma.Multiaddr) []ma.Multiaddr {
+	rm.mtx.RLock()
+	defer rm.mtx.RUnlock()
+	if len(rm.reservations) == 0 {
+		return addrs
+	}
+	out := append([]ma.Multiaddr(nil), addrs...)
+	for _, rsvp := range rm.reservations {
+		out = append(out, rsvp.addrs...)
+	}
+	return out
+}
+
+// run keeps reservations with DesiredRelays relays while we aren't publicly
+// reachable. Relays are found through the service registry.
+func (rm *relayManager) run(ctx context.Context) {
+	if !rm.enabled {
+		return
+	}
+	ticker := time.NewTicker(RelayCheckInterval)
+	defer ticker.Stop()
+	for {
+		rm.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (rm *relayManager) check(ctx context.Context) {
+	if rm.n.Reachability() == ReachabilityPublic {
+		rm.mtx.RLock()
+		var drop []peer.ID
+		for p := range rm.reservations {
+			drop = append(drop, p)
+		}
+		rm.mtx.RUnlock()
+		if len(drop) > 0 {
+			log.Infof("publicly reachable, dropping %d relay reservations", len(drop))
+		}
+		for _, p := range drop {
+			rm.release(p)
+		}
+		return
+	}
+
+	// Drop the reservations whose relay we lost the connection to.
+	rm.mtx.RLock()
+	var lost []peer.ID
+	for p := range rm.reservations {
+		if rm.n.Host.Network().Connectedness(p) != inet.Connected {
+			lost = append(lost, p)
+		}
+	}
+	have := len(rm.reservations) - len(lost)
+	rm.mtx.RUnlock()
+	for _, p := range lost {
+		rm.release(p)
+	}
+	if have >= DesiredRelays {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RelayCheckInterval)
+	defer cancel()
+	relays, err := rm.n.FindService(ctx, RelayServiceName, DesiredRelays*2)
+	if err != nil {
+		log.Debugf("relay: failed to find relays: %s", err)
+		return
+	}
+	for _, pi := range relays {
+		if have >= DesiredRelays {
+			return
+		}
+		rm.mtx.RLock()
+		_, ok := rm.reservations[pi.ID]
+		rm.mtx.RUnlock()
+		if ok {
+			continue
+		}
+		if rm.reserve(ctx, pi.ID) {
+			have++
+		}
+	}
+}
+
+// reserve checks that the peer relays connections for us and starts using it
+// as a relay.
+func (rm *relayManager) reserve(ctx context.Context, p peer.ID) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	if err := canHop(ctx, rm.n.Host, p); err != nil {
+		log.Debugf("relay: %s won't relay for us: %s", p, err)
+		return false
+	}
+
+	circuit, err := ma.NewMultiaddr("/p2p/" + p.Pretty() + "/p2p-circuit")
+	if err != nil {
+		return false
+	}
+	var addrs []ma.Multiaddr
+	for _, addr := range rm.n.Host.Peerstore().Addrs(p) {
+		if relayAddrAllowed(addr) {
+			addrs = append(addrs, addr.Encapsulate(circuit))
+		}
+	}
+	if len(addrs) == 0 {
+		return false
+	}
+
+	rm.n.Host.ConnManager().TagPeer(p, relayTag, 42)
+	rm.mtx.Lock()
+	rm.reservations[p] = &relayReservation{addrs: addrs}
+	rm.mtx.Unlock()
+	log.Debugf("relay: using %s as a relay", p)
+	return true
+}
+
+// release stops using the relay. The connection is no longer protected in the
+// connection manager but we don't close it, we may still be talking to the
+// relay or be connected to peers through it.
+func (rm *relayManager) release(p peer.ID) {
+	rm.mtx.Lock()
+	_, ok := rm.reservations[p]
+	delete(rm.reservations, p)
+	rm.mtx.Unlock()
+	if !ok {
+		return
+	}
+	rm.n.Host.ConnManager().UntagPeer(p, relayTag)
+	log.Debugf("relay: released %s", p)
+}
+
+// canHop asks the peer whether it relays connections for us.
+func canHop(ctx context.Context, h host.Host, p peer.ID) error {
+	s, err := h.NewStream(ctx, p, relay.ProtoID)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	msg := &pb.CircuitRelay{Type: pb.CircuitRelay_CAN_HOP.Enum()}
+	if err := ggio.NewDelimitedWriter(s).WriteMsg(msg); err != nil {
+		s.Reset()
+		return err
+	}
+	msg.Reset()
+	if err := ggio.NewDelimitedReader(s, 4096).ReadMsg(msg); err != nil {
+		s.Reset()
+		return err
+	}
+	inet.FullClose(s)
+
+	if msg.GetType() != pb.CircuitRelay_STATUS || msg.GetCode() != pb.CircuitRelay_SUCCESS {
+		return errors.New("relay refused hop")
+	}
+	return nil
+}
+
+// Relays returns the relays we currently hold reservations with.
+func (n *OverlayNode) Relays() []peer.ID {
+	n.relays.mtx.RLock()
+	defer n.relays.mtx.RUnlock()
+	relays := make([]peer.ID, 0, len(n.relays.reservations))
+	for p := range n.relays.reservations {
+		relays = append(relays, p)
+	}
+	return relays
+}
+
+// relayAdvertiser advertises the relay service in the service registry while
+// we are publicly reachable. Peers behind a NAT can't be dialed through us so
+// there is no point in advertising the relay until AutoNAT, or our addresses,
+// tell us we are reachable.
+type relayAdvertiser struct {
+	n           *OverlayNode
+	advertising bool
+}
+
+// check starts or stops advertising the relay service if our reachability
+// changed.
+func (ra *relayAdvertiser) check(ctx context.Context) {
+	public := ra.n.Reachability() == ReachabilityPublic
+	switch {
+	case public && !ra.advertising:
+		if err := ra.n.Advertise(ctx, RelayServiceName, 0); err != nil {
+			log.Warnf("failed to advertise relay service: %s", err)
+			return
+		}
+		ra.advertising = true
+	case !public && ra.advertising:
+		if err := ra.n.StopAdvertising(RelayServiceName); err != nil {
+			log.Debugf("failed to stop advertising relay service: %s", err)
+		}
+		ra.advertising = false
+	}
+}
+
+// run checks our reachability every RelayCheckInterval until the context is
+// cancelled.
+func (ra *relayAdvertiser) run(ctx context.Context) {
+	ticker := time.NewTicker(RelayCheckInterval)
+	defer ticker.Stop()
+	for {
+		ra.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
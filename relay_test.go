@@ -0,0 +1,201 @@
+package overlaynetwork
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/gcash/bchd/chaincfg"
+	"github.com/libp2p/go-libp2p-autonat"
+	"github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-crypto"
+	"github.com/libp2p/go-libp2p-kad-dht"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// TestRelayEndToEnd connects a dialer to a node which is only reachable
+// through a relay.
+func TestRelayEndToEnd(t *testing.T) {
+	// Our test nodes only listen on private addresses.
+	allowed := relayAddrAllowed
+	relayAddrAllowed = func(ma.Multiaddr) bool { return true }
+	defer func() { relayAddrAllowed = allowed }()
+
+	relayNode := newTestNode(t, func(cfg *NodeConfig) { cfg.RelayService = &RelayConfig{} })
+	private := newTestNode(t, func(cfg *NodeConfig) { cfg.AutoRelay = true })
+	dialer := newTestNode(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	connectNodes(t, private, relayNode)
+	if !private.relays.reserve(ctx, relayNode.Host.ID()) {
+		t.Fatal("reservation with relay failed")
+	}
+	if relays := private.Relays(); len(relays) != 1 || relays[0] != relayNode.Host.ID() {
+		t.Fatalf("expected relay %s, got %v", relayNode.Host.ID(), relays)
+	}
+
+	// The relayed addresses are advertised and are the only ones the
+	// dialer knows for the private node.
+	var relayed []ma.Multiaddr
+	for _, addr := range private.Host.Addrs() {
+		if isRelayedAddr(addr) {
+			relayed = append(relayed, addr)
+		}
+	}
+	if len(relayed) == 0 {
+		t.Fatal("no relayed addresses advertised")
+	}
+
+	const echoProtocol = "/overlay/test/echo"
+	private.Host.SetStreamHandler(echoProtocol, func(s inet.Stream) {
+		defer s.Close()
+		io.Copy(s, s)
+	})
+
+	pi := peerstore.PeerInfo{ID: private.Host.ID(), Addrs: relayed}
+	if err := dialer.Host.Connect(ctx, pi); err != nil {
+		t.Fatalf("failed to dial through relay: %s", err)
+	}
+	for _, c := range dialer.Host.Network().ConnsToPeer(private.Host.ID()) {
+		if !isRelayedAddr(c.RemoteMultiaddr()) {
+			t.Fatalf("expected a relayed connection, got %s", c.RemoteMultiaddr())
+		}
+	}
+
+	s, err := dialer.Host.NewStream(ctx, private.Host.ID(), echoProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	resp, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "ping" {
+		t.Fatalf("expected ping, got %q", resp)
+	}
+
+	// Releasing the reservation stops advertising the relayed addresses
+	// but leaves the connections open.
+	private.relays.release(relayNode.Host.ID())
+	if len(private.Relays()) != 0 {
+		t.Fatal("relay not released")
+	}
+	for _, addr := range private.Host.Addrs() {
+		if isRelayedAddr(addr) {
+			t.Fatalf("relayed address %s still advertised", addr)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	if relayNode.Host.Network().Connectedness(private.Host.ID()) != inet.Connected {
+		t.Fatal("connection to the relay closed after releasing it")
+	}
+	if dialer.Host.Network().Connectedness(private.Host.ID()) != inet.Connected {
+		t.Fatal("relayed connection closed after releasing the relay")
+	}
+}
+
+func TestRelayConfigConflict(t *testing.T) {
+	applied := appliedRelayConfig
+	streamLimit, connectTimeout := relay.HopStreamLimit, relay.HopConnectTimeout
+	defer func() {
+		appliedRelayConfig = applied
+		relay.HopStreamLimit, relay.HopConnectTimeout = streamLimit, connectTimeout
+	}()
+	appliedRelayConfig = RelayConfig{}
+
+	tests := []struct {
+		name  string
+		cfg   RelayConfig
+		valid bool
+	}{
+		{"first", RelayConfig{MaxCircuits: 10}, true},
+		{"same", RelayConfig{MaxCircuits: 10, ConnectTimeout: time.Second}, true},
+		{"defaults", RelayConfig{}, true},
+		{"other max circuits", RelayConfig{MaxCircuits: 20}, false},
+		{"other connect timeout", RelayConfig{MaxCircuits: 10, ConnectTimeout: time.Minute}, false},
+		{"negative", RelayConfig{MaxCircuits: -1}, false},
+	}
+	for _, test := range tests {
+		if err := test.cfg.apply(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%v, got %v", test.name, test.valid, err)
+		}
+	}
+	if relay.HopStreamLimit != 10 || relay.HopConnectTimeout != time.Second {
+		t.Fatalf("conflicting relay limits applied: %d %s", relay.HopStreamLimit, relay.HopConnectTimeout)
+	}
+
+	// A node which conflicts with the limits another node set isn't
+	// created.
+	privKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewOverlayNode(&NodeConfig{
+		PrivateKey:      privKey,
+		Params:          &chaincfg.TestNet3Params,
+		DisableDNSSeeds: true,
+		DatastoreType:   DatastoreInMemory,
+		RelayService:    &RelayConfig{MaxCircuits: 20},
+	})
+	if err == nil {
+		n.Shutdown()
+		t.Fatal("node started with conflicting relay limits")
+	}
+}
+
+func TestRelayAdvertisedOnlyWhenPublic(t *testing.T) {
+	relayNode := newTestNode(t, func(cfg *NodeConfig) {
+		cfg.RelayService = &RelayConfig{}
+		cfg.DHTMode = DHTModeServer
+	})
+	other := newTestNode(t, func(cfg *NodeConfig) { cfg.DHTMode = DHTModeServer })
+	connectNodes(t, relayNode, other)
+
+	// The relay needs a DHT peer to provide the service to.
+	ok := waitFor(t, time.Second*10, func() bool {
+		return relayNode.Routing.(*dht.IpfsDHT).RoutingTable().Size() > 0
+	})
+	if !ok {
+		t.Fatal("dht peer not added to the routing table")
+	}
+
+	nat := &fakeAutoNAT{status: autonat.NATStatusPrivate}
+	relayNode.nat.autoNAT = nat
+	advertised := func() bool {
+		relayNode.services.mtx.Lock()
+		defer relayNode.services.mtx.Unlock()
+		_, ok := relayNode.services.advertised[RelayServiceName]
+		return ok
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	ra := &relayAdvertiser{n: relayNode}
+
+	ra.check(ctx)
+	if advertised() {
+		t.Fatal("relay advertised while private")
+	}
+
+	nat.setStatus(autonat.NATStatusPublic)
+	ra.check(ctx)
+	if !advertised() {
+		t.Fatal("relay not advertised while public")
+	}
+
+	nat.setStatus(autonat.NATStatusPrivate)
+	ra.check(ctx)
+	if advertised() {
+		t.Fatal("relay still advertised after becoming private")
+	}
+}
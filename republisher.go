@@ -0,0 +1,261 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-routing"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultRepublishInterval is the default interval at which published records
+	// are re-put to the DHT. The DHT drops records older than 36 hours so this
+	// needs to be comfortably lower than that.
+	DefaultRepublishInterval = time.Hour * 12
+
+	// RepublishTimeout is the max amount of time we will wait for a single
+	// record to be put to the DHT.
+	RepublishTimeout = time.Minute * 2
+
+	// ErrRecordNotPublished is returned when trying to unpublish a record that
+	// is not being tracked by the republisher.
+	ErrRecordNotPublished = errors.New("record not published by this node")
+
+	// republisherPrefix is the datastore prefix under which we save the records
+	// that we are tracking.
+	republisherPrefix = datastore.NewKey("/overlay/published")
+)
+
+// RepublishEvent is sent on the republisher's event channel whenever a record
+// fails to be republished.
+type RepublishEvent struct {
+	// Key is the DHT key of the record.
+	Key string
+
+	// Err is the error returned while putting the record.
+	Err error
+
+	// Time is the time of the failure.
+	Time time.Time
+}
+
+// publishedRecord is the record we save to the datastore for each value
+// being republished.
+type publishedRecord struct {
+	Key           string    `json:"key"`
+	Value         []byte    `json:"value"`
+	Published     time.Time `json:"published"`
+	LastRepublish time.Time `json:"lastRepublish"`
+	Expiration    time.Time `json:"expiration"`
+}
+
+func (r *publishedRecord) expired(now time.Time) bool {
+	return !r.Expiration.IsZero() && now.After(r.Expiration)
+}
+
+// Republisher tracks the records this node has published to the DHT and
+// periodically re-puts them so they don't get lost as nodes leave the network.
+// The records are persisted in the datastore so they survive restarts.
+type Republisher struct {
+	ds       datastore.Datastore
+	rt       routing.ValueStore
+	interval time.Duration
+	events   chan RepublishEvent
+	mtx      sync.Mutex
+}
+
+// NewRepublisher returns a new Republisher which will save records to the
+// provided datastore and put them using the provided routing. If interval is
+// zero DefaultRepublishInterval is used.
+func NewRepublisher(ds datastore.Datastore, rt routing.ValueStore, interval time.Duration) *Republisher {
+	if interval == 0 {
+		interval = DefaultRepublishInterval
+	}
+	return &Republisher{
+		ds:       ds,
+		rt:       rt,
+		interval: interval,
+		events:   make(chan RepublishEvent, 32),
+	}
+}
+
+// Publish puts the value to the DHT and tracks it for republishing. A ttl of
+// zero means the record will be republished until it is unpublished. Otherwise
+// we will stop republishing the record after the ttl has passed.
+func (r *Republisher) Publish(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := r.rt.PutValue(ctx, key, value); err != nil {
+		return err
+	}
+	now := time.Now()
+	rec := &publishedRecord{
+		Key:           key,
+		Value:         value,
+		Published:     now,
+		LastRepublish: now,
+	}
+	if ttl > 0 {
+		rec.Expiration = now.Add(ttl)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.save(rec)
+}
+
+// Unpublish stops republishing the record for the given key. The record will
+// remain in the DHT until it expires on the nodes storing it.
+func (r *Republisher) Unpublish(key string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	dsKey := republisherKey(key)
+	has, err := r.ds.Has(dsKey)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return ErrRecordNotPublished
+	}
+	return r.ds.Delete(dsKey)
+}
+
+// Published returns the list of keys currently being republished.
+func (r *Republisher) Published() ([]string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	recs, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		keys = append(keys, rec.Key)
+	}
+	return keys, nil
+}
+
+// Events returns a channel on which republish failures are reported. Events
+// are dropped if the channel is not being read from.
+func (r *Republisher) Events() <-chan RepublishEvent {
+	return r.events
+}
+
+// Run republishes the records once at startup and then on each interval until
+// the context is cancelled.
+func (r *Republisher) Run(ctx context.Context) {
+	r.republish(ctx)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.republish(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// republish re-puts every record which is due for republishing and removes
+// the records whose ttl has passed.
+func (r *Republisher) republish(ctx context.Context) {
+	r.mtx.Lock()
+	recs, err := r.load()
+	r.mtx.Unlock()
+	if err != nil {
+		log.Errorf("republisher: failed to load records: %s", err)
+		return
+	}
+
+	for _, rec := range recs {
+		now := time.Now()
+		if rec.expired(now) {
+			log.Debugf("republisher: record %s expired", rec.Key)
+			r.mtx.Lock()
+			if err := r.ds.Delete(republisherKey(rec.Key)); err != nil {
+				log.Errorf("republisher: failed to delete record %s: %s", rec.Key, err)
+			}
+			r.mtx.Unlock()
+			continue
+		}
+		// Only republish records which will go stale before the next round.
+		if now.Sub(rec.LastRepublish) < r.interval/2 {
+			continue
+		}
+
+		putCtx, cancel := context.WithTimeout(ctx, RepublishTimeout)
+		err := r.rt.PutValue(putCtx, rec.Key, rec.Value)
+		cancel()
+		if err != nil {
+			log.Warnf("republisher: failed to republish %s: %s", rec.Key, err)
+			r.notify(RepublishEvent{Key: rec.Key, Err: err, Time: now})
+			continue
+		}
+
+		r.mtx.Lock()
+		// The record may have been unpublished while we were putting it.
+		has, err := r.ds.Has(republisherKey(rec.Key))
+		if err == nil && has {
+			rec.LastRepublish = now
+			err = r.save(rec)
+		}
+		r.mtx.Unlock()
+		if err != nil {
+			log.Errorf("republisher: failed to save record %s: %s", rec.Key, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (r *Republisher) notify(event RepublishEvent) {
+	select {
+	case r.events <- event:
+	default:
+	}
+}
+
+func (r *Republisher) save(rec *publishedRecord) error {
+	ser, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return r.ds.Put(republisherKey(rec.Key), ser)
+}
+
+func (r *Republisher) load() ([]*publishedRecord, error) {
+	res, err := r.ds.Query(query.Query{Prefix: republisherPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*publishedRecord, 0, len(entries))
+	for _, entry := range entries {
+		rec := new(publishedRecord)
+		if err := json.Unmarshal(entry.Value, rec); err != nil {
+			log.Errorf("republisher: corrupt record at %s: %s", entry.Key, err)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// rawBase32 is the unpadded base32 encoding we use to turn arbitrary strings
+// into datastore key names.
+var rawBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func republisherKey(key string) datastore.Key {
+	return republisherPrefix.ChildString(rawBase32.EncodeToString([]byte(key)))
+}
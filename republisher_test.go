@@ -0,0 +1,138 @@
+package overlaynetwork
+
+import (
+	"context"
+	"errors"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-routing"
+	ropts "github.com/libp2p/go-libp2p-routing/options"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeValueStore counts the puts for each key. Only PutValue is implemented.
+type fakeValueStore struct {
+	routing.ValueStore
+
+	err  error
+	puts map[string]int
+	mtx  sync.Mutex
+}
+
+func (f *fakeValueStore) PutValue(ctx context.Context, key string, value []byte, opts ...ropts.Option) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.puts == nil {
+		f.puts = make(map[string]int)
+	}
+	f.puts[key]++
+	return f.err
+}
+
+func (f *fakeValueStore) count(key string) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.puts[key]
+}
+
+func runRepublisher(t *testing.T, r *Republisher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestRepublisherRepublishesOnInterval(t *testing.T) {
+	rt := new(fakeValueStore)
+	r := NewRepublisher(dssync.MutexWrap(datastore.NewMapDatastore()), rt, time.Millisecond*50)
+	if err := r.Publish(context.Background(), "/v/key", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	runRepublisher(t, r)
+	if !waitFor(t, time.Second*5, func() bool { return rt.count("/v/key") >= 4 }) {
+		t.Fatalf("record put %d times, want at least 4", rt.count("/v/key"))
+	}
+}
+
+func TestRepublisherStopsAfterTTL(t *testing.T) {
+	rt := new(fakeValueStore)
+	r := NewRepublisher(dssync.MutexWrap(datastore.NewMapDatastore()), rt, time.Millisecond*20)
+	if err := r.Publish(context.Background(), "/v/key", []byte("value"), time.Millisecond*100); err != nil {
+		t.Fatal(err)
+	}
+	runRepublisher(t, r)
+	if !waitFor(t, time.Second*5, func() bool {
+		keys, err := r.Published()
+		return err == nil && len(keys) == 0
+	}) {
+		t.Fatal("expired record still tracked")
+	}
+	puts := rt.count("/v/key")
+	time.Sleep(time.Millisecond * 100)
+	if rt.count("/v/key") != puts {
+		t.Fatal("expired record republished")
+	}
+}
+
+func TestRepublisherUnpublish(t *testing.T) {
+	rt := new(fakeValueStore)
+	r := NewRepublisher(dssync.MutexWrap(datastore.NewMapDatastore()), rt, time.Millisecond*20)
+	ctx := context.Background()
+	if err := r.Publish(ctx, "/v/a", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Publish(ctx, "/v/b", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Unpublish("/v/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Unpublish("/v/a"); err != ErrRecordNotPublished {
+		t.Fatalf("expected ErrRecordNotPublished, got %v", err)
+	}
+	keys, err := r.Published()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "/v/b" {
+		t.Fatalf("unexpected published keys %v", keys)
+	}
+
+	runRepublisher(t, r)
+	if !waitFor(t, time.Second*5, func() bool { return rt.count("/v/b") >= 3 }) {
+		t.Fatal("remaining record not republished")
+	}
+	if rt.count("/v/a") != 1 {
+		t.Fatalf("unpublished record put %d times", rt.count("/v/a"))
+	}
+}
+
+func TestRepublisherReportsFailures(t *testing.T) {
+	rt := new(fakeValueStore)
+	r := NewRepublisher(dssync.MutexWrap(datastore.NewMapDatastore()), rt, time.Millisecond*20)
+	if err := r.Publish(context.Background(), "/v/key", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	errPut := errors.New("put failed")
+	rt.mtx.Lock()
+	rt.err = errPut
+	rt.mtx.Unlock()
+
+	runRepublisher(t, r)
+	select {
+	case event := <-r.Events():
+		if event.Key != "/v/key" || event.Err != errPut {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no failure event")
+	}
+}
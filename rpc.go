@@ -0,0 +1,466 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gcash/overlaynetwork/framing"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-protocol"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRPCMessageTooLarge is returned when an RPC request or response is
+	// larger than the max message size.
+	ErrRPCMessageTooLarge = framing.ErrFrameTooLarge
+
+	// ErrUnknownMethod is returned when calling a method which the service
+	// does not have.
+	ErrUnknownMethod = errors.New("unknown rpc method")
+)
+
+const (
+	rpcStatusOK    = 0
+	rpcStatusError = 1
+)
+
+// RPCError is an error returned by the remote handler.
+type RPCError struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *RPCError) Error() string {
+	return "rpc: " + e.Message
+}
+
+// RPCHandler handles a call to an RPC method. The request is decoded by
+// calling decode with a pointer to the request value. The returned value is
+// encoded and sent back as the response. If an error is returned its message
+// is sent back to the caller as an RPCError.
+type RPCHandler func(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error)
+
+// RPCOpts holds the options for an RPC service or client. Both sides of a
+// service must use the same codec.
+type RPCOpts struct {
+	// Codec is used to encode requests and responses. Defaults to JSONCodec.
+	Codec Codec
+
+	// MaxMessageSize is the max size of a request or response. Defaults to
+	// DefaultRPCMaxMessageSize.
+	MaxMessageSize int
+
+	// Timeout is the max amount of time a call may take if the context
+	// doesn't have a deadline. Defaults to DefaultRPCTimeout.
+	Timeout time.Duration
+
+	// IdleTimeout is how long an idle stream is kept open for reuse.
+	// Defaults to DefaultRPCIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+var (
+	// DefaultRPCMaxMessageSize is the default max size of an RPC message.
+	DefaultRPCMaxMessageSize = 1 << 20
+
+	// DefaultRPCTimeout is the default max amount of time an RPC call may take.
+	DefaultRPCTimeout = time.Second * 30
+
+	// DefaultRPCIdleTimeout is the default amount of time an idle RPC stream
+	// is kept open.
+	DefaultRPCIdleTimeout = time.Minute
+)
+
+func (o *RPCOpts) withDefaults() RPCOpts {
+	var opts RPCOpts
+	if o != nil {
+		opts = *o
+	}
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec
+	}
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = DefaultRPCMaxMessageSize
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultRPCTimeout
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultRPCIdleTimeout
+	}
+	return opts
+}
+
+// rpcService serves the methods registered under a protocol ID.
+type rpcService struct {
+	handlers map[string]RPCHandler
+	opts     RPCOpts
+}
+
+// RegisterService registers the handlers as an RPC service on the protocol ID.
+// Each request is framed with a varint length prefix and identifies the
+// method by name. Callers may reuse a stream for multiple calls.
+func (n *OverlayNode) RegisterService(pid protocol.ID, handlers map[string]RPCHandler, opts *RPCOpts) {
+	svc := &rpcService{
+		handlers: handlers,
+		opts:     opts.withDefaults(),
+	}
+	n.Host.SetStreamHandler(pid, func(s inet.Stream) {
+		svc.serve(n.ctx, s)
+	})
+}
+
+// serve handles the requests on the stream until the caller closes it or it
+// has been idle for the IdleTimeout.
+func (svc *rpcService) serve(ctx context.Context, stream inet.Stream) {
+	from := stream.Conn().RemotePeer()
+	s := framing.NewStream(stream, svc.opts.MaxMessageSize)
+	s.ReadTimeout = svc.opts.IdleTimeout
+	s.WriteTimeout = svc.opts.Timeout
+	for {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				s.Close()
+			} else {
+				log.Debugf("rpc: error reading request from %s: %s", from, err)
+				s.Reset()
+			}
+			return
+		}
+		id, method, body, err := decodeRPCRequest(frame)
+		if err != nil {
+			framing.Put(frame)
+			log.Debugf("rpc: malformed request from %s: %s", from, err)
+			s.Reset()
+			return
+		}
+
+		resp, err := svc.call(ctx, from, method, body)
+		framing.Put(frame)
+		var out []byte
+		if err != nil {
+			out = encodeRPCResponse(id, rpcStatusError, []byte(err.Error()))
+		} else {
+			out = encodeRPCResponse(id, rpcStatusOK, resp)
+		}
+		if len(out) > svc.opts.MaxMessageSize {
+			out = encodeRPCResponse(id, rpcStatusError, []byte(ErrRPCMessageTooLarge.Error()))
+		}
+		if err := s.WriteFrame(out); err != nil {
+			log.Debugf("rpc: error writing response to %s: %s", from, err)
+			s.Reset()
+			return
+		}
+	}
+}
+
+func (svc *rpcService) call(ctx context.Context, from peer.ID, method string, body []byte) (resp []byte, err error) {
+	handler, ok := svc.handlers[method]
+	if !ok {
+		return nil, ErrUnknownMethod
+	}
+	ctx, cancel := context.WithTimeout(ctx, svc.opts.Timeout)
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("rpc: panic in handler for %s: %v", method, r)
+			err = errors.New("internal error")
+		}
+	}()
+	v, err := handler(ctx, from, func(v interface{}) error {
+		return svc.opts.Codec.Unmarshal(body, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return svc.opts.Codec.Marshal(v)
+}
+
+// RPCClient calls the methods of an RPC service on other peers. Streams are
+// kept open and reused for subsequent calls to the same peer.
+type RPCClient struct {
+	host   host.Host
+	pid    protocol.ID
+	opts   RPCOpts
+	nextID uint64
+	idle   map[peer.ID][]*rpcStream
+	closed bool
+	cancel context.CancelFunc
+	mtx    sync.Mutex
+}
+
+type rpcStream struct {
+	s    *framing.Stream
+	used time.Time
+}
+
+// RPCClient returns a client for the RPC service on the protocol ID. The
+// client should be closed with Close when it is no longer used.
+func (n *OverlayNode) RPCClient(pid protocol.ID, opts *RPCOpts) *RPCClient {
+	ctx, cancel := context.WithCancel(n.ctx)
+	c := &RPCClient{
+		host:   n.Host,
+		pid:    pid,
+		opts:   opts.withDefaults(),
+		idle:   make(map[peer.ID][]*rpcStream),
+		cancel: cancel,
+	}
+	go c.reapIdle(ctx)
+	return c
+}
+
+// Call calls the method on the peer with the request and decodes the response
+// into resp, which must be a pointer. If the remote handler returns an error
+// it is returned as an *RPCError.
+func (c *RPCClient) Call(ctx context.Context, p peer.ID, method string, req, resp interface{}) error {
+	body, err := c.opts.Codec.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	c.nextID++
+	id := c.nextID
+	c.mtx.Unlock()
+
+	frame := encodeRPCRequest(id, method, body)
+	if len(frame) > c.opts.MaxMessageSize {
+		return ErrRPCMessageTooLarge
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	rs, reused, err := c.getStream(ctx, p)
+	if err != nil {
+		return err
+	}
+	respFrame, reusable, err := rs.roundTrip(ctx, frame, deadline)
+	if err != nil && reused && ctx.Err() == nil && time.Now().Before(deadline) {
+		// The server closes streams which have been idle for its
+		// IdleTimeout, which may be shorter than ours. It only does so
+		// between requests so a pooled stream which fails straight away
+		// never delivered the request and we retry once on a new stream.
+		log.Debugf("rpc: pooled stream to %s failed, retrying on a new stream: %s", p, err)
+		rs, err = c.newStream(ctx, p)
+		if err != nil {
+			return err
+		}
+		respFrame, reusable, err = rs.roundTrip(ctx, frame, deadline)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// The stream's deadline may pass just before the context's.
+		if !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+	defer framing.Put(respFrame)
+	respID, status, respBody, err := decodeRPCResponse(respFrame)
+	if err != nil || respID != id {
+		rs.s.Reset()
+		return errors.New("rpc: malformed response")
+	}
+	if reusable {
+		c.putStream(p, rs)
+	}
+
+	if status != rpcStatusOK {
+		return &RPCError{Message: string(respBody)}
+	}
+	return c.opts.Codec.Unmarshal(respBody, resp)
+}
+
+// roundTrip writes the request frame to the stream and reads the response
+// frame. The stream is reset if either fails or the context is done first,
+// in which case it must not be reused.
+func (rs *rpcStream) roundTrip(ctx context.Context, frame []byte, deadline time.Time) (resp []byte, reusable bool, err error) {
+	rs.s.SetDeadline(deadline)
+
+	// Reset the stream if the context is cancelled so that the read
+	// below returns.
+	stop := resetOnDone(ctx, rs.s)
+	if err := rs.s.WriteFrame(frame); err != nil {
+		stop()
+		rs.s.Reset()
+		return nil, false, err
+	}
+	resp, err = rs.s.ReadFrame()
+	if err != nil {
+		stop()
+		rs.s.Reset()
+		return nil, false, err
+	}
+	// The context may have been cancelled after we read the response, in
+	// which case the stream was reset and can't be reused.
+	return resp, !stop(), nil
+}
+
+// resetOnDone resets the stream if the context is done before stop is called.
+// stop returns whether the stream was reset. Once it returns the stream is
+// no longer watched.
+func resetOnDone(ctx context.Context, s *framing.Stream) (stop func() bool) {
+	done := make(chan struct{})
+	reset := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Reset()
+			reset <- true
+		case <-done:
+			reset <- false
+		}
+	}()
+	var (
+		once     sync.Once
+		wasReset bool
+	)
+	return func() bool {
+		once.Do(func() {
+			close(done)
+			wasReset = <-reset
+		})
+		return wasReset
+	}
+}
+
+// getStream returns an idle stream to the peer or opens a new one. reused is
+// set if the stream was taken from the idle pool.
+func (c *RPCClient) getStream(ctx context.Context, p peer.ID) (rs *rpcStream, reused bool, err error) {
+	c.mtx.Lock()
+	if streams := c.idle[p]; len(streams) > 0 {
+		rs := streams[len(streams)-1]
+		c.idle[p] = streams[:len(streams)-1]
+		c.mtx.Unlock()
+		return rs, true, nil
+	}
+	c.mtx.Unlock()
+
+	rs, err = c.newStream(ctx, p)
+	return rs, false, err
+}
+
+// newStream opens a new stream to the peer.
+func (c *RPCClient) newStream(ctx context.Context, p peer.ID) (*rpcStream, error) {
+	s, err := c.host.NewStream(ctx, p, c.pid)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcStream{s: framing.NewStream(s, c.opts.MaxMessageSize)}, nil
+}
+
+// putStream returns the stream to the idle pool, or closes it if the client
+// was closed.
+func (c *RPCClient) putStream(p peer.ID, rs *rpcStream) {
+	rs.s.SetDeadline(time.Time{})
+	rs.used = time.Now()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		go rs.s.Close()
+		return
+	}
+	c.idle[p] = append(c.idle[p], rs)
+}
+
+// reapIdle closes the streams which have been idle for longer than the
+// IdleTimeout.
+func (c *RPCClient) reapIdle(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-c.opts.IdleTimeout / 2)
+			c.mtx.Lock()
+			for p, streams := range c.idle {
+				var keep []*rpcStream
+				for _, rs := range streams {
+					if rs.used.Before(cutoff) {
+						go rs.s.Close()
+					} else {
+						keep = append(keep, rs)
+					}
+				}
+				if len(keep) == 0 {
+					delete(c.idle, p)
+				} else {
+					c.idle[p] = keep
+				}
+			}
+			c.mtx.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close closes all the idle streams and stops reaping them. Streams used by
+// calls in progress are closed when the calls return.
+func (c *RPCClient) Close() {
+	c.cancel()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closed = true
+	for p, streams := range c.idle {
+		for _, rs := range streams {
+			go rs.s.Close()
+		}
+		delete(c.idle, p)
+	}
+}
+
+func encodeRPCRequest(id uint64, method string, body []byte) []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(method)+len(body))
+	n := binary.PutUvarint(buf, id)
+	n += binary.PutUvarint(buf[n:], uint64(len(method)))
+	n += copy(buf[n:], method)
+	n += copy(buf[n:], body)
+	return buf[:n]
+}
+
+func decodeRPCRequest(frame []byte) (uint64, string, []byte, error) {
+	id, n := binary.Uvarint(frame)
+	if n <= 0 {
+		return 0, "", nil, errors.New("invalid request id")
+	}
+	frame = frame[n:]
+	l, n := binary.Uvarint(frame)
+	if n <= 0 || uint64(len(frame)-n) < l {
+		return 0, "", nil, errors.New("invalid method")
+	}
+	frame = frame[n:]
+	return id, string(frame[:l]), frame[l:], nil
+}
+
+func encodeRPCResponse(id uint64, status byte, body []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+1+len(body))
+	n := binary.PutUvarint(buf, id)
+	buf[n] = status
+	n++
+	n += copy(buf[n:], body)
+	return buf[:n]
+}
+
+func decodeRPCResponse(frame []byte) (uint64, byte, []byte, error) {
+	id, n := binary.Uvarint(frame)
+	if n <= 0 || len(frame) <= n {
+		return 0, 0, nil, fmt.Errorf("invalid response")
+	}
+	return id, frame[n], frame[n+1:], nil
+}
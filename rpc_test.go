@@ -0,0 +1,169 @@
+package overlaynetwork
+
+import (
+	"context"
+	"errors"
+	"github.com/libp2p/go-libp2p-peer"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRPCProtocol = "/overlay/test/rpc"
+
+// newRPCTestNodes returns a client node and a server node serving the test
+// RPC service. The block method blocks until its context is done.
+func newRPCTestNodes(t *testing.T) (*OverlayNode, *OverlayNode) {
+	client, server := newTestNode(t, nil), newTestNode(t, nil)
+	server.RegisterService(testRPCProtocol, map[string]RPCHandler{
+		"echo": func(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error) {
+			var s string
+			if err := decode(&s); err != nil {
+				return nil, err
+			}
+			return s, nil
+		},
+		"fail": func(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error) {
+			return nil, errors.New("failed")
+		},
+		"block": func(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}, nil)
+	connectNodes(t, client, server)
+	return client, server
+}
+
+func idleStreams(c *RPCClient, p peer.ID) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.idle[p])
+}
+
+func TestRPCCall(t *testing.T) {
+	client, server := newRPCTestNodes(t)
+	c := client.RPCClient(testRPCProtocol, nil)
+	defer c.Close()
+	ctx := context.Background()
+	pid := server.Host.ID()
+
+	for i := 0; i < 3; i++ {
+		var resp string
+		if err := c.Call(ctx, pid, "echo", "hello", &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp != "hello" {
+			t.Fatalf("expected hello, got %q", resp)
+		}
+	}
+	// The calls were made one after the other so they shared a stream.
+	if n := idleStreams(c, pid); n != 1 {
+		t.Fatalf("expected 1 idle stream, got %d", n)
+	}
+
+	err := c.Call(ctx, pid, "fail", "", nil)
+	if rpcErr, ok := err.(*RPCError); !ok || rpcErr.Message != "failed" {
+		t.Fatalf("expected the handler's error, got %v", err)
+	}
+	err = c.Call(ctx, pid, "missing", "", nil)
+	if rpcErr, ok := err.(*RPCError); !ok || rpcErr.Message != ErrUnknownMethod.Error() {
+		t.Fatalf("expected ErrUnknownMethod, got %v", err)
+	}
+}
+
+func TestRPCCancelledCallNotReused(t *testing.T) {
+	client, server := newRPCTestNodes(t)
+	c := client.RPCClient(testRPCProtocol, nil)
+	defer c.Close()
+	pid := server.Host.ID()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if err := c.Call(ctx, pid, "block", "", nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if n := idleStreams(c, pid); n != 0 {
+		t.Fatalf("reset stream returned to the pool")
+	}
+
+	// Cancelling the context of a call which already returned doesn't
+	// touch the stream it returned to the pool.
+	ctx, cancel = context.WithCancel(context.Background())
+	var resp string
+	if err := c.Call(ctx, pid, "echo", "hello", &resp); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	time.Sleep(time.Millisecond * 50)
+	if err := c.Call(context.Background(), pid, "echo", "hello", &resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRPCClientClose(t *testing.T) {
+	client, server := newRPCTestNodes(t)
+	pid := server.Host.ID()
+
+	// Give the node's own goroutines a moment to settle.
+	time.Sleep(time.Millisecond * 200)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		client.RPCClient(testRPCProtocol, nil).Close()
+	}
+	ok := waitFor(t, time.Second*5, func() bool {
+		return runtime.NumGoroutine() <= before+5
+	})
+	if !ok {
+		t.Fatalf("closed clients leaked goroutines: %d before, %d after", before, runtime.NumGoroutine())
+	}
+
+	// Streams aren't pooled once the client is closed.
+	c := client.RPCClient(testRPCProtocol, nil)
+	c.Close()
+	var resp string
+	if err := c.Call(context.Background(), pid, "echo", "hello", &resp); err != nil {
+		t.Fatal(err)
+	}
+	if n := idleStreams(c, pid); n != 0 {
+		t.Fatalf("closed client pooled %d streams", n)
+	}
+}
+
+func TestRPCRetriesStreamClosedByServer(t *testing.T) {
+	client, server := newTestNode(t, nil), newTestNode(t, nil)
+	var calls int32
+	server.RegisterService(testRPCProtocol, map[string]RPCHandler{
+		"echo": func(ctx context.Context, from peer.ID, decode func(v interface{}) error) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			var s string
+			if err := decode(&s); err != nil {
+				return nil, err
+			}
+			return s, nil
+		},
+	}, &RPCOpts{IdleTimeout: time.Millisecond * 100})
+	connectNodes(t, client, server)
+	c := client.RPCClient(testRPCProtocol, &RPCOpts{IdleTimeout: time.Minute})
+	defer c.Close()
+	pid := server.Host.ID()
+
+	for i := 0; i < 3; i++ {
+		var resp string
+		if err := c.Call(context.Background(), pid, "echo", "hello", &resp); err != nil {
+			t.Fatalf("call %d: %s", i, err)
+		}
+		if resp != "hello" {
+			t.Fatalf("expected hello, got %q", resp)
+		}
+		// The server closes the pooled stream before the next call.
+		time.Sleep(time.Millisecond * 300)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("handler called %d times", n)
+	}
+	if n := idleStreams(c, pid); n != 1 {
+		t.Fatalf("expected 1 idle stream, got %d", n)
+	}
+}
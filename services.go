@@ -0,0 +1,230 @@
+package overlaynetwork
+
+import (
+	"context"
+	"errors"
+	"github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	"github.com/libp2p/go-libp2p-peerstore"
+	"github.com/libp2p/go-libp2p-routing"
+	"sync"
+	"time"
+)
+
+// ErrNotAdvertised is returned when stopping the advertisement of a service
+// which we are not advertising.
+var ErrNotAdvertised = errors.New("service not advertised")
+
+// serviceNamespace is the namespace of the provider CIDs of services.
+const serviceNamespace = "service"
+
+// serviceRegistry advertises the services this node offers in the DHT and
+// finds other peers offering a service.
+type serviceRegistry struct {
+	ctx        context.Context
+	rt         routing.IpfsRouting
+	ht         host.Host
+	hs         *handshaker
+	cfg        TopicDiscoveryConfig
+	advertised map[string]*advertisement
+	mtx        sync.Mutex
+}
+
+// advertisement is a running service advertisement.
+type advertisement struct {
+	cancel context.CancelFunc
+}
+
+// newServiceRegistry returns a registry which advertises and finds services
+// through rt. Unset settings in cfg are filled from the
+// DefaultTopicDiscoveryConfig.
+func newServiceRegistry(ctx context.Context, rt routing.IpfsRouting, ht host.Host, hs *handshaker, cfg TopicDiscoveryConfig) *serviceRegistry {
+	return &serviceRegistry{
+		ctx:        ctx,
+		rt:         rt,
+		ht:         ht,
+		hs:         hs,
+		cfg:        cfg.withDefaults(),
+		advertised: make(map[string]*advertisement),
+	}
+}
+
+// Advertise announces in the DHT that this node offers the service and adds
+// it to the services we send in the handshake. The provider record is
+// refreshed before it expires until the ttl elapses, the context is cancelled
+// or StopAdvertising is called. A zero ttl advertises the service until the
+// node shuts down.
+//
+// Note that provider records can't be withdrawn so the node may still be
+// returned by FindService for a while after it stops advertising. It is
+// filtered out once peers see that it no longer lists the service in the
+// handshake.
+func (n *OverlayNode) Advertise(ctx context.Context, serviceName string, ttl time.Duration) error {
+	return n.services.advertise(ctx, serviceName, ttl)
+}
+
+// StopAdvertising stops advertising the service.
+func (n *OverlayNode) StopAdvertising(serviceName string) error {
+	return n.services.stop(serviceName)
+}
+
+// FindService returns up to limit peers which offer the service. We connect
+// to each provider found in the DHT and only return the ones which list the
+// service in the handshake.
+func (n *OverlayNode) FindService(ctx context.Context, serviceName string, limit int) ([]peerstore.PeerInfo, error) {
+	return n.services.find(ctx, serviceName, limit)
+}
+
+func (sr *serviceRegistry) advertise(ctx context.Context, service string, ttl time.Duration) error {
+	id, err := providerCID(serviceNamespace, service)
+	if err != nil {
+		return err
+	}
+
+	// The advertisement runs off the node context and also stops when the
+	// caller's context is done. Advertising a service again replaces the
+	// running advertisement.
+	var (
+		advCtx context.Context
+		cancel context.CancelFunc
+	)
+	if ttl > 0 {
+		advCtx, cancel = context.WithTimeout(sr.ctx, ttl)
+	} else {
+		advCtx, cancel = context.WithCancel(sr.ctx)
+	}
+	adv := &advertisement{cancel: cancel}
+
+	sr.mtx.Lock()
+	if old, ok := sr.advertised[service]; ok {
+		old.cancel()
+	}
+	sr.advertised[service] = adv
+	sr.mtx.Unlock()
+
+	sr.hs.addService(service)
+
+	provide := func() error {
+		ctx, cancel := context.WithTimeout(advCtx, sr.cfg.ProvideTimeout)
+		defer cancel()
+		return sr.rt.Provide(ctx, id, true)
+	}
+	if err := provide(); err != nil {
+		sr.remove(service, adv)
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(sr.cfg.ReprovideInterval)
+		defer ticker.Stop()
+		defer sr.remove(service, adv)
+		for {
+			select {
+			case <-ticker.C:
+				// The tick may race with the advertisement being stopped.
+				if advCtx.Err() != nil {
+					return
+				}
+				if err := provide(); err != nil {
+					log.Debugf("services: failed to advertise %s: %s", service, err)
+				}
+			case <-ctx.Done():
+				return
+			case <-advCtx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (sr *serviceRegistry) stop(service string) error {
+	sr.mtx.Lock()
+	adv, ok := sr.advertised[service]
+	sr.mtx.Unlock()
+	if !ok {
+		return ErrNotAdvertised
+	}
+	sr.remove(service, adv)
+	return nil
+}
+
+// remove stops the advertisement and removes the service unless it has been
+// replaced by a newer advertisement.
+func (sr *serviceRegistry) remove(service string, adv *advertisement) {
+	adv.cancel()
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	if sr.advertised[service] != adv {
+		return
+	}
+	delete(sr.advertised, service)
+	sr.hs.removeService(service)
+}
+
+func (sr *serviceRegistry) find(ctx context.Context, service string, limit int) ([]peerstore.PeerInfo, error) {
+	id, err := providerCID(serviceNamespace, service)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Some of the providers may no longer offer the service so we look for
+	// at least MaxProviders of them.
+	count := sr.cfg.MaxProviders
+	if limit > count {
+		count = limit
+	}
+
+	var (
+		found []peerstore.PeerInfo
+		wg    sync.WaitGroup
+		mtx   sync.Mutex
+	)
+	for prov := range sr.rt.FindProvidersAsync(ctx, id, count) {
+		if prov.ID == sr.ht.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(pi peerstore.PeerInfo) {
+			defer wg.Done()
+			if !sr.offers(ctx, pi, service) {
+				return
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			if limit <= 0 || len(found) < limit {
+				found = append(found, sr.ht.Peerstore().PeerInfo(pi.ID))
+				if len(found) == limit {
+					cancel()
+				}
+			}
+		}(prov)
+	}
+	wg.Wait()
+	return found, nil
+}
+
+// offers connects to the peer and checks that it lists the service in the
+// handshake. If the handshake we have is stale we run it again.
+func (sr *serviceRegistry) offers(ctx context.Context, pi peerstore.PeerInfo, service string) bool {
+	if sr.ht.Network().Connectedness(pi.ID) != inet.Connected {
+		ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+		defer cancel()
+		if err := sr.ht.Connect(ctx, pi); err != nil {
+			log.Debugf("services: failed to connect to %s: %s", pi.ID, err)
+			return false
+		}
+	}
+	if info, err := sr.hs.peerInfo(pi.ID); err == nil && info.HasService(service) {
+		return true
+	}
+	// Either the handshake hasn't finished yet or the peer started offering
+	// the service after it. Run it again to get its current services.
+	if err := sr.hs.handshake(ctx, pi.ID); err != nil {
+		return false
+	}
+	info, err := sr.hs.peerInfo(pi.ID)
+	return err == nil && info.HasService(service)
+}
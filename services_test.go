@@ -0,0 +1,179 @@
+package overlaynetwork
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p-peerstore"
+	"testing"
+	"time"
+)
+
+// newTestRegistry returns a service registry for the node which advertises
+// and finds services through rt.
+func newTestRegistry(t *testing.T, n *OverlayNode, rt *fakeProviderRouting, cfg TopicDiscoveryConfig) *serviceRegistry {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newServiceRegistry(ctx, rt, n.Host, n.handshaker, cfg)
+}
+
+func advertising(hs *handshaker, service string) bool {
+	hs.mtx.RLock()
+	defer hs.mtx.RUnlock()
+	for _, s := range hs.services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServiceAdvertise(t *testing.T) {
+	n := newTestNode(t, nil)
+	rt := new(fakeProviderRouting)
+	sr := newTestRegistry(t, n, rt, TopicDiscoveryConfig{ReprovideInterval: time.Millisecond * 50})
+
+	if err := sr.advertise(context.Background(), "swap", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !advertising(n.handshaker, "swap") {
+		t.Fatal("service not added to the handshake")
+	}
+	if !waitFor(t, time.Second*5, func() bool {
+		provides, _ := rt.counts()
+		return provides >= 3
+	}) {
+		t.Fatal("service not re-provided")
+	}
+
+	if err := sr.stop("swap"); err != nil {
+		t.Fatal(err)
+	}
+	if advertising(n.handshaker, "swap") {
+		t.Fatal("service still in the handshake")
+	}
+	// Let a provide which was already running finish.
+	time.Sleep(time.Millisecond * 50)
+	before, _ := rt.counts()
+	time.Sleep(time.Millisecond * 200)
+	if after, _ := rt.counts(); after != before {
+		t.Fatalf("service provided %d times after it was stopped", after-before)
+	}
+	if err := sr.stop("swap"); err != ErrNotAdvertised {
+		t.Fatalf("expected ErrNotAdvertised, got %v", err)
+	}
+}
+
+func TestServiceAdvertiseDefaults(t *testing.T) {
+	n := newTestNode(t, nil)
+	rt := new(fakeProviderRouting)
+	sr := newTestRegistry(t, n, rt, TopicDiscoveryConfig{})
+	if sr.cfg != DefaultTopicDiscoveryConfig {
+		t.Fatalf("expected the default config, got %+v", sr.cfg)
+	}
+
+	// A zero ReprovideInterval would make the ticker panic.
+	if err := sr.advertise(context.Background(), "swap", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sr.stop("swap"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceAdvertiseTTL(t *testing.T) {
+	n := newTestNode(t, nil)
+	sr := newTestRegistry(t, n, new(fakeProviderRouting), TopicDiscoveryConfig{})
+
+	if err := sr.advertise(context.Background(), "swap", time.Millisecond*100); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, time.Second*5, func() bool { return !advertising(n.handshaker, "swap") }) {
+		t.Fatal("service still advertised after the ttl")
+	}
+
+	// Cancelling the caller's context also stops the advertisement.
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := sr.advertise(ctx, "swap", 0); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if !waitFor(t, time.Second*5, func() bool { return !advertising(n.handshaker, "swap") }) {
+		t.Fatal("service still advertised after the context was cancelled")
+	}
+}
+
+func TestFindService(t *testing.T) {
+	n := newTestNode(t, nil)
+	swap := newTestNode(t, func(cfg *NodeConfig) { cfg.Services = []string{"swap"} })
+	other := newTestNode(t, nil)
+	late := newTestNode(t, nil)
+	rt := &fakeProviderRouting{
+		providers: []peerstore.PeerInfo{
+			{ID: n.Host.ID(), Addrs: n.Host.Addrs()},
+			{ID: swap.Host.ID(), Addrs: swap.Host.Addrs()},
+			{ID: other.Host.ID(), Addrs: other.Host.Addrs()},
+			{ID: late.Host.ID(), Addrs: late.Host.Addrs()},
+		},
+	}
+	sr := newTestRegistry(t, n, rt, TopicDiscoveryConfig{MaxProviders: 5})
+
+	// Only the providers which list the service in the handshake are
+	// returned and we're never one of them.
+	found, err := sr.find(context.Background(), "swap", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != swap.Host.ID() {
+		t.Fatalf("expected only the swap node, got %v", found)
+	}
+	if rt.lastCount != 5 {
+		t.Fatalf("expected a search for 5 providers, got %d", rt.lastCount)
+	}
+
+	// A provider which started offering the service after our handshake
+	// with it is found once we run the handshake again.
+	late.handshaker.addService("swap")
+	found, err = sr.find(context.Background(), "swap", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 providers, got %v", found)
+	}
+	if rt.lastCount != 10 {
+		t.Fatalf("expected a search for 10 providers, got %d", rt.lastCount)
+	}
+
+	found, err = sr.find(context.Background(), "swap", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected 1 provider, got %v", found)
+	}
+}
+
+func TestFindServiceDHT(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	connectNodes(t, a, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	if !waitFor(t, time.Second*5, func() bool {
+		return a.Routing.(*dht.IpfsDHT).RoutingTable().Find(b.Host.ID()) != "" &&
+			b.Routing.(*dht.IpfsDHT).RoutingTable().Find(a.Host.ID()) != ""
+	}) {
+		t.Fatal("nodes not added to each other's routing tables")
+	}
+	if err := b.Advertise(ctx, "swap", 0); err != nil {
+		t.Fatal(err)
+	}
+	found, err := a.FindService(ctx, "swap", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != b.Host.ID() {
+		t.Fatalf("expected b, got %v", found)
+	}
+}
@@ -0,0 +1,442 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	"github.com/libp2p/go-libp2p-peer"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStorageQuotaExceeded is returned when storing a record would put the node
+// over its storage quota.
+var ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+
+// StorageConfig controls how much data other peers are allowed to store on
+// this node and how often that data is garbage collected.
+type StorageConfig struct {
+	// Quota is the maximum number of bytes of DHT records we will store.
+	// Once reached, records pushed to us are rejected until GC frees up some
+	// space. Zero means no limit.
+	Quota int64
+
+	// PeerRecordLimit is the maximum number of records a single peer may
+	// store with us per PeerLimitWindow. Zero means no limit.
+	PeerRecordLimit int
+
+	// PeerByteLimit is the maximum number of bytes a single peer may store
+	// with us per PeerLimitWindow. Zero means no limit.
+	PeerByteLimit int64
+
+	// PeerLimitWindow is the window over which the per-peer limits are applied.
+	PeerLimitWindow time.Duration
+
+	// GCInterval governs how often we garbage collect DHT records.
+	GCInterval time.Duration
+
+	// UnrequestedTTL is how long we will keep a record that nobody has asked
+	// us for. Zero means records are only collected once they expire.
+	UnrequestedTTL time.Duration
+}
+
+// DefaultStorageConfig specifies default sane parameters for storage.
+var DefaultStorageConfig = StorageConfig{
+	PeerRecordLimit: 500,
+	PeerByteLimit:   1 << 24,
+	PeerLimitWindow: time.Hour,
+	GCInterval:      time.Hour,
+}
+
+// NamespaceStats holds the record count and size of a datastore namespace.
+type NamespaceStats struct {
+	Records int
+	Bytes   int64
+}
+
+// recordInfo is what the quotaDatastore tracks in memory for each key.
+type recordInfo struct {
+	size       int
+	lastAccess time.Time
+}
+
+// quotaDatastore wraps the DHT datastore to keep track of how much data is
+// stored and when each record was last requested. It rejects writes which
+// would push it over the quota.
+type quotaDatastore struct {
+	datastore.Batching
+
+	quota   int64
+	used    int64
+	records map[datastore.Key]*recordInfo
+	mtx     sync.Mutex
+}
+
+func newQuotaDatastore(child datastore.Batching, quota int64) (*quotaDatastore, error) {
+	q := &quotaDatastore{
+		Batching: child,
+		quota:    quota,
+		records:  make(map[datastore.Key]*recordInfo),
+	}
+	res, err := child.Query(query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	// We don't persist when a record was last requested so after a restart
+	// the time we received it stands in for it. Otherwise every record
+	// would look freshly requested and restarts would defeat the
+	// UnrequestedTTL.
+	for _, entry := range entries {
+		q.records[datastore.NewKey(entry.Key)] = &recordInfo{
+			size:       len(entry.Value),
+			lastAccess: recordReceived(entry.Value),
+		}
+		q.used += int64(len(entry.Value))
+	}
+	return q, nil
+}
+
+// recordReceived returns the time the DHT record was received. The zero time
+// is returned if the value isn't a valid record.
+func recordReceived(value []byte) time.Time {
+	rec := new(recpb.Record)
+	if err := rec.Unmarshal(value); err != nil {
+		return time.Time{}
+	}
+	received, err := time.Parse(time.RFC3339Nano, rec.GetTimeReceived())
+	if err != nil {
+		return time.Time{}
+	}
+	return received
+}
+
+// Put stores the value if doing so doesn't exceed the quota.
+func (q *quotaDatastore) Put(key datastore.Key, value []byte) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	delta := int64(len(value))
+	info, ok := q.records[key]
+	if ok {
+		delta -= int64(info.size)
+	}
+	if q.quota > 0 && delta > 0 && q.used+delta > q.quota {
+		return ErrStorageQuotaExceeded
+	}
+	if err := q.Batching.Put(key, value); err != nil {
+		return err
+	}
+	if !ok {
+		info = &recordInfo{}
+		q.records[key] = info
+	}
+	info.size = len(value)
+	info.lastAccess = time.Now()
+	q.used += delta
+	return nil
+}
+
+// Get returns the value for the key and marks it as requested.
+func (q *quotaDatastore) Get(key datastore.Key) ([]byte, error) {
+	value, err := q.Batching.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	q.mtx.Lock()
+	if info, ok := q.records[key]; ok {
+		info.lastAccess = time.Now()
+	}
+	q.mtx.Unlock()
+	return value, nil
+}
+
+// Delete removes the key and frees up its space.
+func (q *quotaDatastore) Delete(key datastore.Key) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if err := q.Batching.Delete(key); err != nil {
+		return err
+	}
+	if info, ok := q.records[key]; ok {
+		q.used -= int64(info.size)
+		delete(q.records, key)
+	}
+	return nil
+}
+
+// Batch returns a basic batch so that batched writes go through the quota.
+func (q *quotaDatastore) Batch() (datastore.Batch, error) {
+	return datastore.NewBasicBatch(q), nil
+}
+
+// Used returns the number of bytes currently stored.
+func (q *quotaDatastore) Used() int64 {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.used
+}
+
+// storageManager garbage collects the DHT datastore.
+type storageManager struct {
+	ds      *quotaDatastore
+	limiter *storeLimiter
+	cfg     StorageConfig
+}
+
+func newStorageManager(child datastore.Batching, cfg StorageConfig) (*storageManager, error) {
+	ds, err := newQuotaDatastore(child, cfg.Quota)
+	if err != nil {
+		return nil, err
+	}
+	return &storageManager{
+		ds:      ds,
+		limiter: newStoreLimiter(cfg.PeerRecordLimit, cfg.PeerByteLimit, cfg.PeerLimitWindow),
+		cfg:     cfg,
+	}, nil
+}
+
+// run garbage collects on each GCInterval until the context is cancelled.
+func (sm *storageManager) run(ctx context.Context) {
+	if sm.cfg.GCInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(sm.cfg.GCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sm.collectGarbage(); err != nil {
+				log.Errorf("storage gc: %s", err)
+			}
+			sm.limiter.prune()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collectGarbage deletes the DHT records which are expired or haven't been
+// requested within the UnrequestedTTL, and the provider records older than
+// the ProvideValidity. If we are still over 90% of the quota after that, the
+// least recently requested records and the oldest provider records are
+// evicted.
+func (sm *storageManager) collectGarbage() error {
+	res, err := sm.ds.Query(query.Query{})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+
+	type candidate struct {
+		key        datastore.Key
+		lastAccess time.Time
+	}
+	var (
+		now        = time.Now()
+		deleted    int
+		candidates []candidate
+	)
+	for _, entry := range entries {
+		key := datastore.NewKey(entry.Key)
+		if strings.HasPrefix(entry.Key, "/providers/") {
+			provided, err := providerTime(entry.Value)
+			if err != nil || now.Sub(provided) > providers.ProvideValidity {
+				sm.ds.Delete(key)
+				deleted++
+				continue
+			}
+			candidates = append(candidates, candidate{key, provided})
+			continue
+		}
+		rec := new(recpb.Record)
+		if err := rec.Unmarshal(entry.Value); err != nil {
+			log.Debugf("storage gc: deleting corrupt record %s", key)
+			sm.ds.Delete(key)
+			deleted++
+			continue
+		}
+		received, err := time.Parse(time.RFC3339Nano, rec.GetTimeReceived())
+		if err != nil || now.Sub(received) > dht.MaxRecordAge {
+			sm.ds.Delete(key)
+			deleted++
+			continue
+		}
+
+		sm.ds.mtx.Lock()
+		lastAccess := received
+		if info, ok := sm.ds.records[key]; ok && info.lastAccess.After(lastAccess) {
+			lastAccess = info.lastAccess
+		}
+		sm.ds.mtx.Unlock()
+
+		if sm.cfg.UnrequestedTTL > 0 && now.Sub(lastAccess) > sm.cfg.UnrequestedTTL {
+			sm.ds.Delete(key)
+			deleted++
+			continue
+		}
+		candidates = append(candidates, candidate{key, lastAccess})
+	}
+
+	if sm.cfg.Quota > 0 {
+		target := sm.cfg.Quota / 10 * 9
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+		})
+		for _, c := range candidates {
+			if sm.ds.Used() <= target {
+				break
+			}
+			sm.ds.Delete(c.key)
+			deleted++
+		}
+	}
+	log.Debugf("storage gc: deleted %d records, %d bytes in use", deleted, sm.ds.Used())
+	return nil
+}
+
+// providerTime returns the time a provider record was written. The DHT stores
+// it as a varint of the unix time in nanoseconds.
+func providerTime(value []byte) (time.Time, error) {
+	nsec, n := binary.Varint(value)
+	if n <= 0 {
+		return time.Time{}, errors.New("malformed provider record")
+	}
+	return time.Unix(0, nsec), nil
+}
+
+// storeLimiter tracks how many records each peer has stored with us in the
+// current window.
+type storeLimiter struct {
+	recordLimit int
+	byteLimit   int64
+	window      time.Duration
+
+	peers map[peer.ID]*peerStoreUsage
+	mtx   sync.Mutex
+}
+
+type peerStoreUsage struct {
+	records int
+	bytes   int64
+	start   time.Time
+}
+
+func newStoreLimiter(recordLimit int, byteLimit int64, window time.Duration) *storeLimiter {
+	return &storeLimiter{
+		recordLimit: recordLimit,
+		byteLimit:   byteLimit,
+		window:      window,
+		peers:       make(map[peer.ID]*peerStoreUsage),
+	}
+}
+
+// allow records a store request of the given size from the peer and returns
+// whether it is within the peer's limits.
+func (l *storeLimiter) allow(p peer.ID, size int) bool {
+	if l.recordLimit == 0 && l.byteLimit == 0 {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	usage, ok := l.peers[p]
+	if !ok || now.Sub(usage.start) > l.window {
+		usage = &peerStoreUsage{start: now}
+		l.peers[p] = usage
+	}
+	if l.recordLimit > 0 && usage.records+1 > l.recordLimit {
+		return false
+	}
+	if l.byteLimit > 0 && usage.bytes+int64(size) > l.byteLimit {
+		return false
+	}
+	usage.records++
+	usage.bytes += int64(size)
+	return true
+}
+
+// prune removes the peers whose window has ended.
+func (l *storeLimiter) prune() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	for p, usage := range l.peers {
+		if now.Sub(usage.start) > l.window {
+			delete(l.peers, p)
+		}
+	}
+}
+
+// StorageStats returns the number of records and bytes stored under each top
+// level namespace of the node's datastore. The DHT records are also broken
+// down by record namespace, for example "/dht/pk" or "/dht/pow", with the
+// provider records under "/dht/providers".
+func (n *OverlayNode) StorageStats() (map[string]NamespaceStats, error) {
+	res, err := n.Datastore.Query(query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]NamespaceStats)
+	for entry := range res.Next() {
+		if entry.Error != nil {
+			return nil, entry.Error
+		}
+		key := datastore.NewKey(entry.Key)
+		namespaces := []string{"/"}
+		if list := key.List(); len(list) > 1 {
+			namespaces[0] = "/" + list[0]
+		}
+		if DHTNamespace.IsAncestorOf(key) {
+			if ns := dhtRecordNamespace(key); ns != "" {
+				namespaces = append(namespaces, DHTNamespace.ChildString(ns).String())
+			}
+		}
+		for _, ns := range namespaces {
+			s := stats[ns]
+			s.Records++
+			s.Bytes += int64(len(entry.Value))
+			stats[ns] = s
+		}
+	}
+	return stats, nil
+}
+
+// dhtRecordNamespace returns the namespace of the DHT record stored at the
+// key, or an empty string if it can't be determined. The DHT stores records
+// under the base32 encoding of their key and provider records under
+// /providers.
+func dhtRecordNamespace(key datastore.Key) string {
+	list := key.List()
+	if len(list) < 2 {
+		return ""
+	}
+	if list[1] == "providers" {
+		return "providers"
+	}
+	recordKey, err := rawBase32.DecodeString(list[1])
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(string(recordKey), "/", 3)
+	if len(parts) < 3 || parts[0] != "" || parts[1] == "" {
+		return ""
+	}
+	return parts[1]
+}
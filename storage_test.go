@@ -0,0 +1,122 @@
+package overlaynetwork
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"testing"
+	"time"
+)
+
+func TestStorageGCAfterRestart(t *testing.T) {
+	child := dssync.MutexWrap(datastore.NewMapDatastore())
+	put := func(key string, received time.Time) {
+		rec := &recpb.Record{
+			Key:          []byte(key),
+			Value:        []byte("value"),
+			TimeReceived: received.Format(time.RFC3339Nano),
+		}
+		ser, err := rec.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Put(datastore.NewKey(key), ser); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("/stale", time.Now().Add(-time.Hour*2))
+	put("/fresh", time.Now().Add(-time.Minute))
+
+	// The records were written before the storage manager was created, as
+	// if the node had restarted.
+	sm, err := newStorageManager(child, StorageConfig{UnrequestedTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := child.Has(datastore.NewKey("/stale")); has {
+		t.Error("unrequested record survived a restart")
+	}
+	if has, _ := child.Has(datastore.NewKey("/fresh")); !has {
+		t.Error("fresh record was collected")
+	}
+}
+
+func TestStorageGCProviderRecords(t *testing.T) {
+	child := dssync.MutexWrap(datastore.NewMapDatastore())
+	provider := func(name string, provided time.Time) datastore.Key {
+		key := datastore.NewKey("/providers/CID/" + name)
+		buf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutVarint(buf, provided.UnixNano())
+		if err := child.Put(key, buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	now := time.Now()
+	expired := provider("expired", now.Add(-providers.ProvideValidity-time.Hour))
+	var fresh []datastore.Key
+	for i := 0; i < 20; i++ {
+		fresh = append(fresh, provider(fmt.Sprintf("peer%02d", i), now.Add(-time.Minute*time.Duration(20-i))))
+	}
+
+	// The fresh provider records alone are over the quota.
+	sm, err := newStorageManager(child, StorageConfig{Quota: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := child.Has(expired); has {
+		t.Error("expired provider record not collected")
+	}
+	if used := sm.ds.Used(); used > 90 {
+		t.Errorf("still using %d bytes after gc", used)
+	}
+	if has, _ := child.Has(fresh[0]); has {
+		t.Error("oldest provider record not evicted")
+	}
+	if has, _ := child.Has(fresh[len(fresh)-1]); !has {
+		t.Error("newest provider record evicted")
+	}
+}
+
+func TestStorageStatsByRecordNamespace(t *testing.T) {
+	n := newTestNode(t, nil)
+	records := []datastore.Key{
+		DHTNamespace.ChildString(rawBase32.EncodeToString([]byte("/pk/a"))),
+		DHTNamespace.ChildString(rawBase32.EncodeToString([]byte("/pow/a"))),
+		DHTNamespace.ChildString(rawBase32.EncodeToString([]byte("/pow/b"))),
+		DHTNamespace.ChildString("providers").ChildString("CID").ChildString("peer"),
+		AppNamespace.ChildString("a"),
+	}
+	for _, key := range records {
+		if err := n.Datastore.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := n.StorageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{
+		"/dht/pk":        1,
+		"/dht/pow":       2,
+		"/dht/providers": 1,
+		"/app":           1,
+	}
+	for ns, records := range expected {
+		if stats[ns].Records != records || stats[ns].Bytes != int64(records*5) {
+			t.Errorf("%s: unexpected stats %+v", ns, stats[ns])
+		}
+	}
+	if stats["/dht"].Records < 4 {
+		t.Errorf("dht total %+v doesn't include every record", stats["/dht"])
+	}
+}
@@ -0,0 +1,276 @@
+package overlaynetwork
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-libp2p-pubsub"
+	"github.com/ugorji/go/codec"
+	"reflect"
+)
+
+var (
+	// ErrCodecMismatch is returned when decoding a message which was encoded
+	// with a different codec than the one used by the topic.
+	ErrCodecMismatch = errors.New("message encoded with a different codec")
+
+	// ErrUnsupportedSchema is returned when decoding a message whose schema
+	// version is outside of the range accepted by the topic.
+	ErrUnsupportedSchema = errors.New("unsupported schema version")
+
+	// ErrMalformedMessage is returned when a typed message is too short to
+	// contain its header.
+	ErrMalformedMessage = errors.New("malformed typed message")
+)
+
+// Codec serializes the values published to a typed topic. Marshal and
+// Unmarshal are always passed a pointer to the value. If the topic's type is
+// itself a pointer, such as a generated protobuf message, the value is passed
+// as is rather than a pointer to the pointer.
+type Codec interface {
+	// ID is written to the header of each message so that messages encoded
+	// with a different codec can be detected.
+	ID() byte
+
+	// Marshal serializes the value.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal deserializes data into the value.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes values using encoding/json.
+	JSONCodec Codec = jsonCodec{}
+
+	// ProtobufCodec encodes values using protobuf. The topic's type must be a
+	// generated protobuf message.
+	ProtobufCodec Codec = protobufCodec{}
+
+	// CBORCodec encodes values using CBOR.
+	CBORCodec Codec = cborCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte                                   { return 1 }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type protobufCodec struct{}
+
+func (protobufCodec) ID() byte { return 2 }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+type cborCodec struct{}
+
+var cborHandle = new(codec.CborHandle)
+
+func (cborCodec) ID() byte { return 3 }
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	var out []byte
+	err := codec.NewEncoderBytes(&out, cborHandle).Encode(v)
+	return out, err
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, cborHandle).Decode(v)
+}
+
+// TopicOpts holds the options for a typed topic.
+type TopicOpts struct {
+	// SchemaVersion is the version tagged on each message we publish.
+	SchemaVersion uint64
+
+	// MinSchemaVersion is the lowest schema version we accept. Messages
+	// tagged with a version lower than this, or higher than SchemaVersion,
+	// fail to decode.
+	MinSchemaVersion uint64
+
+	// OnDecodeError is called with each message that fails to decode. Such
+	// messages are skipped by the subscription. May be nil.
+	OnDecodeError func(msg *pubsub.Message, err error)
+
+	// Validate registers a topic validator which drops messages that fail
+	// to decode before they are propagated to other peers.
+	Validate bool
+}
+
+// Topic is a pubsub topic whose messages are values of type T serialized
+// with a codec. Each message is prefixed with a header containing the codec
+// ID and schema version. It sits on top of the raw Pubsub API which remains
+// usable for other topics.
+type Topic[T any] struct {
+	ps    *Pubsub
+	name  string
+	codec Codec
+	opts  TopicOpts
+}
+
+// TypedMessage is a decoded message received on a typed topic.
+type TypedMessage[T any] struct {
+	// From is the author of the message.
+	From peer.ID
+
+	// Value is the decoded value.
+	Value T
+
+	// SchemaVersion is the schema version the message was tagged with.
+	SchemaVersion uint64
+
+	// Raw is the underlying pubsub message.
+	Raw *pubsub.Message
+}
+
+// NewTopic returns a typed topic using the given codec. If opts is nil the
+// default options are used.
+func NewTopic[T any](ps *Pubsub, name string, c Codec, opts *TopicOpts) (*Topic[T], error) {
+	t := &Topic[T]{
+		ps:    ps,
+		name:  name,
+		codec: c,
+	}
+	if opts != nil {
+		t.opts = *opts
+	}
+	if t.opts.MinSchemaVersion > t.opts.SchemaVersion {
+		return nil, errors.New("min schema version is greater than schema version")
+	}
+	if t.opts.Validate {
+		err := ps.RegisterTopicValidator(name, func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+			_, _, err := t.decode(msg.GetData())
+			return err == nil
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Name returns the name of the topic.
+func (t *Topic[T]) Name() string {
+	return t.name
+}
+
+// Publish encodes the value and publishes it to the topic.
+func (t *Topic[T]) Publish(ctx context.Context, v T) error {
+	data, err := t.encode(v)
+	if err != nil {
+		return err
+	}
+	return t.ps.Publish(ctx, t.name, data)
+}
+
+// Subscribe subscribes to the topic and returns a subscription which yields
+// decoded values.
+func (t *Topic[T]) Subscribe(ctx context.Context) (*TypedSubscription[T], error) {
+	sub, err := t.ps.Join(ctx, t.name)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedSubscription[T]{sub: sub, topic: t}, nil
+}
+
+func (t *Topic[T]) encode(v T) ([]byte, error) {
+	var target interface{} = &v
+	if isPointer[T]() {
+		target = v
+	}
+	payload, err := t.codec.Marshal(target)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 1+binary.MaxVarintLen64)
+	header[0] = t.codec.ID()
+	n := binary.PutUvarint(header[1:], t.opts.SchemaVersion)
+	return append(header[:1+n], payload...), nil
+}
+
+func (t *Topic[T]) decode(data []byte) (T, uint64, error) {
+	var v T
+	if len(data) < 2 {
+		return v, 0, ErrMalformedMessage
+	}
+	if data[0] != t.codec.ID() {
+		return v, 0, ErrCodecMismatch
+	}
+	version, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return v, 0, ErrMalformedMessage
+	}
+	if version < t.opts.MinSchemaVersion || version > t.opts.SchemaVersion {
+		return v, version, ErrUnsupportedSchema
+	}
+	var target interface{} = &v
+	if isPointer[T]() {
+		v = reflect.New(reflect.TypeOf(v).Elem()).Interface().(T)
+		target = v
+	}
+	if err := t.codec.Unmarshal(data[1+n:], target); err != nil {
+		return v, version, err
+	}
+	return v, version, nil
+}
+
+// isPointer returns whether T is a pointer type.
+func isPointer[T any]() bool {
+	return reflect.TypeOf((*T)(nil)).Elem().Kind() == reflect.Ptr
+}
+
+// TypedSubscription is a subscription to a typed topic.
+type TypedSubscription[T any] struct {
+	sub   *Subscription
+	topic *Topic[T]
+}
+
+// Next returns the next message which decodes successfully. Messages which
+// fail to decode are passed to the topic's OnDecodeError and skipped.
+func (s *TypedSubscription[T]) Next(ctx context.Context) (*TypedMessage[T], error) {
+	for {
+		msg, err := s.sub.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		v, version, err := s.topic.decode(msg.GetData())
+		if err != nil {
+			log.Debugf("topic %s: failed to decode message: %s", s.topic.name, err)
+			if s.topic.opts.OnDecodeError != nil {
+				s.topic.opts.OnDecodeError(msg, err)
+			}
+			continue
+		}
+		from := msg.GetFrom()
+		return &TypedMessage[T]{
+			From:          from,
+			Value:         v,
+			SchemaVersion: version,
+			Raw:           msg,
+		}, nil
+	}
+}
+
+// Cancel cancels the subscription.
+func (s *TypedSubscription[T]) Cancel() {
+	s.sub.Cancel()
+}
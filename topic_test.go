@@ -0,0 +1,106 @@
+package overlaynetwork
+
+import (
+	"bytes"
+	"context"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type topicTestValue struct {
+	Name   string
+	Amount int64
+	Data   []byte
+}
+
+func roundTrip[T any](t *testing.T, c Codec, v T) T {
+	t.Helper()
+	topic := &Topic[T]{name: "test", codec: c, opts: TopicOpts{SchemaVersion: 2, MinSchemaVersion: 1}}
+	data, err := topic.encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, version, err := topic.decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected schema version 2, got %d", version)
+	}
+	return got
+}
+
+func TestTopicCodecRoundTrip(t *testing.T) {
+	value := topicTestValue{Name: "offer", Amount: 5000, Data: []byte{1, 2, 3}}
+	for _, c := range []Codec{JSONCodec, CBORCodec} {
+		if got := roundTrip(t, c, value); !reflect.DeepEqual(got, value) {
+			t.Errorf("codec %d: expected %+v, got %+v", c.ID(), value, got)
+		}
+		if got := roundTrip(t, c, &value); !reflect.DeepEqual(*got, value) {
+			t.Errorf("codec %d: expected %+v, got %+v", c.ID(), value, *got)
+		}
+	}
+
+	// Generated protobuf messages are pointer types.
+	rec := &recpb.Record{Key: []byte("key"), Value: []byte("value"), TimeReceived: "now"}
+	got := roundTrip(t, ProtobufCodec, rec)
+	if !bytes.Equal(got.Key, rec.Key) || !bytes.Equal(got.Value, rec.Value) || got.TimeReceived != rec.TimeReceived {
+		t.Errorf("protobuf: expected %+v, got %+v", rec, got)
+	}
+}
+
+func TestTopicDecodeErrors(t *testing.T) {
+	topic := &Topic[topicTestValue]{name: "test", codec: JSONCodec, opts: TopicOpts{SchemaVersion: 2, MinSchemaVersion: 2}}
+	old := &Topic[topicTestValue]{name: "test", codec: JSONCodec, opts: TopicOpts{SchemaVersion: 1}}
+	oldData, err := old.encode(topicTestValue{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cborData, err := (&Topic[topicTestValue]{codec: CBORCodec, opts: TopicOpts{SchemaVersion: 2}}).encode(topicTestValue{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrMalformedMessage},
+		{"codec mismatch", cborData, ErrCodecMismatch},
+		{"old schema", oldData, ErrUnsupportedSchema},
+	}
+	for _, test := range tests {
+		if _, _, err := topic.decode(test.data); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestTopicPublishSubscribe(t *testing.T) {
+	n := newTestNode(t, nil)
+	topic, err := NewTopic[*recpb.Record](n.PubSub, "typed", ProtobufCodec, &TopicOpts{Validate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	sub, err := topic.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+
+	if err := topic.Publish(ctx, &recpb.Record{Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Value.Key) != "key" || msg.From != n.Host.ID() {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+}
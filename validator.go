@@ -1,10 +1,15 @@
 package overlaynetwork
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"github.com/gcash/bchd/chaincfg"
 	"github.com/libp2p/go-libp2p-record"
+	"math/bits"
+	"time"
 )
 
 // TODO: we should take our time a define a number of validators that we
@@ -19,8 +24,51 @@ var (
 	// ErrInvalidSha256Record represents an error that is returned when the
 	// key is not the hex encoded sha256 hash of the value.
 	ErrInvalidSha256Record = errors.New("value does not hash to the key")
+
+	// ErrInvalidPowRecord represents an error that is returned when a pow
+	// record is malformed or the key is not the hash of the value.
+	ErrInvalidPowRecord = errors.New("invalid pow record")
+
+	// ErrInsufficientWork represents an error that is returned when the
+	// proof of work in a pow record is below the required difficulty.
+	ErrInsufficientWork = errors.New("insufficient proof of work")
+
+	// ErrPowRecordExpired represents an error that is returned when a pow
+	// record is past its expiration.
+	ErrPowRecordExpired = errors.New("pow record expired")
+
+	// ErrPowLifetimeTooLong represents an error that is returned when a pow
+	// record expires further in the future than PowMaxLifetime.
+	ErrPowLifetimeTooLong = errors.New("pow record lifetime too long")
+
+	// PowDifficulty is the number of leading zero bits required in the hash of
+	// a pow record with a payload of up to PowDifficultyUnit bytes on each
+	// network. Networks not in the map use DefaultPowDifficulty.
+	PowDifficulty = map[string]int{
+		chaincfg.MainNetParams.Name:       20,
+		chaincfg.TestNet3Params.Name:      16,
+		chaincfg.RegressionNetParams.Name: 4,
+		chaincfg.SimNetParams.Name:        4,
+	}
+
+	// DefaultPowDifficulty is the difficulty used for networks which are not
+	// in the PowDifficulty map.
+	DefaultPowDifficulty = 16
+
+	// PowDifficultyUnit is the payload size covered by the base difficulty.
+	// Each time the payload size doubles beyond this one more bit of
+	// difficulty is required, which doubles the expected work.
+	PowDifficultyUnit = 1024
+
+	// PowMaxLifetime is the max amount of time a pow record may be valid
+	// for. Without it work done once could keep a record alive forever.
+	PowMaxLifetime = time.Hour * 36
 )
 
+// powHeaderLen is the length of the nonce and expiration which precede the
+// payload of a pow record.
+const powHeaderLen = 16
+
 // Sha256Validator is a basic validator used by the DHT to validate that
 // the key for any given record is the hex encoded sha256 hash of the value.
 type Sha256Validator struct{}
@@ -49,3 +97,129 @@ func (v *Sha256Validator) Validate(key string, value []byte) error {
 func (v *Sha256Validator) Select(key string, values [][]byte) (int, error) {
 	return 0, nil
 }
+
+// PowValidator is a validator for a spam resistant DHT namespace. Records in
+// the pow namespace consist of an 8 byte nonce, an 8 byte big endian unix
+// expiration time and the payload. The key is the hex encoded sha256 hash of
+// the value and the hash must have a number of leading zero bits which scales
+// with the size of the payload.
+type PowValidator struct {
+	// Difficulty is the number of leading zero bits required for payloads
+	// of up to PowDifficultyUnit bytes.
+	Difficulty int
+}
+
+// NewPowValidator returns a PowValidator using the difficulty for the
+// given network.
+func NewPowValidator(params *chaincfg.Params) *PowValidator {
+	difficulty, ok := PowDifficulty[params.Name]
+	if !ok {
+		difficulty = DefaultPowDifficulty
+	}
+	return &PowValidator{Difficulty: difficulty}
+}
+
+// Validate validates the given record, returning an error if it's
+// invalid (e.g., expired, signed by the wrong key, etc.).
+func (v *PowValidator) Validate(key string, value []byte) error {
+	ns, key, err := record.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	if ns != "pow" {
+		return errors.New("namespace not 'pow'")
+	}
+	if len(value) < powHeaderLen {
+		return ErrInvalidPowRecord
+	}
+	h := sha256.Sum256(value)
+	if key != hex.EncodeToString(h[:]) {
+		return ErrInvalidPowRecord
+	}
+	if leadingZeroBits(h[:]) < RequiredPowBits(v.Difficulty, len(value)-powHeaderLen) {
+		return ErrInsufficientWork
+	}
+	expires, err := PowExpiration(value)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !now.Before(expires) {
+		return ErrPowRecordExpired
+	}
+	if expires.Sub(now) > PowMaxLifetime {
+		return ErrPowLifetimeTooLong
+	}
+	return nil
+}
+
+// Select selects the best record from the set of records (e.g., the
+// newest).
+//
+// Decisions made by select should be stable.
+func (v *PowValidator) Select(key string, values [][]byte) (int, error) {
+	return 0, nil
+}
+
+// RequiredPowBits returns the number of leading zero bits required for a
+// payload of the given size.
+func RequiredPowBits(difficulty, size int) int {
+	required := difficulty
+	for unit := PowDifficultyUnit; unit < size; unit *= 2 {
+		required++
+	}
+	return required
+}
+
+// MinePowRecord searches for a nonce which satisfies the difficulty for
+// the payload and returns the DHT key and value of the resulting record.
+// The record is valid until expires, which must be within PowMaxLifetime
+// when the record is stored. This may take a while for large payloads or
+// high difficulties so it returns early if the context is cancelled.
+func MinePowRecord(ctx context.Context, payload []byte, difficulty int, expires time.Time) (string, []byte, error) {
+	required := RequiredPowBits(difficulty, len(payload))
+	value := make([]byte, powHeaderLen+len(payload))
+	binary.BigEndian.PutUint64(value[8:powHeaderLen], uint64(expires.Unix()))
+	copy(value[powHeaderLen:], payload)
+	for nonce := uint64(0); ; nonce++ {
+		if nonce%(1<<16) == 0 {
+			select {
+			case <-ctx.Done():
+				return "", nil, ctx.Err()
+			default:
+			}
+		}
+		binary.BigEndian.PutUint64(value[:8], nonce)
+		h := sha256.Sum256(value)
+		if leadingZeroBits(h[:]) >= required {
+			return "/pow/" + hex.EncodeToString(h[:]), value, nil
+		}
+	}
+}
+
+// PowPayload returns the payload from a pow record value.
+func PowPayload(value []byte) ([]byte, error) {
+	if len(value) < powHeaderLen {
+		return nil, ErrInvalidPowRecord
+	}
+	return value[powHeaderLen:], nil
+}
+
+// PowExpiration returns the expiration time of a pow record value.
+func PowExpiration(value []byte) (time.Time, error) {
+	if len(value) < powHeaderLen {
+		return time.Time{}, ErrInvalidPowRecord
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(value[8:powHeaderLen])), 0), nil
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,83 @@
+package overlaynetwork
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestPowValidator(t *testing.T) {
+	const difficulty = 8
+	v := &PowValidator{Difficulty: difficulty}
+	mine := func(payload []byte, difficulty int, expires time.Time) (string, []byte) {
+		key, value, err := MinePowRecord(context.Background(), payload, difficulty, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, value
+	}
+	hourFromNow := time.Now().Add(time.Hour)
+
+	// Find a record which meets a lower difficulty but not ours.
+	var weakKey string
+	var weakValue []byte
+	for i := 0; ; i++ {
+		weakKey, weakValue = mine([]byte{byte(i)}, difficulty-4, hourFromNow)
+		h := sha256.Sum256(weakValue)
+		if leadingZeroBits(h[:]) < difficulty {
+			break
+		}
+	}
+
+	validKey, validValue := mine([]byte("swap offer"), difficulty, hourFromNow)
+	otherKey, _ := mine([]byte("other offer"), difficulty, hourFromNow)
+	expiredKey, expiredValue := mine([]byte("swap offer"), difficulty, time.Now().Add(-time.Minute))
+	longKey, longValue := mine([]byte("swap offer"), difficulty, time.Now().Add(PowMaxLifetime*2))
+
+	// A large payload needs more work than the base difficulty.
+	large := make([]byte, PowDifficultyUnit*2)
+	largeKey, largeValue := mine(large, difficulty, hourFromNow)
+	underKey, underValue := mine(large, difficulty-1, hourFromNow)
+	for {
+		h := sha256.Sum256(underValue)
+		if leadingZeroBits(h[:]) < RequiredPowBits(difficulty, len(large)) {
+			break
+		}
+		large[0]++
+		underKey, underValue = mine(large, difficulty-1, hourFromNow)
+	}
+
+	h := sha256.Sum256([]byte("short"))
+	shortKey := "/pow/" + hex.EncodeToString(h[:])
+
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+		err   error
+	}{
+		{"valid", validKey, validValue, nil},
+		{"valid large payload", largeKey, largeValue, nil},
+		{"too little work", weakKey, weakValue, ErrInsufficientWork},
+		{"too little work for payload size", underKey, underValue, ErrInsufficientWork},
+		{"wrong key", otherKey, validValue, ErrInvalidPowRecord},
+		{"too short", shortKey, []byte("short"), ErrInvalidPowRecord},
+		{"expired", expiredKey, expiredValue, ErrPowRecordExpired},
+		{"lifetime too long", longKey, longValue, ErrPowLifetimeTooLong},
+	}
+	for _, test := range tests {
+		if err := v.Validate(test.key, test.value); err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	if err := v.Validate("/sha256/"+validKey[len("/pow/"):], validValue); err == nil {
+		t.Error("record accepted in the wrong namespace")
+	}
+	payload, err := PowPayload(validValue)
+	if err != nil || string(payload) != "swap offer" {
+		t.Errorf("expected payload %q, got %q (%v)", "swap offer", payload, err)
+	}
+}